@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// connectionUsage counts the media bytes sent to a connection, for a data usage report when it closes.
+// It is updated from the send loop and read from the state handlers, so it is only accessed atomically.
+type connectionUsage struct {
+	bytesSent   uint64
+	offerAt     int64
+	connectedAt int64
+	// firstSampleAt is when the first sample was written, to measure the time to first frame
+	firstSampleAt int64
+	// relayServer is the TURN server the selected candidate pair is relayed through, if any
+	relayServer atomic.Value
+}
+
+func newConnectionUsage(offerAt time.Time) *connectionUsage {
+	return &connectionUsage{offerAt: offerAt.UnixNano()}
+}
+
+// sent records a sample of n bytes successfully written to the track, RTP and SRTP overhead is not included
+func (u *connectionUsage) sent(n int) {
+	atomic.AddUint64(&u.bytesSent, uint64(n))
+	if atomic.LoadInt64(&u.firstSampleAt) == 0 {
+		atomic.CompareAndSwapInt64(&u.firstSampleAt, 0, time.Now().UnixNano())
+	}
+}
+
+// timeToFirstFrame returns the time from receiving the offer to writing the first sample, 0 when none was written yet
+func (u *connectionUsage) timeToFirstFrame() time.Duration {
+	firstSampleAt := atomic.LoadInt64(&u.firstSampleAt)
+	if firstSampleAt == 0 {
+		return 0
+	}
+	return time.Duration(firstSampleAt - u.offerAt)
+}
+
+func (u *connectionUsage) connected(at time.Time) {
+	atomic.CompareAndSwapInt64(&u.connectedAt, 0, at.UnixNano())
+}
+
+// report returns the bytes sent and how long the connection has been connected
+func (u *connectionUsage) report(now time.Time) (uint64, time.Duration) {
+	duration := time.Duration(0)
+	if connectedAt := atomic.LoadInt64(&u.connectedAt); connectedAt != 0 {
+		duration = now.Sub(time.Unix(0, connectedAt))
+	}
+	return atomic.LoadUint64(&u.bytesSent), duration
+}
+
+func (u *connectionUsage) relayedVia(server string) {
+	u.relayServer.Store(server)
+}
+
+// relayedThrough returns the TURN server the connection was relayed through last, empty when it was not relayed
+func (u *connectionUsage) relayedThrough() string {
+	server, _ := u.relayServer.Load().(string)
+	return server
+}
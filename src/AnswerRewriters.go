@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	answerRewrites = flag.String("answer-rewrite", "", "comma separated rewriters applied in order to the SDP answer sent to the client, like strip-rtx,candidate-ip=203.0.113.7,bitrate=2000. Known are "+strings.Join(answerRewriterNames(), ", "))
+)
+
+// AnswerRewriter changes the answer we send to the client, for transformations that differ between deployments.
+// pion rejects a local description it did not generate, so rewriters only change what the client receives,
+// never what pion negotiated.
+type AnswerRewriter interface {
+	Rewrite(answer string) string
+}
+
+// AnswerRewriterFunc is a function used as AnswerRewriter
+type AnswerRewriterFunc func(answer string) string
+
+func (f AnswerRewriterFunc) Rewrite(answer string) string {
+	return f(answer)
+}
+
+// answerRewriterFactories create the rewriters -answer-rewrite can select, from the value after the = of their name.
+// A new rewriter only needs to be added here.
+var answerRewriterFactories = map[string]func(value string) (AnswerRewriter, error){
+	"bitrate":      newBitrateRewriter,
+	"candidate-ip": newCandidateIpRewriter,
+	"strip-codec":  newStripCodecRewriter,
+	"strip-rtx": func(value string) (AnswerRewriter, error) {
+		if value != "" {
+			return nil, fmt.Errorf("strip-rtx takes no value")
+		}
+		return newStripCodecRewriter("rtx")
+	},
+}
+
+func answerRewriterNames() []string {
+	names := []string{}
+	for name := range answerRewriterFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configuredAnswerRewriters are the rewriters of -answer-rewrite, set by validateAnswerRewrites
+var configuredAnswerRewriters []AnswerRewriter
+
+func validateAnswerRewrites() error {
+	configuredAnswerRewriters = nil
+	for _, value := range strings.Split(*answerRewrites, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		name, argument := value, ""
+		if i := strings.Index(value, "="); i >= 0 {
+			name, argument = value[:i], value[i+1:]
+		}
+		factory, ok := answerRewriterFactories[name]
+		if !ok {
+			return fmt.Errorf("unknown rewriter %s, use one of %s", name, strings.Join(answerRewriterNames(), ", "))
+		}
+		rewriter, err := factory(argument)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		configuredAnswerRewriters = append(configuredAnswerRewriters, rewriter)
+	}
+	return nil
+}
+
+// rewriteAnswer applies the built-in changes to an answer of pion and then the rewriters of -answer-rewrite
+func rewriteAnswer(answer string) string {
+	answer = addSpropParameterSets(addAnswerBitrate(sendOnly(pinAnswerProfileLevelId(answer))))
+	for _, rewriter := range configuredAnswerRewriters {
+		answer = rewriter.Rewrite(answer)
+	}
+	return answer
+}
+
+// newBitrateRewriter sets the b=AS of the video, like -answer-bitrate
+func newBitrateRewriter(value string) (AnswerRewriter, error) {
+	kbps, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || kbps == 0 {
+		return nil, fmt.Errorf("%q is not a bitrate in kbps", value)
+	}
+	return AnswerRewriterFunc(func(answer string) string {
+		return setVideoBandwidth(answer, kbps)
+	}), nil
+}
+
+// newCandidateIpRewriter announces the host candidates at another address, for a server behind a 1:1 NAT or
+// a port forward that keeps the port. Candidates trickled after the answer are not rewritten.
+func newCandidateIpRewriter(value string) (AnswerRewriter, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", value)
+	}
+	address := ip.String()
+	return AnswerRewriterFunc(func(answer string) string {
+		lines := strings.Split(answer, "\r\n")
+		for i, line := range lines {
+			if !strings.HasPrefix(line, "a=candidate:") {
+				continue
+			}
+			// foundation component transport priority address port typ type ...
+			fields := strings.Fields(line)
+			if len(fields) < 8 || fields[7] != "host" {
+				continue
+			}
+			fields[4] = address
+			lines[i] = strings.Join(fields, " ")
+		}
+		return strings.Join(lines, "\r\n")
+	}), nil
+}
+
+// newStripCodecRewriter leaves a codec out of every media section, like rtx when the client should not try to use retransmissions
+func newStripCodecRewriter(value string) (AnswerRewriter, error) {
+	if value == "" {
+		return nil, fmt.Errorf("the name of the codec is required")
+	}
+	return AnswerRewriterFunc(func(answer string) string {
+		return stripCodec(answer, value)
+	}), nil
+}
+
+// stripCodec removes the payload types of the codec from the m= lines of the description, together with their attributes
+func stripCodec(description string, codec string) string {
+	lines := strings.Split(description, "\r\n")
+	stripped := map[string]bool{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "a=rtpmap:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+		if len(fields) == 2 && strings.EqualFold(strings.Split(fields[1], "/")[0], codec) {
+			stripped[fields[0]] = true
+		}
+	}
+	if len(stripped) == 0 {
+		return description
+	}
+	kept := []string{}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			// m=<media> <port> <proto> <formats>...
+			fields := strings.Fields(line)
+			formats := fields[:3]
+			for _, format := range fields[3:] {
+				if !stripped[format] {
+					formats = append(formats, format)
+				}
+			}
+			kept = append(kept, strings.Join(formats, " "))
+			continue
+		}
+		if payloadType, ok := attributePayloadType(line); ok && stripped[payloadType] {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\r\n")
+}
+
+// attributePayloadType returns the payload type of an a=rtpmap, a=fmtp or a=rtcp-fb line
+func attributePayloadType(line string) (string, bool) {
+	for _, prefix := range []string{"a=rtpmap:", "a=fmtp:", "a=rtcp-fb:"} {
+		if fields := strings.Fields(strings.TrimPrefix(line, prefix)); strings.HasPrefix(line, prefix) && len(fields) > 0 {
+			return fields[0], true
+		}
+	}
+	return "", false
+}
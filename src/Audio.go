@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+var (
+	audioArgs      = flag.String("audio-args", "", "ffmpeg arguments producing Opus audio in an Ogg container on stdout, separated by spaces, to also send audio to clients offering to receive it. Empty sends video only")
+	opusBitrate    = flag.String("opus-bitrate", "", "target bitrate of the Opus encoder, like 64k, from 6k to 510k. Empty uses the bitrate of -audio-args")
+	opusFec        = flag.Bool("opus-fec", true, "enable the inband forward error correction of Opus, so a lost packet can be recovered from the next one")
+	opusPacketLoss = flag.Int("opus-packet-loss", 10, "expected packet loss in percent the Opus encoder adds forward error correction for, from 1 to 100")
+	opusDtx        = flag.Bool("opus-dtx", false, "enable the discontinuous transmission of Opus, which sends almost nothing during silence")
+)
+
+// opusPageDuration is the -page_duration in microseconds ffmpeg is started with, unless -audio-args sets it
+const opusPageDuration = "20000"
+
+func validateOpus() error {
+	if *opusBitrate != "" {
+		bitrate, ok := parseFfmpegBitrate(*opusBitrate)
+		if !ok || bitrate < 6000 || bitrate > 510000 {
+			return fmt.Errorf("-opus-bitrate: %s is not a bitrate from 6k to 510k", *opusBitrate)
+		}
+	}
+	if *opusFec && (*opusPacketLoss < 1 || *opusPacketLoss > 100) {
+		return errors.New("-opus-packet-loss: must be from 1 to 100")
+	}
+	return nil
+}
+
+// opusFfmpegArgs returns audioArgs, like -audio-args, with the libopus options of the -opus flags added before the output,
+// the last argument. maxBitrate is the maxaveragebitrate the client offered in bits per second, the bitrate is lowered
+// to it when it is not 0. Every Ogg page holds a single 20ms packet, as the pages are sent as samples.
+func opusFfmpegArgs(audioArgs string, maxBitrate uint64) []string {
+	args := strings.Fields(audioArgs)
+	options := []string{}
+	bitrate := *opusBitrate
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-b:a" {
+			if bitrate == "" {
+				bitrate = args[i+1]
+			}
+			args = append(args[:i:i], args[i+2:]...)
+			i--
+		}
+	}
+	if maxBitrate > 0 {
+		if parsed, ok := parseFfmpegBitrate(bitrate); !ok || parsed > maxBitrate {
+			bitrate = strconv.FormatUint(maxBitrate, 10)
+		}
+	}
+	if bitrate != "" {
+		options = append(options, "-b:a", bitrate)
+	}
+	if *opusFec {
+		options = append(options, "-fec", "1", "-packet_loss", strconv.Itoa(*opusPacketLoss))
+	}
+	if *opusDtx {
+		options = append(options, "-dtx", "1")
+	}
+	if !containsArg(args, "-page_duration") {
+		options = append(options, "-page_duration", opusPageDuration)
+	}
+	if len(args) == 0 {
+		return options
+	}
+	output := len(args) - 1
+	return append(append(append([]string{}, args[:output]...), options...), args[output:]...)
+}
+
+func containsArg(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == name {
+			return true
+		}
+	}
+	return false
+}
+
+// offersOpus reports whether the offer has an enabled audio section with Opus
+func offersOpus(offer string) bool {
+	parsedOffer := &sdp.SessionDescription{}
+	if err := parsedOffer.Unmarshal([]byte(offer)); err != nil {
+		return false
+	}
+	for _, name := range mediaCodecNames(parsedOffer, "audio") {
+		if strings.EqualFold(name, "opus") {
+			return true
+		}
+	}
+	return false
+}
+
+var opusMaxAverageBitratePattern = regexp.MustCompile(`maxaveragebitrate=(\d+)`)
+
+// offeredOpusBitrate returns the maxaveragebitrate in bits per second the client wants to receive Opus at most with,
+// from the fmtp of Opus in the offer (RFC 7587 section 6.1), or 0 when it does not limit it
+func offeredOpusBitrate(offer string) uint64 {
+	parsedOffer := &sdp.SessionDescription{}
+	if err := parsedOffer.Unmarshal([]byte(offer)); err != nil {
+		return 0
+	}
+	for _, media := range parsedOffer.MediaDescriptions {
+		if media.MediaName.Media != "audio" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.Atoi(format)
+			if err != nil {
+				continue
+			}
+			codec, err := parsedOffer.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil || !strings.EqualFold(codec.Name, "opus") {
+				continue
+			}
+			if match := opusMaxAverageBitratePattern.FindStringSubmatch(codec.Fmtp); match != nil {
+				bitrate, _ := strconv.ParseUint(match[1], 10, 64)
+				return bitrate
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// pipeReadSeeker passes a pipe to the oggreader, which only reads
+type pipeReadSeeker struct {
+	io.Reader
+}
+
+func (pipeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("cannot seek in a pipe")
+}
+
+// sendAudio starts the audio ffmpeg with audioArgs and sends its Ogg pages on the track once the connection is established,
+// until the connection is closed. When the audio cannot be started the video is sent without it.
+func sendAudio(logger connectionLogger, peerConnection *webrtc.PeerConnection, offer string, audioArgs string, audioTrack *webrtc.TrackLocalStaticSample, hold *holdState, started <-chan struct{}, closed <-chan struct{}) {
+	defer lastWill()
+	args := opusFfmpegArgs(audioArgs, offeredOpusBitrate(offer))
+	logger.Printf("Sending audio from ffmpeg %s\n", strings.Join(args, " "))
+	pipe, err := RunCommand("ffmpeg", withLogLevel(args)...)
+	if err != nil {
+		logger.Printf("Cannot start the audio: %v\n", err)
+		return
+	}
+	defer func() {
+		if cErr := pipe.Close(); cErr != nil {
+			logger.Printf("cannot close audio pipe: %v\n", cErr)
+		}
+	}()
+
+	ogg, _, err := oggreader.NewWith(pipeReadSeeker{pipe})
+	if err != nil {
+		logger.Printf("Cannot read the audio: %v\n", err)
+		return
+	}
+
+	select {
+	case <-started:
+	case <-closed:
+		return
+	}
+
+	// The pages are paced at their duration, like the video frames, so a file input is not sent all at once
+	var lastGranule uint64
+	sendAt := time.Now()
+	for {
+		select {
+		case <-closed:
+			return
+		default:
+		}
+
+		page, header, err := ogg.ParseNextPage()
+		if err == io.EOF {
+			logger.Printf("All audio pages sent\n")
+			return
+		}
+		if err != nil {
+			logger.Printf("Cannot read the audio: %v\n", err)
+			return
+		}
+		// The granule position counts the samples at 48 kHz up to the end of the page.
+		// The comment header page that follows the identification header has no samples.
+		samples := header.GranulePosition - lastGranule
+		lastGranule = header.GranulePosition
+		if samples == 0 {
+			continue
+		}
+		duration := time.Duration(samples) * time.Second / audioClockRate
+		if hold.isHeld() {
+			sendAt = sendAt.Add(duration)
+			time.Sleep(time.Until(sendAt))
+			continue
+		}
+		if err := audioTrack.WriteSample(media.Sample{Data: page, Duration: duration}); err != nil && connectionClosing(peerConnection) {
+			logger.Debugf("Stopped sending audio, the connection is closing: %v\n", err)
+			return
+		} else if err != nil {
+			logger.Printf("Cannot send the audio: %v\n", err)
+			return
+		}
+		sendAt = sendAt.Add(duration)
+		time.Sleep(time.Until(sendAt))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var audioTracks = &audioTrackList{}
+
+func init() {
+	flag.Var(audioTracks, "audio-track", "audio in another language as \"<language> <ffmpeg arguments>\", like \"es -i input.ts -map 0:a:1 -c:a libopus -f ogg -\", can be repeated. Clients select it with ?audio=<language>, the others get -audio-args or else the first -audio-track")
+}
+
+// audioTrack is an audio track clients can select by its language, with the ffmpeg arguments producing it
+type audioTrack struct {
+	language string
+	args     string
+}
+
+// audioTrackList is a repeatable flag, in the order the tracks were given
+type audioTrackList struct {
+	tracks []audioTrack
+}
+
+func (l *audioTrackList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.languages(), ",")
+}
+
+func (l *audioTrackList) Set(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return errors.New("expected \"<language> <ffmpeg arguments>\"")
+	}
+	for _, track := range l.tracks {
+		if track.language == fields[0] {
+			return fmt.Errorf("the %s audio track is given twice", fields[0])
+		}
+	}
+	l.tracks = append(l.tracks, audioTrack{language: fields[0], args: strings.Join(fields[1:], " ")})
+	return nil
+}
+
+func (l *audioTrackList) languages() []string {
+	languages := []string{}
+	for _, track := range l.tracks {
+		languages = append(languages, track.language)
+	}
+	return languages
+}
+
+// errUnknownAudioLanguage is returned by selectAudioArgs for a language there is no -audio-track for
+var errUnknownAudioLanguage = errors.New("unknown audio language")
+
+// defaultAudioArgs returns the ffmpeg arguments of the audio of clients that select no language,
+// -audio-args or else the first -audio-track. Empty arguments send video only.
+func defaultAudioArgs() string {
+	if *audioArgs == "" && len(audioTracks.tracks) > 0 {
+		return audioTracks.tracks[0].args
+	}
+	return *audioArgs
+}
+
+// selectAudioArgs returns the ffmpeg arguments of the audio in language, the default audio when it is empty
+func selectAudioArgs(language string) (string, error) {
+	if language == "" {
+		return defaultAudioArgs(), nil
+	}
+	for _, track := range audioTracks.tracks {
+		if track.language == language {
+			return track.args, nil
+		}
+	}
+	return "", errUnknownAudioLanguage
+}
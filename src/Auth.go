@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+var (
+	authToken = flag.String("auth-token", "", "require \"Authorization: Bearer <token>\" on the signaling and configuration endpoints")
+)
+
+// requireToken rejects requests without the -auth-token bearer token, when it is set
+func requireToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *authToken == "" {
+			handler(w, r)
+			return
+		}
+		token := ""
+		if authorization := r.Header.Get("Authorization"); len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+			token = authorization[len("Bearer "):]
+		}
+		// Compare in constant time, so the token cannot be guessed byte by byte from the response time
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*authToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
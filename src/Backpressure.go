@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	backpressureThreshold = flag.Duration("backpressure-threshold", 50*time.Millisecond, "drop frames when writing a single frame takes longer than this, 0 to never drop")
+	pauseThreshold        = flag.Duration("pause-threshold", time.Second, "when the send loop was paused for longer than this, for example by a suspend, drop the frames that queued up until the next keyframe, 0 to never drop")
+)
+
+// frameDropper drops frames when WriteSample cannot keep up with the source,
+// so latency stays bounded instead of frames queueing up.
+//
+// While behind, non-reference slices are dropped. If we stay behind, every slice
+// is dropped until the next IDR, as the decoder cannot use P-frames whose reference is gone.
+//
+// After the send loop was paused, the frames ffmpeg produced meanwhile are dropped and sending resumes
+// at the next IDR, instead of sending the backlog at the frame rate, which shows as the video running behind.
+//
+// With -send-queue the frames are written by another goroutine than the one reading them, the lock guards the fields then.
+type frameDropper struct {
+	lock           sync.Mutex
+	logger         connectionLogger
+	threshold      time.Duration
+	pauseThreshold time.Duration
+	lastTick       time.Time
+	// backlog is the number of frames that queued up during a pause and still have to be dropped
+	backlog         int
+	behind          bool
+	waitForKeyframe bool
+	// keyframeReason is the reason reported for the frames dropped while waiting for a keyframe
+	keyframeReason string
+	dropped        int
+	reporter       *dropReporter
+	// pending is the number of frames dropped since the last frame sent, which the next frame sent lasts longer
+	pending int
+	// congestion drops the non-reference pictures that do not fit in the bandwidth, nil when not responding to congestion
+	congestion congestionController
+}
+
+func isSlice(unitType h264reader.NalUnitType) bool {
+	return unitType >= h264reader.NalUnitTypeCodedSliceNonIdr && unitType <= h264reader.NalUnitTypeCodedSliceIdr
+}
+
+// shouldDrop reports whether nal must be dropped instead of sent
+func (d *frameDropper) shouldDrop(nal *h264reader.NAL) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.congestion != nil && isSlice(nal.UnitType) {
+		d.congestion.slice(len(nal.Data), nal.RefIdc != 0)
+	}
+	if d.backlog > 0 && isSlice(nal.UnitType) {
+		d.backlog--
+		d.dropped++
+		d.pending++
+		d.reporter.frame(dropReasonPause)
+		return true
+	}
+	if nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr {
+		d.waitForKeyframe = false
+		d.flushLog()
+		return false
+	}
+	if !isSlice(nal.UnitType) {
+		return false
+	}
+	if d.waitForKeyframe {
+		d.dropped++
+		d.pending++
+		d.reporter.frame(d.keyframeReason)
+		return true
+	}
+	if d.behind && nal.RefIdc == 0 {
+		d.dropped++
+		d.pending++
+		d.reporter.frame(dropReasonBackpressure)
+		return true
+	}
+	if d.congestion != nil && d.congestion.dropPicture(nal.RefIdc != 0) {
+		d.pending++
+		d.reporter.frame(dropReasonCongestion)
+		return true
+	}
+	d.flushLog()
+	return false
+}
+
+// continued records a slice that continues the picture passed to shouldDrop, which follows its decision
+func (d *frameDropper) continued(nal *h264reader.NAL) {
+	if d.congestion != nil {
+		d.congestion.slice(len(nal.Data), nal.RefIdc != 0)
+	}
+}
+
+// sampleDuration returns the duration of the frame sent next, it also lasts as long as the frames dropped before it,
+// so the timestamps keep following the source
+func (d *frameDropper) sampleDuration(frame time.Duration) time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	duration := frame * time.Duration(d.pending+1)
+	d.pending = 0
+	return duration
+}
+
+// wrote records how long writing the last frame took
+func (d *frameDropper) wrote(latency time.Duration) {
+	if d.threshold <= 0 {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if latency <= d.threshold {
+		d.behind = false
+		return
+	}
+	if d.behind && !d.waitForKeyframe {
+		d.logger.Printf("Still falling behind (writing a frame took %v), dropping frames until the next keyframe\n", latency)
+		d.waitForNextKeyframe(dropReasonBackpressure)
+	}
+	d.behind = true
+}
+
+// ticked records that the send loop was woken up by its ticker, which should tick every interval.
+// It reports whether a pause was detected.
+func (d *frameDropper) ticked(now time.Time, interval time.Duration) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	last := d.lastTick
+	d.lastTick = now
+	if d.pauseThreshold <= 0 || last.IsZero() || now.Sub(last)-interval <= d.pauseThreshold {
+		return false
+	}
+	pause := now.Sub(last) - interval
+	d.logger.Printf("Send loop was paused for %v, dropping the frames that queued up until the next keyframe\n", pause)
+	d.backlog = int(pause / interval)
+	d.waitForNextKeyframe(dropReasonPause)
+	return true
+}
+
+// skipToKeyframe drops all frames until the next keyframe
+func (d *frameDropper) skipToKeyframe(reason string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.waitForNextKeyframe(reason)
+}
+
+func (d *frameDropper) waitForNextKeyframe(reason string) {
+	d.waitForKeyframe = true
+	d.keyframeReason = reason
+}
+
+func (d *frameDropper) flushLog() {
+	if d.dropped > 0 {
+		d.logger.Printf("Dropped %d frames to catch up\n", d.dropped)
+		d.dropped = 0
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+func TestFrameDropperSampleDuration(t *testing.T) {
+	frame := time.Second / 30
+	reference := &h264reader.NAL{UnitType: h264reader.NalUnitTypeCodedSliceNonIdr, RefIdc: 2}
+	nonReference := &h264reader.NAL{UnitType: h264reader.NalUnitTypeCodedSliceNonIdr}
+	dropper := &frameDropper{behind: true, reporter: &dropReporter{}}
+	for i := 0; i < 2; i++ {
+		if !dropper.shouldDrop(nonReference) {
+			t.Fatal("a non-reference frame was sent while behind")
+		}
+	}
+	if dropper.shouldDrop(reference) {
+		t.Fatal("a reference frame was dropped")
+	}
+	// The frame sent after the dropped ones lasts as long as all three
+	if got := dropper.sampleDuration(frame); got != 3*frame {
+		t.Errorf("the frame after 2 dropped ones lasts %v, want %v", got, 3*frame)
+	}
+	if got := dropper.sampleDuration(frame); got != frame {
+		t.Errorf("the next frame lasts %v, want %v", got, frame)
+	}
+}
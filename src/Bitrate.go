@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+var (
+	answerBitrate = flag.Uint64("answer-bitrate", 0, "add a b=AS line with this bitrate in kbps to the video section of the answer, as a hint of the maximum bitrate we send. 0 adds none")
+)
+
+// offeredBitrate returns the bandwidth in kbps the offer asks us to stay under with b=AS or b=TIAS,
+// on the video section or else on the session. It returns 0 when the offer doesn't limit it.
+func offeredBitrate(offer string) uint64 {
+	parsedOffer := &sdp.SessionDescription{}
+	if err := parsedOffer.Unmarshal([]byte(offer)); err != nil {
+		return 0
+	}
+	for _, media := range parsedOffer.MediaDescriptions {
+		if media.MediaName.Media != "video" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		if kbps := bandwidthKbps(media.Bandwidth); kbps > 0 {
+			return kbps
+		}
+		break
+	}
+	return bandwidthKbps(parsedOffer.Bandwidth)
+}
+
+func bandwidthKbps(bandwidths []sdp.Bandwidth) uint64 {
+	for _, bandwidth := range bandwidths {
+		switch bandwidth.Type {
+		case "AS":
+			return bandwidth.Bandwidth
+		case "TIAS":
+			return bandwidth.Bandwidth / 1000
+		}
+	}
+	return 0
+}
+
+// parseFfmpegBitrate parses a bitrate like 2M or 500k as ffmpeg does, in bits per second
+func parseFfmpegBitrate(value string) (uint64, bool) {
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "k") || strings.HasSuffix(value, "K"):
+		multiplier = 1e3
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1e6
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1e9
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, false
+	}
+	return uint64(number * multiplier), true
+}
+
+// limitBitrate lowers -b:v and -maxrate of the ffmpeg arguments to kbps. When the arguments don't set a bitrate,
+// -b:v is added before the output, the last argument.
+func limitBitrate(args []string, kbps uint64) []string {
+	limit := kbps * 1000
+	limited := append([]string{}, args...)
+	hasBitrate := false
+	for i := 0; i+1 < len(limited); i++ {
+		if limited[i] != "-b:v" && limited[i] != "-maxrate" {
+			continue
+		}
+		if limited[i] == "-b:v" {
+			hasBitrate = true
+		}
+		if bitrate, ok := parseFfmpegBitrate(limited[i+1]); ok && bitrate > limit {
+			limited[i+1] = strconv.FormatUint(kbps, 10) + "k"
+		}
+	}
+	if !hasBitrate && len(limited) > 0 {
+		output := len(limited) - 1
+		limited = append(append(append([]string{}, limited[:output]...), "-b:v", strconv.FormatUint(kbps, 10)+"k"), limited[output:]...)
+	}
+	return limited
+}
+
+// addAnswerBitrate adds the b=AS line of -answer-bitrate to the first enabled video section of the answer.
+// This is applied to the SDP sent to the browser only, pion rejects a local description it did not generate.
+func addAnswerBitrate(answer string) string {
+	if *answerBitrate == 0 {
+		return answer
+	}
+	return setVideoBandwidth(answer, *answerBitrate)
+}
+
+// setVideoBandwidth sets the b=AS line of the first enabled video section of the description to kbps.
+// The bandwidth lines of a media section follow its i= and c= lines and come before its attributes (RFC 4566 section 5).
+func setVideoBandwidth(description string, kbps uint64) string {
+	lines := strings.Split(description, "\r\n")
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "m=video ") || strings.HasPrefix(lines[i], "m=video 0 ") {
+			continue
+		}
+		insert := i + 1
+		for insert < len(lines) && (strings.HasPrefix(lines[insert], "i=") || strings.HasPrefix(lines[insert], "c=")) {
+			insert++
+		}
+		// Replace a bandwidth the section has already
+		end := insert
+		for end < len(lines) && strings.HasPrefix(lines[end], "b=AS:") {
+			end++
+		}
+		bandwidth := "b=AS:" + strconv.FormatUint(kbps, 10)
+		lines = append(lines[:insert], append([]string{bandwidth}, lines[end:]...)...)
+		break
+	}
+	return strings.Join(lines, "\r\n")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	checkOnly    = flag.Bool("check", false, "validate the configuration, probe ffmpeg and the listen address, then exit")
+	checkTimeout = flag.Duration("check-timeout", 10*time.Second, "how long -check waits for ffmpeg to produce output")
+)
+
+// runCheck verifies the parts of the configuration that can only be tested by using them.
+// It returns the exit code for the process.
+func runCheck() int {
+	fmt.Printf("OK   configuration parsed and validated\n")
+	exitCode := 0
+
+	listener, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		fmt.Printf("FAIL listen address %s: %v\n", *listenAddress, err)
+		exitCode = 1
+	} else {
+		listener.Close()
+		fmt.Printf("OK   listen address %s is available\n", *listenAddress)
+	}
+
+	if _, ok := mediaSource.(rtpMediaSource); ok {
+		if conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: *rtpListen}); err != nil {
+			fmt.Printf("FAIL RTP port %d: %v\n", *rtpListen, err)
+			exitCode = 1
+		} else {
+			conn.Close()
+			fmt.Printf("OK   RTP port %d is available\n", *rtpListen)
+		}
+		return exitCode
+	}
+	if !usesFfmpeg() {
+		fmt.Printf("OK   the source is %s, ffmpeg is not used\n", *mediaSourceKind)
+		return exitCode
+	}
+
+	if err := probeFfmpeg(); err != nil {
+		fmt.Printf("FAIL ffmpeg: %v\n", err)
+		exitCode = 1
+	} else {
+		fmt.Printf("OK   ffmpeg produced output with the given arguments\n")
+	}
+	return exitCode
+}
+
+// probeFfmpeg starts ffmpeg like a connection would and waits for its first output
+func probeFfmpeg() error {
+	// Starting can already wait for output when -encoders is set, so the timeout covers it as well
+	started := make(chan io.ReadCloser, 1)
+	result := make(chan error, 1)
+	go func() {
+		var dataPipe io.ReadCloser
+		var err error
+		if len(playlistItems) > 0 {
+			dataPipe, err = RunPlaylist(connectionLogger{requestId: "check"}, playlistItems[:1], ffmpegArgs...)
+		} else {
+			dataPipe, err = StartFfmpeg(connectionLogger{requestId: "check"}, ffmpegArgs...)
+		}
+		if err != nil {
+			result <- err
+			return
+		}
+		started <- dataPipe
+
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(dataPipe, buf)
+		if err == io.EOF {
+			err = fmt.Errorf("ffmpeg exited without output")
+		}
+		result <- err
+	}()
+
+	timeout := time.After(*checkTimeout)
+	defer func() {
+		select {
+		case dataPipe := <-started:
+			dataPipe.Close()
+		default:
+		}
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-timeout:
+		return fmt.Errorf("no output within %v", *checkTimeout)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	trustedProxies = flag.String("trusted-proxies", "", "comma separated addresses or CIDRs of the reverse proxies and load balancers in front of this server, like 10.0.0.0/8. The client address of their requests is taken from X-Forwarded-For, the scheme and host of the URLs we answer from X-Forwarded-Proto and X-Forwarded-Host")
+)
+
+// trustedProxyNetworks are parsed from -trusted-proxies by validateTrustedProxies
+var trustedProxyNetworks []*net.IPNet
+
+func validateTrustedProxies() error {
+	trustedProxyNetworks = nil
+	for _, value := range strings.Split(*trustedProxies, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return fmt.Errorf("invalid address %s", value)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			value = fmt.Sprintf("%s/%d", value, bits)
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return err
+		}
+		trustedProxyNetworks = append(trustedProxyNetworks, network)
+	}
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxyNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp returns the address of the client that sent the request. Behind trusted proxies that is the last address
+// in X-Forwarded-For that was not added by one of them, earlier addresses could have been made up by the client.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			// A malformed hop cannot be trusted nor looked past
+			break
+		}
+		host = hop.String()
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// forwardedByTrustedProxy tells whether the request came from one of -trusted-proxies, whose X-Forwarded headers are honored
+func forwardedByTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && isTrustedProxy(ip)
+}
+
+// firstForwarded returns the first value of a X-Forwarded header, the one set by the proxy the client talked to
+func firstForwarded(r *http.Request, header string) string {
+	return strings.TrimSpace(strings.Split(r.Header.Get(header), ",")[0])
+}
+
+// requestBaseURL returns the scheme and host the client sent the request to, like https://example.com. Behind trusted
+// proxies terminating HTTPS we see plain HTTP, they are taken from X-Forwarded-Proto and X-Forwarded-Host instead.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if forwardedByTrustedProxy(r) {
+		if proto := strings.ToLower(firstForwarded(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		// A host with a path or spaces would make up another URL than the one of the request
+		if forwardedHost := firstForwarded(r, "X-Forwarded-Host"); forwardedHost != "" && !strings.ContainsAny(forwardedHost, "/\\ ") {
+			host = forwardedHost
+		}
+	}
+	return scheme + "://" + host
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+var (
+	videoCodecs = flag.String("codecs", "h264", "comma separated list of video codecs to send, in order of preference: h264, vp8, vp9. The first one the client offers is used")
+	vp8Args     = flag.String("vp8-args", "", "ffmpeg arguments used when sending VP8, separated by spaces. By default they are derived from the H264 arguments")
+	vp9Args     = flag.String("vp9-args", "", "ffmpeg arguments used when sending VP9, separated by spaces. By default they are derived from the H264 arguments")
+)
+
+// codecMimeTypes maps the names accepted by -codecs to the mime type of the track we send
+var codecMimeTypes = map[string]string{
+	"h264": webrtc.MimeTypeH264,
+	"vp8":  webrtc.MimeTypeVP8,
+	"vp9":  webrtc.MimeTypeVP9,
+}
+
+// preferredCodecs returns the codecs of -codecs, in order of preference
+func preferredCodecs() []string {
+	codecs := []string{}
+	for _, codec := range strings.Split(*videoCodecs, ",") {
+		if codec = strings.ToLower(strings.TrimSpace(codec)); codec != "" {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+func validateCodecs() error {
+	codecs := preferredCodecs()
+	if len(codecs) == 0 {
+		return fmt.Errorf("at least one codec is required")
+	}
+	for _, codec := range codecs {
+		if _, ok := codecMimeTypes[codec]; !ok {
+			return fmt.Errorf("unknown codec %q, use h264, vp8 or vp9", codec)
+		}
+	}
+	return nil
+}
+
+// chooseCodec returns the most preferred codec the offer contains.
+// When the offer contains none of them, the most preferred is returned and validateAnswer reports the mismatch.
+func chooseCodec(offer string) string {
+	codecs := preferredCodecs()
+	parsedOffer := &sdp.SessionDescription{}
+	if err := parsedOffer.Unmarshal([]byte(offer)); err != nil {
+		return codecs[0]
+	}
+	offered := mediaCodecNames(parsedOffer, "video")
+	for _, codec := range codecs {
+		for _, name := range offered {
+			if strings.EqualFold(name, codec) {
+				return codec
+			}
+		}
+	}
+	return codecs[0]
+}
+
+// isIvfCodec reports whether ffmpeg sends the codec in an IVF container, instead of an H264 elementary stream
+func isIvfCodec(codec string) bool {
+	return codec == "vp8" || codec == "vp9"
+}
+
+// ivfKeyframe reports whether the frame of an IVF stream in the given codec is a keyframe
+func ivfKeyframe(codec string, frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	if codec == "vp8" {
+		// The first bit is the inverse keyframe bit
+		return frame[0]&0x01 == 0
+	}
+	// The VP9 uncompressed header starts with the frame marker 2 and the profile, profile 3 is followed by a reserved bit.
+	// Then show_existing_frame and frame_type follow, both are 0 for a keyframe.
+	if frame[0]>>6 != 2 {
+		return false
+	}
+	profile := frame[0]>>5&0x01 | frame[0]>>3&0x02
+	shift := uint(2)
+	if profile == 3 {
+		shift = 1
+	}
+	return frame[0]>>shift&0x03 == 0
+}
+
+// codecFfmpegArgs returns the ffmpeg arguments of the source producing a stream in the given codec
+func codecFfmpegArgs(codec string, source ffmpegSource) []string {
+	switch codec {
+	case "vp8":
+		if len(source.Vp8) > 0 {
+			return source.Vp8
+		}
+		return deriveIvfArgs(source.H264, "libvpx")
+	case "vp9":
+		if len(source.Vp9) > 0 {
+			return source.Vp9
+		}
+		return deriveIvfArgs(source.H264, "libvpx-vp9")
+	}
+	return source.H264
+}
+
+// deriveIvfArgs rewrites the H264 ffmpeg arguments to encode VP8 or VP9 using encoder into an IVF container instead,
+// dropping the options that only apply to H264 encoders.
+func deriveIvfArgs(args []string, encoder string) []string {
+	h264Options := map[string]bool{"-profile:v": true, "-profile": true, "-preset": true, "-tune": true, "-x264opts": true, "-x264-params": true, "-level": true}
+	derived := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		hasValue := i+1 < len(args)
+		switch {
+		case hasValue && (arg == "-c:v" || arg == "-vcodec" || arg == "-codec:v"):
+			derived = append(derived, arg, encoder, "-deadline", "realtime")
+			i++
+		case hasValue && arg == "-bsf:v" && args[i+1] == "h264_mp4toannexb":
+			i++
+		case hasValue && h264Options[arg]:
+			i++
+		case hasValue && arg == "-f" && args[i+1] == "h264":
+			derived = append(derived, arg, "ivf")
+			i++
+		default:
+			derived = append(derived, arg)
+		}
+	}
+	return derived
+}
+
+// sendIvf sends the VP8 or VP9 frames of an IVF stream to the track, paced by their timestamps or at the frame rate.
+// When the source is switched, the IVF header of the new stream is parsed and sending continues with its frames.
+func sendIvf(logger connectionLogger, peerConnection *webrtc.PeerConnection, codec string, source *videoSource, hold *holdState, videoTrack *webrtc.TrackLocalStaticSample, usage *connectionUsage, reporter *dropReporter, limits frameLimits, started <-chan struct{}, closed <-chan struct{}) {
+	dataPipe := source.current()
+	ivf, header, ivfErr := ivfreader.NewWith(dataPipe)
+	if ivfErr != nil {
+		logger.Printf("ivfErr: %v\n", ivfErr)
+		if cErr := peerConnection.Close(); cErr != nil {
+			logger.Printf("cannot close peerConnection: %v\n", cErr)
+		}
+		if cErr := source.Close(); cErr != nil {
+			logger.Printf("cannot close dataPipe: %v\n", cErr)
+		}
+		return
+	}
+
+	// Wait for connection established
+	select {
+	case <-started:
+	case <-closed:
+	}
+	waitForPrebuffer(logger, closed)
+	source.active(time.Now())
+
+	clock := newRTPClock(uint32(*timestampClockRate), trackClockRate(peerConnection, videoTrack))
+	// timing is nil when the frames are paced by the ticker instead of their timestamps
+	timing := newIvfClock(logger, header)
+	tickerDuration := limits.frameDuration()
+	ticker := newFrameTicker(tickerDuration)
+	defer ticker.Stop()
+	// skipped is the duration of the frames not sent while held, which the next frame sent lasts longer
+	skipped := time.Duration(0)
+	// waitForKeyframe is set after resuming the connection or dropping a frame, the frames before the next keyframe cannot be decoded
+	waitForKeyframe := false
+	sizes := &frameSizeChecker{logger: logger}
+	for {
+		select {
+		case <-closed:
+			if cErr := source.Close(); cErr != nil {
+				logger.Printf("cannot close dataPipe: %v\n", cErr)
+			}
+			return
+		default:
+		}
+		if duration := limits.frameDuration(); duration != tickerDuration {
+			ticker.Reset(duration)
+			tickerDuration = duration
+		}
+
+		frame, frameHeader, ivfErr := ivf.ParseNextFrame()
+		if ivfErr == nil {
+			source.active(time.Now())
+		}
+		if next := source.current(); next != dataPipe {
+			// The frame is from the old source, it may be cut off
+			logger.Printf("Switched the video source\n")
+			dataPipe = next
+			if ivf, header, ivfErr = ivfreader.NewWith(dataPipe); ivfErr == nil {
+				timing = newIvfClock(logger, header)
+				continue
+			}
+		}
+		// frameGap is the time since the previous frame
+		frameGap := tickerDuration
+		if ivfErr == nil && timing != nil {
+			due, gap := timing.frame(frameHeader.Timestamp, time.Now())
+			if gap > 0 {
+				frameGap = gap
+			}
+			waitUntil(due, closed)
+		}
+		if ivfErr == nil && hold.isHeld() {
+			skipped += frameGap
+			waitForKeyframe = true
+			reporter.frame(dropReasonHold)
+		} else if ivfErr == nil && waitForKeyframe && !ivfKeyframe(codec, frame) {
+			skipped += frameGap
+			reporter.frame(dropReasonHold)
+		} else if ivfErr == nil && !sizes.allowed(len(frame)) {
+			skipped += frameGap
+			waitForKeyframe = true
+			reporter.frame(dropReasonOversize)
+		} else if ivfErr == nil {
+			waitForKeyframe = false
+			duration := clock.sampleDuration(frameGap + skipped)
+			if ivfErr = videoTrack.WriteSample(media.Sample{Data: frame, Duration: duration}); ivfErr == nil {
+				usage.sent(len(frame))
+				logger.Debugf("Sent a frame of %d bytes lasting %v\n", len(frame), duration)
+			}
+			skipped = 0
+		}
+		if ivfErr != nil && ivfErr != io.EOF && connectionClosing(peerConnection) {
+			logger.Debugf("Stopped sending video, the connection is closing: %v\n", ivfErr)
+			if cErr := source.Close(); cErr != nil {
+				logger.Printf("cannot close dataPipe: %v\n", cErr)
+			}
+			return
+		}
+		if ivfErr == io.EOF {
+			logger.Printf("All video frames parsed and sent\n")
+		} else if ivfErr != nil {
+			logger.Printf("ivfErr: %v\n", ivfErr)
+		}
+		if ivfErr != nil {
+			if cErr := peerConnection.Close(); cErr != nil {
+				logger.Printf("cannot close peerConnection: %v\n", cErr)
+			}
+			if cErr := source.Close(); cErr != nil {
+				logger.Printf("cannot close dataPipe: %v\n", cErr)
+			}
+			return
+		}
+
+		if timing != nil {
+			continue
+		}
+		select {
+		case <-ticker.ticks():
+		case <-closed:
+		}
+	}
+}
+
+// trackCodecError is a failure to add or start the video track caused by its codec. That is a misconfiguration
+// rather than a problem of the connection: the MediaEngine does not register the codec chosen from -codecs,
+// for example with -h264-profile-level-id, or the payload types pion picked are not the ones the client can receive.
+type trackCodecError struct {
+	mimeType string
+	err      error
+}
+
+func (e trackCodecError) Error() string {
+	return fmt.Sprintf("cannot send the video track in %s, check that -codecs and -h264-profile-level-id register a codec the client offered: %v", e.mimeType, e.err)
+}
+
+// explainTrackError returns a trackCodecError for errors of pion caused by the codec of the track, other errors as they are
+func explainTrackError(err error, mimeType string) error {
+	if errors.Is(err, webrtc.ErrUnsupportedCodec) || errors.Is(err, webrtc.ErrCodecNotFound) || errors.Is(err, webrtc.ErrNoCodecsAvailable) {
+		return trackCodecError{mimeType: mimeType, err: err}
+	}
+	return err
+}
+
+// noCommonCodecError is returned for an offer none of the codecs we can send is in, the client gets a 406 Not Acceptable
+// listing both, so it can retry with a codec we support instead of getting a connection without video
+type noCommonCodecError struct {
+	// supported are the codecs of -codecs, offered those of the video sections of the offer
+	supported []string
+	offered   []string
+}
+
+func (e noCommonCodecError) Error() string {
+	return fmt.Sprintf("no common video codec, we send %s but the offer only contains %s", strings.Join(e.supported, ", "), strings.Join(e.offered, ", "))
+}
+
+// diagnostic is the body of the 406 answered for the offer
+func (e noCommonCodecError) diagnostic() string {
+	return fmt.Sprintf("No common video codec\nWe can send: %s\nThe offer contains: %s\n", strings.Join(e.supported, ", "), strings.Join(e.offered, ", "))
+}
+
+// supportedCodecs describes the codecs of -codecs, in order of preference, with the profile of H264 when it is pinned
+func supportedCodecs() []string {
+	supported := []string{}
+	for _, codec := range preferredCodecs() {
+		name := strings.TrimPrefix(codecMimeTypes[codec], "video/")
+		if codec == "h264" && *h264ProfileLevelId != "" {
+			name += " profile-level-id=" + strings.ToLower(*h264ProfileLevelId)
+		}
+		supported = append(supported, name)
+	}
+	return supported
+}
+
+// offeredVideoCodecs describes the codecs of the enabled video sections of the description, once each, with the
+// profile-level-id of H264 as a client offers several of them. Retransmission and FEC formats are left out, they carry no video of their own.
+func offeredVideoCodecs(description *sdp.SessionDescription) []string {
+	offered := []string{}
+	seen := map[string]bool{}
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != "video" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.Atoi(format)
+			if err != nil {
+				continue
+			}
+			codec, err := description.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil || codec.Name == "" {
+				continue
+			}
+			switch strings.ToLower(codec.Name) {
+			case "rtx", "red", "ulpfec", "flexfec-03":
+				continue
+			}
+			name := codec.Name
+			if match := fmtpProfileLevelIdPattern.FindStringSubmatch(codec.Fmtp); match != nil && strings.EqualFold(codec.Name, "h264") {
+				name += " profile-level-id=" + strings.ToLower(match[1])
+			}
+			if !seen[name] {
+				seen[name] = true
+				offered = append(offered, name)
+			}
+		}
+	}
+	return offered
+}
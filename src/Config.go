@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	configFile    = flag.String("config", "", "JSON file with options, command line flags override its values")
+	listenAddress = flag.String("listen", "[::]:5050", "address the HTTP server listens on")
+	iceServers    = &iceServerList{
+		servers:  []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+		fallback: []bool{false},
+	}
+)
+
+func init() {
+	flag.Var(iceServers, "ice-server", "ICE server as \"<url>[,<url>...] [<username> <credential>] [fallback]\", can be repeated, in order of preference (default stun:stun.l.google.com:19302)")
+}
+
+// ffmpegArgs are the arguments passed to every ffmpeg invocation
+var ffmpegArgs []string
+
+// ffmpegArgsOnCommandLine is set when ffmpegArgs were given after --, the "ffmpeg" config value is ignored then
+var ffmpegArgsOnCommandLine bool
+
+// iceServerList is a repeatable flag, the first value replaces the default servers.
+// fallback has an entry for every server, telling whether its relay candidates are only a fallback for the others.
+type iceServerList struct {
+	servers  []webrtc.ICEServer
+	fallback []bool
+	set      bool
+}
+
+func (l *iceServerList) String() string {
+	if l == nil {
+		return ""
+	}
+	values := []string{}
+	for _, server := range l.servers {
+		values = append(values, strings.Join(server.URLs, ","))
+	}
+	return strings.Join(values, " ")
+}
+
+func (l *iceServerList) Set(value string) error {
+	fields := strings.Fields(value)
+	fallback := len(fields) > 1 && fields[len(fields)-1] == "fallback"
+	if fallback {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) != 1 && len(fields) != 3 {
+		return errors.New("expected \"<url>[,<url>...] [<username> <credential>] [fallback]\"")
+	}
+	server := webrtc.ICEServer{URLs: strings.Split(fields[0], ",")}
+	if len(fields) == 3 {
+		server.Username = fields[1]
+		server.Credential = fields[2]
+	}
+	if !l.set {
+		l.servers = nil
+		l.fallback = nil
+		l.set = true
+	}
+	l.servers = append(l.servers, server)
+	l.fallback = append(l.fallback, fallback)
+	return nil
+}
+
+// configIceServer is the structured form of -ice-server accepted in config files
+type configIceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+	Fallback   bool     `json:"fallback"`
+}
+
+func (s configIceServer) flagValue() string {
+	value := strings.Join(s.URLs, ",")
+	if s.Username != "" || s.Credential != "" {
+		value += " " + s.Username + " " + s.Credential
+	}
+	if s.Fallback {
+		value += " fallback"
+	}
+	return value
+}
+
+// splitArgs splits the command line into our own flags and the ffmpeg arguments.
+// Without a "--" separator every argument is passed to ffmpeg, unless the first one
+// is one of our flags, in that case there are no ffmpeg arguments on the command line.
+func splitArgs(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	if len(args) > 0 && isOwnFlag(args[0]) {
+		return args, nil
+	}
+	return nil, args
+}
+
+func isOwnFlag(arg string) bool {
+	if !strings.HasPrefix(arg, "-") {
+		return false
+	}
+	name := strings.TrimLeft(arg, "-")
+	if i := strings.Index(name, "="); i >= 0 {
+		name = name[:i]
+	}
+	return flag.Lookup(name) != nil
+}
+
+// parseCommandLine parses our flags and the config file they point to.
+// The ffmpeg arguments from the command line take precedence over the "ffmpeg" config value.
+func parseCommandLine(args []string) error {
+	serverArgs, ffmpegCommandLine := splitArgs(args)
+	if err := flag.CommandLine.Parse(serverArgs); err != nil {
+		return err
+	}
+	if flag.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q, ffmpeg arguments go after --", flag.Arg(0))
+	}
+	recordFlagsOnCommandLine()
+	ffmpegArgs = ffmpegCommandLine
+	ffmpegArgsOnCommandLine = len(ffmpegCommandLine) > 0
+
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile, len(ffmpegCommandLine) > 0); err != nil {
+			return fmt.Errorf("%s: %v", *configFile, err)
+		}
+	}
+	if len(ffmpegArgs) == 0 && usesFfmpeg() {
+		return errors.New("no ffmpeg arguments given")
+	}
+	return nil
+}
+
+// loadConfigFile applies a JSON object mapping flag names to their values.
+// Flags already given on the command line are left alone.
+// Repeatable flags take an array, -ice-server also accepts {"urls", "username", "credential"} objects.
+func loadConfigFile(path string, haveFfmpegArgs bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	setOnCommandLine := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	for name, raw := range values {
+		if name == "ffmpeg" {
+			args := []string{}
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return fmt.Errorf("\"ffmpeg\" must be an array of strings")
+			}
+			if !haveFfmpegArgs {
+				ffmpegArgs = args
+			}
+			continue
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if setOnCommandLine[name] {
+			continue
+		}
+		flagValues, err := configFlagValues(name, raw)
+		if err != nil {
+			return err
+		}
+		for _, value := range flagValues {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readConfigSource reads the "ffmpeg" and "vp8-args" values from the config file again, for switching the source on SIGHUP.
+// ffmpeg arguments given on the command line still take precedence.
+func readConfigSource(path string) (ffmpegSource, error) {
+	if ffmpegArgsOnCommandLine {
+		return ffmpegSource{}, errors.New("the ffmpeg arguments were given on the command line, which take precedence")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ffmpegSource{}, err
+	}
+	values := struct {
+		Ffmpeg  []string `json:"ffmpeg"`
+		Vp8Args *string  `json:"vp8-args"`
+		Vp9Args *string  `json:"vp9-args"`
+	}{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return ffmpegSource{}, err
+	}
+	if len(values.Ffmpeg) == 0 {
+		return ffmpegSource{}, errors.New("no ffmpeg arguments given")
+	}
+	source := ffmpegSource{H264: values.Ffmpeg, Vp8: strings.Fields(*vp8Args), Vp9: strings.Fields(*vp9Args)}
+	if values.Vp8Args != nil {
+		source.Vp8 = strings.Fields(*values.Vp8Args)
+	}
+	if values.Vp9Args != nil {
+		source.Vp9 = strings.Fields(*values.Vp9Args)
+	}
+	return source, nil
+}
+
+// configFlagValues converts a JSON value into the strings to pass to flag.Set
+func configFlagValues(name string, raw json.RawMessage) ([]string, error) {
+	items := []json.RawMessage{}
+	if err := json.Unmarshal(raw, &items); err != nil {
+		items = []json.RawMessage{raw}
+	}
+
+	values := []string{}
+	for _, item := range items {
+		var value interface{}
+		if err := json.Unmarshal(item, &value); err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %v", name, err)
+		}
+		switch v := value.(type) {
+		case string:
+			values = append(values, v)
+		case bool, float64:
+			values = append(values, fmt.Sprint(v))
+		case map[string]interface{}:
+			if name != "ice-server" {
+				return nil, fmt.Errorf("invalid value for %q: objects are only supported for \"ice-server\"", name)
+			}
+			server := configIceServer{}
+			if err := json.Unmarshal(item, &server); err != nil {
+				return nil, fmt.Errorf("invalid value for %q: %v", name, err)
+			}
+			if len(server.URLs) == 0 {
+				return nil, fmt.Errorf("invalid value for %q: \"urls\" is required", name)
+			}
+			values = append(values, server.flagValue())
+		default:
+			return nil, fmt.Errorf("invalid value for %q: unsupported type", name)
+		}
+	}
+	return values, nil
+}
+
+// validateConfig checks the flags that are only used once a connection is made,
+// so mistakes are reported at startup
+func validateConfig() error {
+	if _, err := parseMulticastDNSMode(*mdnsMode); err != nil {
+		return fmt.Errorf("-mdns: %v", err)
+	}
+	if err := validateSeiMode(*seiMode); err != nil {
+		return fmt.Errorf("-sei: %v", err)
+	}
+	if err := validateRecordStartCode(*recordStartCode); err != nil {
+		return fmt.Errorf("-record-start-code: %v", err)
+	}
+	if err := validateRecordDir(*recordDir); err != nil {
+		return fmt.Errorf("-record-dir: %v", err)
+	}
+	if _, _, _, err := parsePlayoutDelay(*playoutDelay); err != nil {
+		return fmt.Errorf("-playout-delay: %v", err)
+	}
+	if err := validateNackBuffer(*nackBuffer); err != nil {
+		return fmt.Errorf("-nack-buffer: %v", err)
+	}
+	if *dropReportInterval <= 0 {
+		return fmt.Errorf("-drop-report-interval: must be positive")
+	}
+	if err := validateOpus(); err != nil {
+		return err
+	}
+	if err := validateFrameSize(); err != nil {
+		return fmt.Errorf("-max-frame-size: %v", err)
+	}
+	if err := validateFrameSkip(*frameSkip); err != nil {
+		return fmt.Errorf("-frame-skip: %v", err)
+	}
+	if err := validateFfmpegNice(*ffmpegNice); err != nil {
+		return fmt.Errorf("-ffmpeg-nice: %v", err)
+	}
+	if err := validateFfmpegIdleIo(*ffmpegIdleIo); err != nil {
+		return fmt.Errorf("-ffmpeg-idle-io: %v", err)
+	}
+	if err := validateFfmpegLogLevel(*ffmpegLogLevel); err != nil {
+		return fmt.Errorf("-ffmpeg-loglevel: %v", err)
+	}
+	if err := validateFfmpegThreads(*ffmpegThreads); err != nil {
+		return fmt.Errorf("-ffmpeg-threads: %v", err)
+	}
+	if err := validateEncoders(ffmpegArgs); err != nil {
+		return fmt.Errorf("-encoders: %v", err)
+	}
+	if err := validateCodecs(); err != nil {
+		return fmt.Errorf("-codecs: %v", err)
+	}
+	if err := validateRtpIngest(); err != nil {
+		return fmt.Errorf("-rtp-listen: %v", err)
+	}
+	source, err := newMediaSource(*mediaSourceKind)
+	if err != nil {
+		return fmt.Errorf("-source: %v", err)
+	}
+	if err := validateMediaSource(source); err != nil {
+		return fmt.Errorf("-source: %v", err)
+	}
+	mediaSource = source
+	if err := validateSourceFormat(); err != nil {
+		return err
+	}
+	if *keyframeRequestInterval < 0 {
+		return fmt.Errorf("-keyframe-request-interval: must not be negative")
+	}
+	if err := validateSourceStall(); err != nil {
+		return fmt.Errorf("-source-stall-action: %v", err)
+	}
+	if err := validateCongestionControl(); err != nil {
+		return err
+	}
+	if err := validateKeyframeInterval(); err != nil {
+		return err
+	}
+	if err := validateSendQueue(); err != nil {
+		return err
+	}
+	if err := validateRampUp(); err != nil {
+		return err
+	}
+	if err := validateH264LevelCheck(*h264LevelCheck); err != nil {
+		return fmt.Errorf("-h264-level-check: %v", err)
+	}
+	if err := validateTimestampClockRate(); err != nil {
+		return fmt.Errorf("-video-clock-rate: %v", err)
+	}
+	if err := validateSignalingTLS(); err != nil {
+		return fmt.Errorf("-tls-cert: %v", err)
+	}
+	if err := validateSenderReportInterval(); err != nil {
+		return fmt.Errorf("-sr-interval: %v", err)
+	}
+	if err := validateReorderDepth(); err != nil {
+		return fmt.Errorf("-reorder-depth: %v", err)
+	}
+	if err := validatePrebuffer(); err != nil {
+		return fmt.Errorf("-prebuffer: %v", err)
+	}
+	if err := validateDtlsTimeout(); err != nil {
+		return fmt.Errorf("-dtls-timeout: %v", err)
+	}
+	if err := validateAnswerRewrites(); err != nil {
+		return fmt.Errorf("-answer-rewrite: %v", err)
+	}
+	if err := validateIvfPacing(); err != nil {
+		return fmt.Errorf("-ivf-pacing: %v", err)
+	}
+	if err := validateTrustedProxies(); err != nil {
+		return fmt.Errorf("-trusted-proxies: %v", err)
+	}
+	if err := validateFallbackFrame(); err != nil {
+		return fmt.Errorf("-fallback-frame: %v", err)
+	}
+	if err := validateKeyframeRequests(); err != nil {
+		return fmt.Errorf("-keyframe-on-pli: %v", err)
+	}
+	if err := validateOfflineSignaling(); err != nil {
+		return fmt.Errorf("-offer-file: %v", err)
+	}
+	if err := validateWarmPool(*warmPoolSize); err != nil {
+		return fmt.Errorf("-warm-pool: %v", err)
+	}
+	if err := validateH264ProfileLevelId(*h264ProfileLevelId, ffmpegArgs); err != nil {
+		return fmt.Errorf("-h264-profile-level-id: %v", err)
+	}
+	if *maxTurnServers < 0 {
+		return fmt.Errorf("-max-turn-servers: must not be negative")
+	}
+	if *maxRelayCandidates < 0 {
+		return fmt.Errorf("-max-relay-candidates: must not be negative")
+	}
+	for _, server := range iceServers.servers {
+		for _, url := range server.URLs {
+			if _, err := ice.ParseURL(url); err != nil {
+				return fmt.Errorf("-ice-server %s: %v", url, err)
+			}
+		}
+	}
+	if err := validateTurnServers(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	congestionControl = flag.String("congestion-control", "off", "how the H264 send path responds to congestion: twcc negotiates transport-wide congestion control feedback with the client and, while the client receives less than we send, drops non-reference pictures until the rest fits, off sends every picture")
+)
+
+func validateCongestionControl() error {
+	if _, ok := congestionControllers[*congestionControl]; !ok && *congestionControl != "off" {
+		return fmt.Errorf("unknown -congestion-control %q, expected off or twcc", *congestionControl)
+	}
+	if *congestionControl == "off" {
+		return nil
+	}
+	for _, codec := range preferredCodecs() {
+		if codec != "h264" {
+			fmt.Printf("Warning: -congestion-control only drops H264 pictures, %s is sent as it comes\n", codec)
+		}
+	}
+	return nil
+}
+
+// dropReasonCongestion is the reason reported for the pictures dropped as the client receives less than we send
+const dropReasonCongestion = "congestion"
+
+// congestionController decides from the feedback of the client which pictures are dropped, so the video fits in
+// the bandwidth of the connection. It sees the RTP and RTCP of the connection as an interceptor, and the slices
+// read from the source through the frameDropper.
+type congestionController interface {
+	interceptor.Interceptor
+	// register negotiates the header extensions and feedback the controller needs with the client
+	register(m *webrtc.MediaEngine) error
+	// slice counts a slice read from the source, for the bitrate of the source
+	slice(size int, reference bool)
+	// dropPicture reports whether the picture starting with the last slice must be dropped, only non-reference pictures are
+	dropPicture(reference bool) bool
+}
+
+// congestionControllers are the controllers -congestion-control selects by name
+var congestionControllers = map[string]func(logger connectionLogger) congestionController{
+	"twcc": newTwccController,
+}
+
+// newCongestionController returns the controller of -congestion-control for a connection, nil when it is off
+func newCongestionController(logger connectionLogger) congestionController {
+	newController, ok := congestionControllers[*congestionControl]
+	if !ok {
+		return nil
+	}
+	return newController(logger)
+}
+
+const (
+	// twccInterval is the send time of the packets the feedback is collected over before the estimate is updated
+	twccInterval = 500 * time.Millisecond
+	// twccLossThreshold is the fraction of lost packets above which the connection is congested
+	twccLossThreshold = 0.1
+	// twccDeliveryThreshold is the fraction of the rate we send at below which a delivery rate means congestion,
+	// the arrival times have jitter
+	twccDeliveryThreshold = 0.85
+	// twccProbe is the factor the estimate grows by per interval without congestion, until it reaches the rate of the source
+	twccProbe = 1.25
+	// twccHistory is the number of packets sent that are remembered for their feedback, a power of 2
+	twccHistory = 1 << 12
+)
+
+// twccPacket is a packet sent with a transport-wide sequence number
+type twccPacket struct {
+	sequence uint16
+	size     int
+	sentAt   time.Time
+	// pending tells whether the feedback on it was not received yet
+	pending bool
+}
+
+// twccWindow collects the feedback on the packets sent in an interval
+type twccWindow struct {
+	firstSent, lastSent time.Time
+	// firstArrival and lastArrival are on the clock of the client, which starts anywhere
+	firstArrival, lastArrival time.Duration
+	sentBytes, receivedBytes  int
+	received, lost            int
+}
+
+func (w *twccWindow) add(packet twccPacket, received bool, arrival time.Duration) {
+	if w.firstSent.IsZero() || packet.sentAt.Before(w.firstSent) {
+		w.firstSent = packet.sentAt
+	}
+	if packet.sentAt.After(w.lastSent) {
+		w.lastSent = packet.sentAt
+	}
+	w.sentBytes += packet.size
+	if !received {
+		w.lost++
+		return
+	}
+	if w.received == 0 || arrival < w.firstArrival {
+		w.firstArrival = arrival
+	}
+	if w.received == 0 || arrival > w.lastArrival {
+		w.lastArrival = arrival
+	}
+	w.received++
+	w.receivedBytes += packet.size
+}
+
+// twccController numbers every packet with the transport-wide sequence number of the transport-cc header extension,
+// the client sends feedback of when each arrived. Per interval, the rate the packets arrived at is compared with the
+// rate they were sent at: when they arrive slower, or too many are lost, the bandwidth is estimated at what arrived
+// and enough non-reference pictures are dropped to fit the video in it. Without congestion the estimate grows by
+// twccProbe per interval, once it reaches the bitrate of the source no pictures are dropped anymore.
+//
+// The bitrate of the audio is not accounted for, it is small compared to the video.
+type twccController struct {
+	interceptor.NoOp
+	logger connectionLogger
+	// sequence is the transport-wide sequence number of the next packet, accessed atomically
+	sequence uint32
+
+	lock sync.Mutex
+	// sent are the last packets sent, by their sequence number modulo twccHistory
+	sent   [twccHistory]twccPacket
+	window twccWindow
+	// estimate is the bitrate in bits per second the client can receive, 0 while not congested
+	estimate float64
+	// dropFraction is the fraction of the non-reference pictures dropped to fit in the estimate,
+	// credit spreads the drops evenly over the pictures
+	dropFraction, credit float64
+	// sourceBytes and nonReferenceBytes were read from the source since sourceSince
+	sourceBytes, nonReferenceBytes int
+	sourceSince                    time.Time
+	dropped                        int
+}
+
+func newTwccController(logger connectionLogger) congestionController {
+	return &twccController{logger: logger}
+}
+
+func (c *twccController) register(m *webrtc.MediaEngine) error {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, kind); err != nil {
+			return err
+		}
+		m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC}, kind)
+	}
+	return nil
+}
+
+func (c *twccController) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	id := 0
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == sdp.TransportCCURI {
+			id = extension.ID
+		}
+	}
+	if id == 0 {
+		if strings.HasPrefix(info.MimeType, "video/") {
+			c.logger.Printf("Warning: the client did not negotiate transport-wide congestion control, -congestion-control does nothing for this connection\n")
+		}
+		return writer
+	}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		sequence := uint16(atomic.AddUint32(&c.sequence, 1) - 1)
+		extension, err := (&rtp.TransportCCExtension{TransportSequence: sequence}).Marshal()
+		if err != nil {
+			return 0, err
+		}
+		if err := header.SetExtension(uint8(id), extension); err != nil {
+			return 0, err
+		}
+		c.lock.Lock()
+		c.sent[sequence%twccHistory] = twccPacket{sequence: sequence, size: header.MarshalSize() + len(payload), sentAt: time.Now(), pending: true}
+		c.lock.Unlock()
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+func (c *twccController) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if err != nil {
+			return n, attributes, err
+		}
+		packets, err := rtcp.Unmarshal(b[:n])
+		if err != nil {
+			return n, attributes, nil
+		}
+		for _, packet := range packets {
+			if feedback, ok := packet.(*rtcp.TransportLayerCC); ok {
+				c.feedback(feedback)
+			}
+		}
+		return n, attributes, nil
+	})
+}
+
+// twccStatuses returns the status symbol of every packet the feedback is about, from its base sequence number on
+func twccStatuses(feedback *rtcp.TransportLayerCC) []uint16 {
+	statuses := []uint16{}
+	for _, chunk := range feedback.PacketChunks {
+		switch chunk := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			for i := uint16(0); i < chunk.RunLength; i++ {
+				statuses = append(statuses, chunk.PacketStatusSymbol)
+			}
+		case *rtcp.StatusVectorChunk:
+			statuses = append(statuses, chunk.SymbolList...)
+		}
+	}
+	// The last chunk can have room for more packets than it is about
+	if len(statuses) > int(feedback.PacketStatusCount) {
+		statuses = statuses[:feedback.PacketStatusCount]
+	}
+	return statuses
+}
+
+// feedback adds the arrivals of the packets in the feedback to the window, and updates the estimate once the window spans an interval
+func (c *twccController) feedback(feedback *rtcp.TransportLayerCC) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// The reference time is a signed 24 bit number of 64ms steps, the deltas follow on from it
+	arrival := time.Duration(int32(feedback.ReferenceTime<<8)>>8) * 64 * time.Millisecond
+	deltas := feedback.RecvDeltas
+	for i, status := range twccStatuses(feedback) {
+		received := status != rtcp.TypeTCCPacketNotReceived
+		if (status == rtcp.TypeTCCPacketReceivedSmallDelta || status == rtcp.TypeTCCPacketReceivedLargeDelta) && len(deltas) > 0 {
+			arrival += time.Duration(deltas[0].Delta) * time.Microsecond
+			deltas = deltas[1:]
+		}
+		sequence := feedback.BaseSequenceNumber + uint16(i)
+		packet := &c.sent[sequence%twccHistory]
+		if !packet.pending || packet.sequence != sequence {
+			continue
+		}
+		// A packet reported lost is reported again when it arrives late, it is counted once
+		packet.pending = false
+		c.window.add(*packet, received, arrival)
+	}
+	if c.window.lastSent.Sub(c.window.firstSent) >= twccInterval {
+		c.update(time.Now())
+	}
+}
+
+// update estimates the bandwidth from the window, which it starts over, and sets the fraction of the non-reference pictures to drop
+func (c *twccController) update(now time.Time) {
+	window := c.window
+	c.window = twccWindow{}
+	sourceRate, nonReferenceRate := 0.0, 0.0
+	if !c.sourceSince.IsZero() && now.After(c.sourceSince) {
+		sourceRate = float64(c.sourceBytes*8) / now.Sub(c.sourceSince).Seconds()
+		nonReferenceRate = float64(c.nonReferenceBytes*8) / now.Sub(c.sourceSince).Seconds()
+	}
+	c.sourceBytes, c.nonReferenceBytes, c.sourceSince = 0, 0, now
+
+	sendRate := float64(window.sentBytes*8) / window.lastSent.Sub(window.firstSent).Seconds()
+	deliveryRate := sendRate
+	if arrivalSpan := window.lastArrival - window.firstArrival; arrivalSpan > 0 {
+		deliveryRate = float64(window.receivedBytes*8) / arrivalSpan.Seconds()
+	}
+	loss := float64(window.lost) / float64(window.lost+window.received)
+	congested := loss > twccLossThreshold || deliveryRate < sendRate*twccDeliveryThreshold
+	switch {
+	case congested:
+		estimate := math.Min(deliveryRate, sendRate)
+		if loss > twccLossThreshold {
+			estimate = math.Min(estimate, sendRate*(1-loss/2))
+		}
+		if c.estimate == 0 {
+			c.logger.Printf("Congestion: the client receives %.0f of the %.0f kbps sent, losing %.0f%%, dropping non-reference pictures\n", deliveryRate/1000, sendRate/1000, loss*100)
+		}
+		// An estimate of 0 would mean not congested, everything that is lost still has to fit
+		c.estimate = math.Max(estimate, 1)
+	case c.estimate > 0:
+		c.estimate *= twccProbe
+	}
+	if c.estimate > 0 && c.estimate >= sourceRate {
+		c.logger.Printf("Congestion is over, the client receives the %.0f kbps of the source again. Dropped %d pictures\n", sourceRate/1000, c.dropped)
+		c.estimate = 0
+		c.dropped = 0
+	}
+	c.dropFraction = 0
+	if c.estimate > 0 && nonReferenceRate > 0 {
+		c.dropFraction = math.Max(0, math.Min(1, (sourceRate-c.estimate)/nonReferenceRate))
+	}
+	c.logger.Debugf("TWCC: sent %.0f kbps, received %.0f kbps, %.0f%% lost, source %.0f kbps, estimate %.0f kbps, dropping %.0f%% of the non-reference pictures\n",
+		sendRate/1000, deliveryRate/1000, loss*100, sourceRate/1000, c.estimate/1000, c.dropFraction*100)
+}
+
+func (c *twccController) slice(size int, reference bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.sourceSince.IsZero() {
+		c.sourceSince = time.Now()
+	}
+	c.sourceBytes += size
+	if !reference {
+		c.nonReferenceBytes += size
+	}
+}
+
+func (c *twccController) dropPicture(reference bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if reference || c.dropFraction == 0 {
+		return false
+	}
+	c.credit += c.dropFraction
+	if c.credit < 1 {
+		return false
+	}
+	c.credit--
+	c.dropped++
+	return true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+func TestTwccStatuses(t *testing.T) {
+	feedback := &rtcp.TransportLayerCC{
+		PacketStatusCount: 12,
+		PacketChunks: []rtcp.PacketStatusChunk{
+			&rtcp.RunLengthChunk{PacketStatusSymbol: rtcp.TypeTCCPacketReceivedSmallDelta, RunLength: 3},
+			&rtcp.StatusVectorChunk{SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit, SymbolList: []uint16{
+				rtcp.TypeTCCPacketNotReceived, rtcp.TypeTCCPacketReceivedLargeDelta, rtcp.TypeTCCPacketNotReceived,
+				rtcp.TypeTCCPacketReceivedSmallDelta, rtcp.TypeTCCPacketReceivedSmallDelta, rtcp.TypeTCCPacketReceivedSmallDelta,
+				rtcp.TypeTCCPacketReceivedSmallDelta,
+			}},
+			// The last chunk has room for more packets than the feedback is about
+			&rtcp.StatusVectorChunk{SymbolSize: rtcp.TypeTCCSymbolSizeOneBit, SymbolList: []uint16{
+				rtcp.TypeTCCPacketReceivedSmallDelta, rtcp.TypeTCCPacketNotReceived, rtcp.TypeTCCPacketNotReceived,
+				rtcp.TypeTCCPacketNotReceived, rtcp.TypeTCCPacketNotReceived,
+			}},
+		},
+	}
+	want := []uint16{1, 1, 1, 0, 2, 0, 1, 1, 1, 1, 1, 0}
+	got := twccStatuses(feedback)
+	if len(got) != len(want) {
+		t.Fatalf("got %d statuses, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("status %d is %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestTwccControllerFeedback(t *testing.T) {
+	c := newTwccController(connectionLogger{}).(*twccController)
+	sentAt := time.Now()
+	for sequence := uint16(65530); sequence != 6; sequence++ {
+		c.sent[sequence%twccHistory] = twccPacket{sequence: sequence, size: 1000, sentAt: sentAt, pending: true}
+	}
+	// The sequence numbers wrap around, packet 65532 is lost and 3 arrives 10ms after the others
+	feedback := &rtcp.TransportLayerCC{
+		BaseSequenceNumber: 65530,
+		PacketStatusCount:  12,
+		ReferenceTime:      1,
+		PacketChunks: []rtcp.PacketStatusChunk{
+			&rtcp.StatusVectorChunk{SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit, SymbolList: []uint16{1, 1, 0, 1, 1, 1, 1}},
+			&rtcp.StatusVectorChunk{SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit, SymbolList: []uint16{1, 1, 2, 1, 1, 1, 0}},
+		},
+		RecvDeltas: []*rtcp.RecvDelta{
+			{Delta: 0}, {Delta: 250}, {Delta: 250}, {Delta: 250}, {Delta: 250}, {Delta: 250},
+			{Delta: 250}, {Delta: 250}, {Delta: 10000}, {Delta: 250}, {Delta: 250},
+		},
+	}
+	c.feedback(feedback)
+	if c.window.received != 11 || c.window.lost != 1 || c.window.sentBytes != 12000 || c.window.receivedBytes != 11000 {
+		t.Errorf("the window has %d received and %d lost packets of %d bytes, %d received", c.window.received, c.window.lost, c.window.sentBytes, c.window.receivedBytes)
+	}
+	if span := c.window.lastArrival - c.window.firstArrival; span != 12250*time.Microsecond {
+		t.Errorf("the packets arrived over %v, want 12.25ms", span)
+	}
+	// Feedback on the same packets again, like for a lost packet that arrived after all, is not counted twice
+	c.feedback(feedback)
+	if c.window.received != 11 || c.window.lost != 1 {
+		t.Errorf("the repeated feedback was counted, the window has %d received and %d lost packets", c.window.received, c.window.lost)
+	}
+}
+
+func TestTwccControllerUpdate(t *testing.T) {
+	now := time.Now()
+	// window returns the feedback on 500ms worth of packets sent at 1600 kbps, which arrived over the span
+	window := func(arrivalSpan time.Duration, lossPercent int) twccWindow {
+		return twccWindow{
+			firstSent: now.Add(-500 * time.Millisecond), lastSent: now,
+			lastArrival: arrivalSpan,
+			sentBytes:   100000, receivedBytes: 100000 * (100 - lossPercent) / 100,
+			received: 100 - lossPercent, lost: lossPercent,
+		}
+	}
+	tests := []struct {
+		name     string
+		estimate float64
+		window   twccWindow
+		// the source has 2000 kbps over the last second, of which 1600 kbps in non-reference pictures
+		wantEstimate, wantDropFraction float64
+	}{
+		{"delivered at the rate sent", 0, window(500*time.Millisecond, 0), 0, 0},
+		{"delivered slower than sent", 0, window(time.Second, 0), 800000, 0.75},
+		{"delivered with jitter", 0, window(550*time.Millisecond, 0), 0, 0},
+		{"20% lost", 0, window(400*time.Millisecond, 20), 1440000, 0.35},
+		{"5% lost", 0, window(475*time.Millisecond, 5), 0, 0},
+		{"probing after congestion", 800000, window(500*time.Millisecond, 0), 1000000, 0.625},
+		{"probing up to the source rate", 1700000, window(500*time.Millisecond, 0), 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTwccController(connectionLogger{}).(*twccController)
+			c.estimate = test.estimate
+			c.window = test.window
+			c.sourceSince, c.sourceBytes, c.nonReferenceBytes = now.Add(-time.Second), 250000, 200000
+			c.update(now)
+			if math.Abs(c.estimate-test.wantEstimate) > 1 {
+				t.Errorf("estimate is %.0f bps, want %.0f", c.estimate, test.wantEstimate)
+			}
+			if math.Abs(c.dropFraction-test.wantDropFraction) > 1e-9 {
+				t.Errorf("dropping %v of the non-reference pictures, want %v", c.dropFraction, test.wantDropFraction)
+			}
+			if c.window != (twccWindow{}) || c.sourceBytes != 0 || !c.sourceSince.Equal(now) {
+				t.Error("the window and the source rate did not start over")
+			}
+		})
+	}
+}
+
+func TestTwccControllerDropPicture(t *testing.T) {
+	c := newTwccController(connectionLogger{}).(*twccController)
+	c.dropFraction = 0.25
+	dropped := 0
+	for i := 0; i < 100; i++ {
+		if c.dropPicture(true) {
+			t.Fatal("a reference picture was dropped")
+		}
+		if c.dropPicture(false) {
+			dropped++
+		}
+	}
+	if dropped != 25 {
+		t.Errorf("dropped %d of 100 non-reference pictures, want 25", dropped)
+	}
+}
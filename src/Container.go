@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	sourceFormat = flag.String("source-format", "auto", "the format the source writes the video in: h264 for an annex B elementary stream, ivf, mpegts or mp4 for fragmented MP4. The video of a container is demuxed and its other streams, like a muxed audio, are skipped. auto takes it from the -f of the ffmpeg arguments, or detects it from the start of a -source file:<path>")
+)
+
+// ffmpegFormats maps the -f of the ffmpeg output to the -source-format it writes
+var ffmpegFormats = map[string]string{
+	"h264":   "h264",
+	"ivf":    "ivf",
+	"mpegts": "mpegts",
+	"mp4":    "mp4",
+	"mov":    "mp4",
+}
+
+func validateSourceFormat() error {
+	switch *sourceFormat {
+	case "auto", "h264", "ivf", "mpegts", "mp4":
+	default:
+		return fmt.Errorf("unknown -source-format %q, expected auto, h264, ivf, mpegts or mp4", *sourceFormat)
+	}
+	if !usesFfmpeg() {
+		return nil
+	}
+	for _, codec := range preferredCodecs() {
+		if err := validateSourceArgs(codec, codecFfmpegArgs(codec, defaultSource())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateSourceArgs checks that the video the ffmpeg arguments write for the codec can be read
+func validateSourceArgs(codec string, args []string) error {
+	output := ffmpegOutputFormat(args)
+	if _, ok := ffmpegFormats[output]; *sourceFormat == "auto" && output != "" && !ok {
+		return fmt.Errorf("the ffmpeg arguments of %s write -f %s, the video can only be read from h264, ivf, mpegts or mp4, or set -source-format", codec, output)
+	}
+	switch sourceFormatOf(args) {
+	case "mpegts":
+		if isIvfCodec(codec) {
+			return fmt.Errorf("MPEG-TS cannot carry %s, write -f ivf or mp4 in -%s-args", strings.ToUpper(codec), codec)
+		}
+	case "mp4":
+		movflags := ffmpegArgValue(args, "-movflags")
+		if !strings.Contains(movflags, "frag_") && !strings.Contains(movflags, "empty_moov") && !containsArg(args, "-frag_duration") && !containsArg(args, "-frag_size") {
+			return fmt.Errorf("the ffmpeg arguments of %s write MP4, which needs -movflags frag_every_frame+empty_moov to be written to a pipe", codec)
+		}
+		if !strings.Contains(movflags, "frag_every_frame") && !containsArg(args, "-frag_duration") {
+			fmt.Printf("Warning: the ffmpeg arguments of %s write an MP4 fragment per keyframe, the frames are only read once their fragment is complete. Add frag_every_frame to -movflags for low latency\n", codec)
+		}
+	}
+	return nil
+}
+
+// ffmpegOutputFormat returns the -f of the output of the ffmpeg arguments, "" when it has none. The -f before an -i is that of the input.
+func ffmpegOutputFormat(args []string) string {
+	format := ""
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-i":
+			format = ""
+			i++
+		case "-f":
+			format = args[i+1]
+			i++
+		}
+	}
+	return format
+}
+
+// ffmpegArgValue returns the value of the last option in the ffmpeg arguments, "" when they do not have it
+func ffmpegArgValue(args []string, option string) string {
+	value := ""
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == option {
+			value = args[i+1]
+		}
+	}
+	return value
+}
+
+// sourceFormatOf returns the -source-format of the source started with the ffmpeg arguments, "" when it is
+// detected from the start of the stream. Only a file can contain anything, the other sources write annex B.
+func sourceFormatOf(args []string) string {
+	if *sourceFormat != "auto" {
+		return *sourceFormat
+	}
+	switch mediaSource.(type) {
+	case ffmpegMediaSource:
+		if format, ok := ffmpegFormats[ffmpegOutputFormat(args)]; ok {
+			return format
+		}
+	case fileMediaSource:
+		return ""
+	}
+	return "h264"
+}
+
+// mpegTsPacketSize is the size of every packet of an MPEG-TS
+const mpegTsPacketSize = 188
+
+// detectSourceFormat returns the format of a stream from its first bytes, h264 when it is no container
+func detectSourceFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("DKIF")):
+		return "ivf"
+	case len(head) > mpegTsPacketSize && head[0] == 0x47 && head[mpegTsPacketSize] == 0x47:
+		return "mpegts"
+	case len(head) >= 8 && (string(head[4:8]) == "ftyp" || string(head[4:8]) == "styp" || string(head[4:8]) == "moov"):
+		return "mp4"
+	}
+	return "h264"
+}
+
+// demuxSource returns the video of the pipe in the format the send loops read, annex B for H264 and IVF for VP8 and VP9.
+// A container is demuxed, the other formats are returned as they are.
+func demuxSource(logger connectionLogger, codec string, args []string, pipe io.ReadCloser) io.ReadCloser {
+	format := sourceFormatOf(args)
+	var reader io.Reader = pipe
+	detected := format == ""
+	if detected {
+		buffered := bufio.NewReader(pipe)
+		head, _ := buffered.Peek(mpegTsPacketSize + 1)
+		format = detectSourceFormat(head)
+		reader = buffered
+	}
+	switch format {
+	case "mpegts":
+		logger.Printf("Demuxing the %s video of the MPEG-TS of the source\n", strings.ToUpper(codec))
+		return &demuxedPipe{demuxer: newTsDemuxer(logger, reader), Closer: pipe}
+	case "mp4":
+		logger.Printf("Demuxing the %s video of the MP4 of the source\n", strings.ToUpper(codec))
+		return &demuxedPipe{demuxer: newMp4Demuxer(logger, codec, reader), Closer: pipe}
+	}
+	if detected {
+		return &bufferedReadCloser{Reader: reader, Closer: pipe}
+	}
+	return pipe
+}
+
+// demuxer reads the video of a container
+type demuxer interface {
+	// next returns the next part of the video, it can be empty
+	next() ([]byte, error)
+}
+
+// demuxedPipe is the video a demuxer read from a pipe
+type demuxedPipe struct {
+	demuxer
+	io.Closer
+	pending []byte
+}
+
+func (p *demuxedPipe) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		data, err := p.next()
+		if err != nil {
+			return 0, err
+		}
+		p.pending = data
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// splitAnnexB returns the NAL units of an annex B stream, without their start codes
+func splitAnnexB(data []byte) [][]byte {
+	units := [][]byte{}
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				// The zero of a 4 byte start code, NAL units do not end with a zero byte
+				units = append(units, bytes.TrimRight(data[start:i], "\x00"))
+			}
+			start = i + 3
+			i += 2
+		}
+	}
+	if start >= 0 {
+		units = append(units, data[start:])
+	}
+	return units
+}
+
+// joinAnnexB returns the NAL units as an annex B stream. The access unit delimiters a container needs are left
+// out, so the stream is the same as ffmpeg writes with -f h264, RTP marks the end of a picture itself.
+func joinAnnexB(units [][]byte) []byte {
+	annexB := []byte{}
+	for _, unit := range units {
+		if len(unit) == 0 || unit[0]&0x1f == 9 {
+			continue
+		}
+		annexB = append(append(annexB, 0x00, 0x00, 0x00, 0x01), unit...)
+	}
+	return annexB
+}
+
+// mpegTsStreamTypeH264 is the stream type of H264 in the program map table of an MPEG-TS
+const mpegTsStreamTypeH264 = 0x1b
+
+// tsDemuxer reads the H264 of the first program of an MPEG-TS. The PAT and PMT are expected to fit in a
+// single packet, which they do unless the program has dozens of streams.
+type tsDemuxer struct {
+	logger connectionLogger
+	reader io.Reader
+	packet [mpegTsPacketSize]byte
+	// pmtPid and videoPid are the PIDs of the program map table and the H264 it lists, -1 while not known
+	pmtPid, videoPid int
+	// pes is the PES packet of the video received so far
+	pes []byte
+	// loggedOtherStreams is set once the streams that are skipped were logged
+	loggedOtherStreams bool
+}
+
+func newTsDemuxer(logger connectionLogger, reader io.Reader) *tsDemuxer {
+	return &tsDemuxer{logger: logger, reader: reader, pmtPid: -1, videoPid: -1}
+}
+
+// next returns the H264 of the next PES packet of the video, which is complete once the next one starts
+func (d *tsDemuxer) next() ([]byte, error) {
+	for {
+		if _, err := io.ReadFull(d.reader, d.packet[:]); err != nil {
+			if (err == io.EOF || err == io.ErrUnexpectedEOF) && len(d.pes) > 0 {
+				pes := d.pes
+				d.pes = nil
+				return pesPayload(pes), nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		packet := d.packet[:]
+		if packet[0] != 0x47 {
+			return nil, errors.New("the MPEG-TS of the source lost its sync")
+		}
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		unitStart := packet[1]&0x40 != 0
+		if packet[3]&0x10 == 0 {
+			// Only an adaptation field, like for the clock
+			continue
+		}
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			if 1+int(payload[0]) > len(payload) {
+				continue
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		switch {
+		case pid == 0 && unitStart:
+			d.pat(payload)
+		case pid == d.pmtPid && unitStart:
+			if err := d.pmt(payload); err != nil {
+				return nil, err
+			}
+		case pid == d.videoPid:
+			if unitStart && len(d.pes) > 0 {
+				pes := d.pes
+				d.pes = append([]byte{}, payload...)
+				return pesPayload(pes), nil
+			}
+			if unitStart || len(d.pes) > 0 {
+				d.pes = append(d.pes, payload...)
+			}
+		}
+	}
+}
+
+// psiSection returns the section of a PAT or PMT that starts in the payload, without its CRC, nil when it does not fit
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 || 1+int(payload[0])+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if length < 4 || 3+length > len(section) {
+		return nil
+	}
+	return section[:3+length-4]
+}
+
+// pat reads the PID of the program map table of the first program
+func (d *tsDemuxer) pat(payload []byte) {
+	section := psiSection(payload)
+	if len(section) < 8 || section[0] != 0x00 {
+		return
+	}
+	for i := 8; i+4 <= len(section); i += 4 {
+		// Program 0 is the network information table
+		if program := int(section[i])<<8 | int(section[i+1]); program != 0 {
+			d.pmtPid = int(section[i+2]&0x1f)<<8 | int(section[i+3])
+			return
+		}
+	}
+}
+
+// pmt reads the PID of the H264 of the program
+func (d *tsDemuxer) pmt(payload []byte) error {
+	section := psiSection(payload)
+	if len(section) < 12 || section[0] != 0x02 {
+		return nil
+	}
+	videoPid, others := -1, 0
+	for i := 12 + (int(section[10]&0x0f)<<8 | int(section[11])); i+5 <= len(section); i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4])) {
+		if section[i] == mpegTsStreamTypeH264 && videoPid == -1 {
+			videoPid = int(section[i+1]&0x1f)<<8 | int(section[i+2])
+		} else {
+			others++
+		}
+	}
+	if videoPid == -1 {
+		return errors.New("the MPEG-TS of the source has no H264 video")
+	}
+	if others > 0 && !d.loggedOtherStreams {
+		d.loggedOtherStreams = true
+		d.logger.Printf("Skipping the %d other streams in the MPEG-TS of the source, audio is sent from -audio-args\n", others)
+	}
+	if videoPid != d.videoPid {
+		d.videoPid = videoPid
+		d.pes = nil
+	}
+	return nil
+}
+
+// pesPayload returns the H264 a PES packet carries, nil when it is no PES packet
+func pesPayload(pes []byte) []byte {
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || 9+int(pes[8]) > len(pes) {
+		return nil
+	}
+	return joinAnnexB(splitAnnexB(pes[9+int(pes[8]):]))
+}
+
+const (
+	// mp4MaxBoxSize is the largest top level box read, anything larger is not a fragment of a live stream
+	mp4MaxBoxSize = 256 << 20
+	// mp4MaxFragmentSamples is the most samples of a track a fragment can have
+	mp4MaxFragmentSamples = 1 << 16
+)
+
+// mp4Box is a box of an MP4, its payload is what follows its header
+type mp4Box struct {
+	typ     string
+	payload []byte
+}
+
+// mp4Children returns the boxes in the payload of a box, up to the first that does not fit
+func mp4Children(data []byte) []mp4Box {
+	boxes := []mp4Box{}
+	for len(data) >= 8 {
+		size, headerSize := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		if size == 1 {
+			if len(data) < 16 {
+				break
+			}
+			size, headerSize = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size == 0 {
+			size = uint64(len(data))
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			break
+		}
+		boxes = append(boxes, mp4Box{typ: string(data[4:8]), payload: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// mp4Child returns the payload of the first box of the type in the payload of a box, nil when it has none
+func mp4Child(data []byte, typ string) []byte {
+	for _, box := range mp4Children(data) {
+		if box.typ == typ {
+			return box.payload
+		}
+	}
+	return nil
+}
+
+// mp4Fields reads the big endian fields of a box, once one is missing they are all 0 and ok is false
+type mp4Fields struct {
+	data []byte
+	ok   bool
+}
+
+func (f *mp4Fields) uint32() uint32 {
+	if len(f.data) < 4 {
+		f.ok = false
+		return 0
+	}
+	value := binary.BigEndian.Uint32(f.data)
+	f.data = f.data[4:]
+	return value
+}
+
+func (f *mp4Fields) uint64() uint64 {
+	if len(f.data) < 8 {
+		f.ok = false
+		return 0
+	}
+	value := binary.BigEndian.Uint64(f.data)
+	f.data = f.data[8:]
+	return value
+}
+
+// mp4Track is the video track of an MP4
+type mp4Track struct {
+	id uint32
+	// entry is the type of its sample entry, like avc1, and codec the name of that codec in -codecs, "" when it cannot be sent
+	entry, codec  string
+	timescale     uint32
+	width, height uint16
+	// lengthSize is the size of the length before every H264 NAL unit, parameterSets the SPS and PPS of the avcC
+	lengthSize    int
+	parameterSets [][]byte
+	// defaultDuration and defaultSize of the samples, from the trex
+	defaultDuration, defaultSize uint32
+}
+
+// mp4Sample is where a sample of the video is in the stream and when it is presented, in the timescale of the track
+type mp4Sample struct {
+	offset int64
+	size   uint32
+	time   uint64
+}
+
+// mp4Codecs maps the sample entries that can be sent to their codec in -codecs
+var mp4Codecs = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"vp08": "vp8",
+	"vp09": "vp9",
+}
+
+// mp4Demuxer reads the video track of a fragmented MP4: the moov at its start describes the tracks, then every
+// fragment is a moof listing its samples followed by the mdat with their data. H264 is written in annex B with the
+// parameter sets of the moov before every IDR, VP8 and VP9 in IVF with the timestamps of the samples.
+//
+// Only the offsets in the moof of the fragment being read are used, the stream is read once in order.
+type mp4Demuxer struct {
+	logger connectionLogger
+	codec  string
+	reader io.Reader
+	// position is the offset in the stream of the next box, origin that of the ftyp of the output of the current
+	// ffmpeg, which the base data offsets of its fragments are relative to. A playlist starts another ffmpeg.
+	position, origin int64
+	track            mp4Track
+	// samples are the samples of the video in the last moof, in the mdat that follows
+	samples []mp4Sample
+	// wroteIvfHeader is set once the header of the IVF of VP8 or VP9 was written, the next ffmpeg continues the IVF
+	wroteIvfHeader bool
+	// loggedOtherTracks and loggedMissingSamples are set once those were logged
+	loggedOtherTracks, loggedMissingSamples bool
+}
+
+func newMp4Demuxer(logger connectionLogger, codec string, reader io.Reader) *mp4Demuxer {
+	return &mp4Demuxer{logger: logger, codec: codec, reader: reader}
+}
+
+// readBox reads the next top level box, it returns its type, payload and the size of its header
+func (d *mp4Demuxer) readBox() (string, []byte, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(d.reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return "", nil, 0, err
+	}
+	typ := string(header[4:8])
+	size, headerSize := uint64(binary.BigEndian.Uint32(header)), uint64(8)
+	if size == 1 {
+		if _, err := io.ReadFull(d.reader, header); err != nil {
+			return "", nil, 0, io.EOF
+		}
+		size, headerSize = binary.BigEndian.Uint64(header), 16
+	}
+	if size == 0 {
+		// The box lasts until the end of the stream
+		payload, err := io.ReadAll(io.LimitReader(d.reader, mp4MaxBoxSize))
+		d.position += int64(headerSize) + int64(len(payload))
+		return typ, payload, int64(headerSize), err
+	}
+	if size < headerSize || size-headerSize > mp4MaxBoxSize {
+		return "", nil, 0, fmt.Errorf("the MP4 of the source has a %q box of %d bytes, it is no fragmented MP4", typ, size)
+	}
+	payload := make([]byte, size-headerSize)
+	if _, err := io.ReadFull(d.reader, payload); err != nil {
+		return "", nil, 0, io.EOF
+	}
+	d.position += int64(size)
+	return typ, payload, int64(headerSize), nil
+}
+
+// next returns the video of the next fragment, or the IVF header after the moov
+func (d *mp4Demuxer) next() ([]byte, error) {
+	for {
+		start := d.position
+		typ, payload, headerSize, err := d.readBox()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "ftyp":
+			d.origin = start
+		case "moov":
+			if err := d.moov(payload); err != nil {
+				return nil, err
+			}
+			if isIvfCodec(d.track.codec) && !d.wroteIvfHeader {
+				d.wroteIvfHeader = true
+				return d.track.ivfHeader(), nil
+			}
+		case "moof":
+			d.samples = d.moof(payload, start)
+		case "mdat":
+			return d.mdat(payload, start+headerSize), nil
+		}
+	}
+}
+
+// moov reads the video track
+func (d *mp4Demuxer) moov(moov []byte) error {
+	var video *mp4Track
+	others := 0
+	for _, box := range mp4Children(moov) {
+		if box.typ != "trak" {
+			continue
+		}
+		if track, handler := parseMp4Track(box.payload); handler == "vide" && video == nil {
+			video = track
+		} else {
+			others++
+		}
+	}
+	if video == nil {
+		return errors.New("the MP4 of the source has no video")
+	}
+	if video.codec == "" {
+		return fmt.Errorf("the MP4 of the source has %s video, which cannot be sent", video.entry)
+	}
+	if video.codec != d.codec {
+		return fmt.Errorf("the MP4 of the source has %s video, the connection sends %s", strings.ToUpper(video.codec), strings.ToUpper(d.codec))
+	}
+	for _, box := range mp4Children(mp4Child(moov, "mvex")) {
+		if box.typ != "trex" {
+			continue
+		}
+		// The version and flags, the track, its default sample description, duration and size
+		fields := &mp4Fields{data: box.payload, ok: true}
+		fields.uint32()
+		if fields.uint32() != video.id {
+			continue
+		}
+		fields.uint32()
+		video.defaultDuration, video.defaultSize = fields.uint32(), fields.uint32()
+	}
+	if others > 0 && !d.loggedOtherTracks {
+		d.loggedOtherTracks = true
+		d.logger.Printf("Skipping the %d other tracks in the MP4 of the source, audio is sent from -audio-args\n", others)
+	}
+	d.track = *video
+	return nil
+}
+
+// parseMp4Track returns the track of a trak box, and the handler of its media, like vide for video
+func parseMp4Track(trak []byte) (*mp4Track, string) {
+	track := &mp4Track{lengthSize: 4}
+	if tkhd := mp4Child(trak, "tkhd"); len(tkhd) >= 24 && tkhd[0] == 1 {
+		track.id = binary.BigEndian.Uint32(tkhd[20:])
+	} else if len(tkhd) >= 16 {
+		track.id = binary.BigEndian.Uint32(tkhd[12:])
+	}
+	mdia := mp4Child(trak, "mdia")
+	handler := ""
+	if hdlr := mp4Child(mdia, "hdlr"); len(hdlr) >= 12 {
+		handler = string(hdlr[8:12])
+	}
+	if mdhd := mp4Child(mdia, "mdhd"); len(mdhd) >= 24 && mdhd[0] == 1 {
+		track.timescale = binary.BigEndian.Uint32(mdhd[20:])
+	} else if len(mdhd) >= 16 {
+		track.timescale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+	stsd := mp4Child(mp4Child(mp4Child(mdia, "minf"), "stbl"), "stsd")
+	if len(stsd) < 8 {
+		return track, handler
+	}
+	entries := mp4Children(stsd[8:])
+	if len(entries) == 0 {
+		return track, handler
+	}
+	entry := entries[0]
+	track.entry, track.codec = entry.typ, mp4Codecs[entry.typ]
+	// The visual sample entry has 78 bytes of fields before its boxes, the width and height at 24
+	if len(entry.payload) < 78 {
+		return track, handler
+	}
+	track.width, track.height = binary.BigEndian.Uint16(entry.payload[24:]), binary.BigEndian.Uint16(entry.payload[26:])
+	if avcC := mp4Child(entry.payload[78:], "avcC"); len(avcC) >= 6 {
+		track.lengthSize = int(avcC[4]&0x03) + 1
+		data := avcC[5:]
+		// The SPS, with their count in 5 bits, then the PPS
+		for _, countMask := range []byte{0x1f, 0xff} {
+			if len(data) == 0 {
+				break
+			}
+			count := int(data[0] & countMask)
+			data = data[1:]
+			for i := 0; i < count && len(data) >= 2 && 2+int(binary.BigEndian.Uint16(data)) <= len(data); i++ {
+				length := int(binary.BigEndian.Uint16(data))
+				track.parameterSets = append(track.parameterSets, data[2:2+length])
+				data = data[2+length:]
+			}
+		}
+	}
+	return track, handler
+}
+
+// moof returns the samples of the video track in the fragment that starts at the offset
+func (d *mp4Demuxer) moof(moof []byte, moofStart int64) []mp4Sample {
+	samples := []mp4Sample{}
+	for _, traf := range mp4Children(moof) {
+		if traf.typ != "traf" {
+			continue
+		}
+		tfhd := &mp4Fields{data: mp4Child(traf.payload, "tfhd"), ok: true}
+		flags := tfhd.uint32() & 0xffffff
+		if tfhd.uint32() != d.track.id || !tfhd.ok {
+			continue
+		}
+		// Without a base data offset the data is relative to the moof, as with default-base-is-moof
+		base, duration, size := moofStart, d.track.defaultDuration, d.track.defaultSize
+		if flags&0x01 != 0 {
+			base = d.origin + int64(tfhd.uint64())
+		}
+		if flags&0x02 != 0 {
+			tfhd.uint32()
+		}
+		if flags&0x08 != 0 {
+			duration = tfhd.uint32()
+		}
+		if flags&0x10 != 0 {
+			size = tfhd.uint32()
+		}
+		time := uint64(0)
+		if tfdt := (&mp4Fields{data: mp4Child(traf.payload, "tfdt"), ok: true}); tfdt.uint32()>>24 == 1 {
+			time = tfdt.uint64()
+		} else {
+			time = uint64(tfdt.uint32())
+		}
+
+		offset := base
+		for _, trun := range mp4Children(traf.payload) {
+			if trun.typ != "trun" {
+				continue
+			}
+			fields := &mp4Fields{data: trun.payload, ok: true}
+			versionAndFlags := fields.uint32()
+			version, flags := versionAndFlags>>24, versionAndFlags&0xffffff
+			count := fields.uint32()
+			if count > mp4MaxFragmentSamples {
+				continue
+			}
+			if flags&0x01 != 0 {
+				offset = base + int64(int32(fields.uint32()))
+			}
+			if flags&0x04 != 0 {
+				fields.uint32()
+			}
+			for i := uint32(0); i < count && fields.ok; i++ {
+				sampleDuration, sampleSize, compositionOffset := duration, size, int64(0)
+				if flags&0x100 != 0 {
+					sampleDuration = fields.uint32()
+				}
+				if flags&0x200 != 0 {
+					sampleSize = fields.uint32()
+				}
+				if flags&0x400 != 0 {
+					fields.uint32()
+				}
+				if flags&0x800 != 0 && version == 0 {
+					compositionOffset = int64(fields.uint32())
+				} else if flags&0x800 != 0 {
+					compositionOffset = int64(int32(fields.uint32()))
+				}
+				if fields.ok {
+					samples = append(samples, mp4Sample{offset: offset, size: sampleSize, time: uint64(int64(time) + compositionOffset)})
+				}
+				offset += int64(sampleSize)
+				time += uint64(sampleDuration)
+			}
+		}
+	}
+	return samples
+}
+
+// mdat returns the video of the samples of the last moof in the mdat, whose data starts at the offset
+func (d *mp4Demuxer) mdat(mdat []byte, dataStart int64) []byte {
+	video := []byte{}
+	for _, sample := range d.samples {
+		start := sample.offset - dataStart
+		if start < 0 || start+int64(sample.size) > int64(len(mdat)) {
+			if !d.loggedMissingSamples {
+				d.loggedMissingSamples = true
+				d.logger.Printf("Warning: the video samples of an MP4 fragment of the source are not in its mdat, skipping them\n")
+			}
+			continue
+		}
+		data := mdat[start : start+int64(sample.size)]
+		if d.track.codec == "h264" {
+			video = append(video, d.track.annexB(data)...)
+			continue
+		}
+		header := make([]byte, 12)
+		binary.LittleEndian.PutUint32(header, uint32(len(data)))
+		binary.LittleEndian.PutUint64(header[4:], sample.time)
+		video = append(append(video, header...), data...)
+	}
+	d.samples = nil
+	return video
+}
+
+// annexB returns the length prefixed NAL units of an H264 sample in annex B, with the parameter sets of the
+// avcC before an IDR that has none, as they are only in the moov unless the entry is avc3
+func (t *mp4Track) annexB(sample []byte) []byte {
+	units := [][]byte{}
+	hasSps, hasIdr := false, false
+	for len(sample) >= t.lengthSize {
+		length := 0
+		for _, b := range sample[:t.lengthSize] {
+			length = length<<8 | int(b)
+		}
+		sample = sample[t.lengthSize:]
+		if length == 0 || length > len(sample) {
+			break
+		}
+		unit := sample[:length]
+		sample = sample[length:]
+		hasSps = hasSps || unit[0]&0x1f == 7
+		hasIdr = hasIdr || unit[0]&0x1f == 5
+		units = append(units, unit)
+	}
+	if hasIdr && !hasSps {
+		units = append(append([][]byte{}, t.parameterSets...), units...)
+	}
+	return joinAnnexB(units)
+}
+
+// ivfHeader returns the header of the IVF the VP8 or VP9 of the track is written in, with the timescale as timebase
+func (t *mp4Track) ivfHeader() []byte {
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	if t.codec == "vp9" {
+		copy(header[8:], "VP90")
+	} else {
+		copy(header[8:], "VP80")
+	}
+	binary.LittleEndian.PutUint16(header[12:], t.width)
+	binary.LittleEndian.PutUint16(header[14:], t.height)
+	binary.LittleEndian.PutUint32(header[16:], t.timescale)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	return header
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+var (
+	sampleSps = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	samplePps = []byte{0x68, 0xce, 0x3c, 0x80}
+	sampleAud = []byte{0x09, 0xf0}
+	sampleIdr = []byte{0x65, 0x88, 0x84, 0x21, 0xa0}
+	sampleP   = []byte{0x41, 0x9a, 0x02, 0x03}
+)
+
+// annexB returns the NAL units with 4 byte start codes, as the demuxers write them
+func annexB(units ...[]byte) []byte {
+	data := []byte{}
+	for _, unit := range units {
+		data = append(append(data, 0, 0, 0, 1), unit...)
+	}
+	return data
+}
+
+// tsPacket returns an MPEG-TS packet with up to 184 bytes of the payload, filled up with an adaptation field
+func tsPacket(pid int, unitStart bool, payload []byte) []byte {
+	packet := []byte{0x47, byte(pid >> 8 & 0x1f), byte(pid), 0x10}
+	if unitStart {
+		packet[1] |= 0x40
+	}
+	if stuffing := 184 - len(payload); stuffing > 0 {
+		packet[3] |= 0x20
+		packet = append(packet, byte(stuffing-1))
+		if stuffing > 1 {
+			packet = append(packet, 0x00)
+			packet = append(packet, bytes.Repeat([]byte{0xff}, stuffing-2)...)
+		}
+	}
+	return append(packet, payload...)
+}
+
+// tsSection returns the payload of a packet with a PAT or PMT section, with a CRC of zeros that is not checked
+func tsSection(tableId byte, fields []byte) []byte {
+	length := len(fields) + 4
+	return append(append([]byte{0x00, tableId, 0xb0 | byte(length>>8), byte(length)}, fields...), 0, 0, 0, 0)
+}
+
+// tsStream returns an MPEG-TS of a program with an audio stream and the H264 on PID 0x100, a PES packet per access unit
+func tsStream(accessUnits ...[]byte) []byte {
+	stream := tsPacket(0, true, tsSection(0x00, []byte{0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00}))
+	stream = append(stream, tsPacket(0x1000, true, tsSection(0x02, []byte{
+		0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0x00,
+		0x0f, 0xe1, 0x01, 0xf0, 0x00,
+		mpegTsStreamTypeH264, 0xe1, 0x00, 0xf0, 0x00,
+	}))...)
+	for _, accessUnit := range accessUnits {
+		pes := append([]byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5, 0x21, 0, 1, 0, 1}, accessUnit...)
+		for start := true; len(pes) > 0; start = false {
+			n := 184
+			if n > len(pes) {
+				n = len(pes)
+			}
+			stream = append(stream, tsPacket(0x100, start, pes[:n])...)
+			pes = pes[n:]
+		}
+		// Audio between the video
+		stream = append(stream, tsPacket(0x101, true, []byte{0, 0, 1, 0xc0, 0, 3, 0x80, 0, 0, 0xff, 0xf1, 0x50})...)
+	}
+	return stream
+}
+
+func TestTsDemuxer(t *testing.T) {
+	// An access unit larger than a packet
+	large := append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0x5a}, 500)...)
+	accessUnits := [][]byte{
+		annexB(sampleAud, sampleSps, samplePps, sampleIdr),
+		annexB(sampleAud, sampleP),
+		annexB(sampleAud, large),
+	}
+	want := [][]byte{
+		annexB(sampleSps, samplePps, sampleIdr),
+		annexB(sampleP),
+		annexB(large),
+	}
+	stream := tsStream(accessUnits...)
+	if format := detectSourceFormat(stream); format != "mpegts" {
+		t.Fatalf("detectSourceFormat = %s, want mpegts", format)
+	}
+
+	demuxer := newTsDemuxer(connectionLogger{}, bytes.NewReader(stream))
+	for i, want := range want {
+		got, err := demuxer.next()
+		if err != nil {
+			t.Fatalf("access unit %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("access unit %d is %x, want %x", i, got, want)
+		}
+	}
+	if _, err := demuxer.next(); err != io.EOF {
+		t.Errorf("got %v after the last access unit, want io.EOF", err)
+	}
+}
+
+func TestTsDemuxerErrors(t *testing.T) {
+	withoutVideo := append(tsPacket(0, true, tsSection(0x00, []byte{0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00})),
+		tsPacket(0x1000, true, tsSection(0x02, []byte{0, 1, 0xc1, 0, 0, 0xe1, 0x01, 0xf0, 0x00, 0x0f, 0xe1, 0x01, 0xf0, 0x00}))...)
+	lostSync := tsStream(annexB(sampleSps, samplePps, sampleIdr))
+	lostSync[2*mpegTsPacketSize] = 0x00
+	truncated := tsStream(annexB(sampleSps, samplePps, sampleIdr))
+	truncated = truncated[:len(truncated)-100]
+
+	for name, stream := range map[string][]byte{"without H264": withoutVideo, "lost sync": lostSync} {
+		if _, err := newTsDemuxer(connectionLogger{}, bytes.NewReader(stream)).next(); err == nil || err == io.EOF {
+			t.Errorf("%s: got %v, want an error", name, err)
+		}
+	}
+	// A cut off packet ends the stream after the video before it
+	demuxer := newTsDemuxer(connectionLogger{}, bytes.NewReader(truncated))
+	if got, err := demuxer.next(); err != nil || !bytes.Equal(got, annexB(sampleSps, samplePps, sampleIdr)) {
+		t.Errorf("got %x, %v before the cut off packet", got, err)
+	}
+	if _, err := demuxer.next(); err != io.EOF {
+		t.Errorf("got %v after the cut off packet, want io.EOF", err)
+	}
+}
+
+// box returns an MP4 box with the payloads
+func box(typ string, payloads ...[]byte) []byte {
+	data := make([]byte, 8)
+	copy(data[4:], typ)
+	for _, payload := range payloads {
+		data = append(data, payload...)
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+// u32 returns the big endian fields
+func u32(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(data[4*i:], value)
+	}
+	return data
+}
+
+// mp4Moov returns the moov of a fragmented MP4 with an audio track 1 and the video track 2 of the sample entry
+func mp4Moov(sampleEntry []byte) []byte {
+	track := func(id uint32, handler string, entry []byte) []byte {
+		return box("trak",
+			box("tkhd", u32(0, 0, 0, id, 0)),
+			box("mdia",
+				box("mdhd", u32(0, 0, 0, 90000, 0)),
+				box("hdlr", u32(0, 0), []byte(handler), u32(0, 0, 0)),
+				box("minf", box("stbl", box("stsd", u32(0, 1), entry)))))
+	}
+	return box("moov",
+		box("mvhd", u32(0, 0, 0, 1000, 0)),
+		track(1, "soun", box("mp4a", make([]byte, 28))),
+		track(2, "vide", sampleEntry),
+		box("mvex", box("trex", u32(0, 1, 1, 0, 0, 0)), box("trex", u32(0, 2, 1, 3000, 0, 0))))
+}
+
+// visualSampleEntry returns a sample entry of 1280x720 video with the boxes
+func visualSampleEntry(typ string, boxes ...[]byte) []byte {
+	fields := make([]byte, 78)
+	binary.BigEndian.PutUint16(fields[24:], 1280)
+	binary.BigEndian.PutUint16(fields[26:], 720)
+	return box(typ, append([][]byte{fields}, boxes...)...)
+}
+
+// mp4Fragment returns a moof and mdat with the samples of track 2, which start at time. With baseDataOffset the tfhd
+// has the offset of the mdat data in the stream, otherwise the samples are relative to the moof.
+func mp4Fragment(time uint64, baseDataOffset int64, samples ...[]byte) []byte {
+	trun := u32(0x301, uint32(len(samples)), 0)
+	data := []byte{}
+	for _, sample := range samples {
+		trun = append(trun, u32(3000, uint32(len(sample)))...)
+		data = append(data, sample...)
+	}
+	tfhd := box("tfhd", u32(0x020000, 2))
+	if baseDataOffset >= 0 {
+		tfhd = box("tfhd", u32(0x000001, 2, uint32(baseDataOffset>>32), uint32(baseDataOffset)))
+	}
+	tfdt := box("tfdt", u32(0x01000000, uint32(time>>32), uint32(time)))
+	moof := func(dataOffset uint32) []byte {
+		binary.BigEndian.PutUint32(trun[8:], dataOffset)
+		return box("moof", box("mfhd", u32(0, 1)), box("traf", tfhd, tfdt, box("trun", trun)))
+	}
+	dataOffset := uint32(len(moof(0)) + 8)
+	if baseDataOffset >= 0 {
+		dataOffset = 0
+	}
+	return append(moof(dataOffset), box("mdat", data)...)
+}
+
+// lengthPrefixed returns the NAL units with the 4 byte lengths of an MP4 sample
+func lengthPrefixed(units ...[]byte) []byte {
+	data := []byte{}
+	for _, unit := range units {
+		data = append(append(data, u32(uint32(len(unit)))...), unit...)
+	}
+	return data
+}
+
+func TestMp4DemuxerH264(t *testing.T) {
+	avcC := append([]byte{1, 0x42, 0xc0, 0x1f, 0xff, 0xe1, 0, byte(len(sampleSps))}, sampleSps...)
+	avcC = append(append(avcC, 1, 0, byte(len(samplePps))), samplePps...)
+	header := append(box("ftyp", []byte("iso5"), u32(0), []byte("iso5")), mp4Moov(visualSampleEntry("avc1", box("avcC", avcC)))...)
+	stream := append(header, mp4Fragment(0, -1, lengthPrefixed(sampleAud, sampleIdr), lengthPrefixed(sampleP))...)
+	// The second fragment addresses its samples from the start of the stream
+	moofSize := len(mp4Fragment(6000, 0, lengthPrefixed(sampleP), lengthPrefixed(sampleP))) - 8 - 2*(4+len(sampleP))
+	stream = append(stream, mp4Fragment(6000, int64(len(stream)+moofSize+8), lengthPrefixed(sampleP), lengthPrefixed(sampleP))...)
+	if format := detectSourceFormat(stream); format != "mp4" {
+		t.Fatalf("detectSourceFormat = %s, want mp4", format)
+	}
+
+	pipe := &demuxedPipe{demuxer: newMp4Demuxer(connectionLogger{}, "h264", bytes.NewReader(stream)), Closer: io.NopCloser(nil)}
+	got, err := io.ReadAll(pipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The IDR gets the parameter sets of the avcC
+	want := annexB(sampleSps, samplePps, sampleIdr, sampleP, sampleP, sampleP)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestMp4DemuxerVp9(t *testing.T) {
+	frames := [][]byte{{0x82, 0x49, 0x83}, {0x86, 0x01}}
+	stream := append(append(box("ftyp", []byte("iso5"), u32(0)), mp4Moov(visualSampleEntry("vp09", box("vpcC", u32(1<<24, 0))))...),
+		mp4Fragment(9000, -1, frames...)...)
+
+	demuxer := newMp4Demuxer(connectionLogger{}, "vp9", bytes.NewReader(stream))
+	header, err := demuxer.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(header, []byte("DKIF")) || string(header[8:12]) != "VP90" || binary.LittleEndian.Uint16(header[12:]) != 1280 || binary.LittleEndian.Uint16(header[14:]) != 720 || binary.LittleEndian.Uint32(header[16:]) != 90000 {
+		t.Errorf("got the IVF header %x", header)
+	}
+	video, err := demuxer.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every frame has the IVF frame header with its size and timestamp
+	for i, frame := range frames {
+		if len(video) < 12+len(frame) {
+			t.Fatalf("frame %d is missing", i)
+		}
+		if size, timestamp := binary.LittleEndian.Uint32(video), binary.LittleEndian.Uint64(video[4:]); size != uint32(len(frame)) || timestamp != uint64(9000+3000*i) {
+			t.Errorf("frame %d has size %d and timestamp %d", i, size, timestamp)
+		}
+		if !bytes.Equal(video[12:12+len(frame)], frame) {
+			t.Errorf("frame %d is %x, want %x", i, video[12:12+len(frame)], frame)
+		}
+		video = video[12+len(frame):]
+	}
+}
+
+func TestMp4DemuxerErrors(t *testing.T) {
+	avc1 := visualSampleEntry("avc1", box("avcC", []byte{1, 0x42, 0xc0, 0x1f, 0xff, 0xe0, 0}))
+	tests := map[string]struct {
+		codec  string
+		stream []byte
+	}{
+		"other codec than the connection": {"vp8", mp4Moov(avc1)},
+		"codec that cannot be sent":       {"h264", mp4Moov(visualSampleEntry("hvc1"))},
+		"box larger than a fragment":      {"h264", u32(mp4MaxBoxSize+9, 0x6d646174)},
+	}
+	for name, test := range tests {
+		if _, err := newMp4Demuxer(connectionLogger{}, test.codec, bytes.NewReader(test.stream)).next(); err == nil || err == io.EOF {
+			t.Errorf("%s: got %v, want an error", name, err)
+		}
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	// 3 and 4 byte start codes
+	data := append(append([]byte{0, 0, 1}, sampleSps...), annexB(samplePps, sampleIdr)...)
+	units := splitAnnexB(data)
+	want := [][]byte{sampleSps, samplePps, sampleIdr}
+	if len(units) != len(want) {
+		t.Fatalf("got %d NAL units, want %d", len(units), len(want))
+	}
+	for i := range units {
+		if !bytes.Equal(units[i], want[i]) {
+			t.Errorf("NAL unit %d is %x, want %x", i, units[i], want[i])
+		}
+	}
+}
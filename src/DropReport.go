@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	dropReportInterval = flag.Duration("drop-report-interval", time.Second, "how often the frames dropped since the last report are sent on the quality data channel, at most")
+)
+
+// dropReportLabel is the label of the data channel a client opens to be told about dropped frames
+const dropReportLabel = "quality"
+
+// Reasons frames are dropped for
+const (
+	dropReasonBackpressure = "backpressure"
+	dropReasonPause        = "pause"
+	dropReasonFrameSkip    = "frame-skip"
+	dropReasonSourceSwitch = "source-switch"
+	dropReasonHold         = "hold"
+	dropReasonOversize     = "oversize"
+)
+
+// dropReport is a message on the quality data channel, Frames frames were not sent since the previous message for Reason
+type dropReport struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Frames int    `json:"frames"`
+}
+
+// dropReporter tells the client about the frames that were not sent, so it can show that the quality is reduced.
+// The drops are counted by reason and sent once per -drop-report-interval, as every frame can be dropped for a while.
+// It does nothing until the client opened the quality data channel.
+type dropReporter struct {
+	logger  connectionLogger
+	lock    sync.Mutex
+	channel *webrtc.DataChannel
+	dropped map[string]int
+}
+
+func newDropReporter(logger connectionLogger) *dropReporter {
+	return &dropReporter{logger: logger, dropped: map[string]int{}}
+}
+
+// handleDataChannel is the OnDataChannel handler, it starts reporting on the quality data channel
+func (r *dropReporter) handleDataChannel(channel *webrtc.DataChannel) {
+	if channel.Label() != dropReportLabel {
+		return
+	}
+	channel.OnOpen(func() {
+		r.logger.Printf("Reporting dropped frames on the %s data channel\n", dropReportLabel)
+		r.lock.Lock()
+		r.channel = channel
+		r.lock.Unlock()
+		go r.run(channel)
+	})
+}
+
+// frame records a frame that was not sent
+func (r *dropReporter) frame(reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.channel == nil {
+		return
+	}
+	r.dropped[reason]++
+}
+
+func (r *dropReporter) run(channel *webrtc.DataChannel) {
+	ticker := time.NewTicker(*dropReportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if channel.ReadyState() != webrtc.DataChannelStateOpen {
+			return
+		}
+		for _, report := range r.reports() {
+			message, err := json.Marshal(report)
+			if err != nil {
+				continue
+			}
+			if err := channel.SendText(string(message)); err != nil {
+				r.logger.Printf("Cannot report dropped frames: %v\n", err)
+				return
+			}
+		}
+	}
+}
+
+// reports returns a report for every reason frames were dropped for since the last call
+func (r *dropReporter) reports() []dropReport {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	reports := []dropReport{}
+	for reason, frames := range r.dropped {
+		reports = append(reports, dropReport{Type: "dropped", Reason: reason, Frames: frames})
+		delete(r.dropped, reason)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Reason < reports[j].Reason })
+	return reports
+}
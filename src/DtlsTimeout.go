@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
+var (
+	dtlsTimeout = flag.Duration("dtls-timeout", 10*time.Second, "close connections that did not complete the DTLS handshake this long after ICE connected, which happens when a firewall drops the DTLS packets. 0 leaves it to pion, which gives up after 30 seconds")
+)
+
+func validateDtlsTimeout() error {
+	if *dtlsTimeout < 0 {
+		return errors.New("the timeout cannot be negative")
+	}
+	return nil
+}
+
+// dtlsHandshakeTimedOut waits -dtls-timeout for the handshake after ICE connected, until connected is closed when
+// the PeerConnection connected or closed is closed with the connection. It reports whether the handshake timed out.
+func dtlsHandshakeTimedOut(connected <-chan struct{}, closed <-chan struct{}) bool {
+	timer := time.NewTimer(*dtlsTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-connected:
+	case <-closed:
+	}
+	return false
+}
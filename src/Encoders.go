@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	encoders      = flag.String("encoders", "", "comma separated list of video encoders to try in order, like h264_nvenc,libx264. When ffmpeg fails to initialize one, the -c:v of the ffmpeg arguments is replaced by the next")
+	ffmpegThreads = flag.Int("ffmpeg-threads", 0, "limit the threads every ffmpeg uses by passing -threads to the encoder, 0 to let ffmpeg decide")
+)
+
+// encoderFailures are printed by ffmpeg when an encoder cannot be opened, for example because no GPU is available
+var encoderFailures = []string{
+	"Error while opening encoder",
+	"Error initializing output stream",
+	"Unknown encoder",
+	"No capable devices found",
+	"Cannot load",
+	"OpenEncodeSessionEx failed",
+}
+
+func encoderList() []string {
+	list := []string{}
+	for _, encoder := range strings.Split(*encoders, ",") {
+		if encoder = strings.TrimSpace(encoder); encoder != "" {
+			list = append(list, encoder)
+		}
+	}
+	return list
+}
+
+// videoEncoderIndex returns the index of the value of -c:v in args, or -1 when there is none
+func videoEncoderIndex(args []string) int {
+	index := -1
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-c:v" || args[i] == "-vcodec" || args[i] == "-codec:v" {
+			index = i + 1
+		}
+	}
+	return index
+}
+
+// validateEncoders checks that the ffmpeg arguments select one of -encoders, which is then replaced on failure
+func validateEncoders(args []string) error {
+	list := encoderList()
+	if len(list) == 0 {
+		return nil
+	}
+	index := videoEncoderIndex(args)
+	if index < 0 {
+		return fmt.Errorf("the ffmpeg arguments contain no -c:v to replace")
+	}
+	for _, encoder := range list {
+		if encoder == args[index] {
+			return nil
+		}
+	}
+	return fmt.Errorf("the ffmpeg arguments use -c:v %s, which is not in the list", args[index])
+}
+
+func validateFfmpegThreads(threads int) error {
+	if threads < 0 {
+		return fmt.Errorf("%d is not a positive number of threads", threads)
+	}
+	return nil
+}
+
+// withThreads adds -threads before the output, the last argument, so it applies to the encoder
+func withThreads(args []string, threads int) []string {
+	if threads == 0 || len(args) == 0 {
+		return args
+	}
+	output := len(args) - 1
+	return append(append(append([]string{}, args[:output]...), "-threads", strconv.Itoa(threads)), args[output:]...)
+}
+
+// StartFfmpeg runs ffmpeg with the given arguments, -ffmpeg-threads and -ffmpeg-loglevel. When -encoders is set and ffmpeg exits
+// without output because the encoder could not be initialized, it is retried with the next encoder of the list.
+func StartFfmpeg(logger connectionLogger, arg ...string) (io.ReadCloser, error) {
+	arg = withLogLevel(withThreads(arg, *ffmpegThreads))
+	list := encoderList()
+	index := videoEncoderIndex(arg)
+	if len(list) == 0 || index < 0 {
+		return RunCommand("ffmpeg", arg...)
+	}
+	// Start at the encoder selected by the arguments, VP8 arguments select libvpx and are never replaced
+	start := -1
+	for i, encoder := range list {
+		if encoder == arg[index] {
+			start = i
+		}
+	}
+	if start < 0 {
+		return RunCommand("ffmpeg", arg...)
+	}
+
+	for i := start; ; i++ {
+		encoderArgs := append([]string{}, arg...)
+		encoderArgs[index] = list[i]
+
+		stderr := &stderrTail{}
+		dataPipe, err := RunCommandWithStderr("ffmpeg", stderr, encoderArgs...)
+		if err != nil {
+			return nil, err
+		}
+		// Wait for the first output, an encoder that fails to initialize exits before producing any
+		buffered := bufio.NewReader(dataPipe)
+		if _, err := buffered.Peek(1); err == nil {
+			return &bufferedReadCloser{Reader: buffered, Closer: dataPipe}, nil
+		}
+		// Closing waits for ffmpeg to exit, so all of its stderr has been received
+		dataPipe.Close()
+
+		failure := stderr.encoderFailure()
+		if failure == "" {
+			// Not an encoder problem, let the caller see the empty stream
+			return io.NopCloser(buffered), nil
+		}
+		if i+1 >= len(list) {
+			return nil, fmt.Errorf("encoder %s failed and there is no encoder left to fall back to: %s", list[i], failure)
+		}
+		logger.Printf("Encoder %s failed (%s), falling back to %s\n", list[i], failure, list[i+1])
+	}
+}
+
+// bufferedReadCloser reads through the buffer that was used to wait for the first output
+type bufferedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// stderrTail keeps the last few kilobytes ffmpeg wrote to stderr
+type stderrTail struct {
+	lock sync.Mutex
+	data []byte
+}
+
+const stderrTailSize = 8192
+
+func (t *stderrTail) Write(b []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.data = append(t.data, b...)
+	if len(t.data) > stderrTailSize {
+		t.data = t.data[len(t.data)-stderrTailSize:]
+	}
+	return len(b), nil
+}
+
+// encoderFailure returns the stderr line reporting that the encoder could not be initialized, if any
+func (t *stderrTail) encoderFailure() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, line := range bytes.Split(t.data, []byte("\n")) {
+		for _, failure := range encoderFailures {
+			if bytes.Contains(line, []byte(failure)) {
+				return strings.TrimSpace(string(line))
+			}
+		}
+	}
+	return ""
+}
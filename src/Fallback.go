@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	fallbackFrameFile = flag.String("fallback-frame", "", "H264 file with a keyframe, like a \"technical difficulties\" slate, sent to the connections whose source ended or failed until a restarted ffmpeg produces video again, instead of closing them")
+	fallbackInterval  = flag.Duration("fallback-interval", time.Second, "how often the fallback frame is sent while the source is down")
+	fallbackRetry     = flag.Duration("fallback-retry", 2*time.Second, "how long to wait before starting ffmpeg again when restarting a source that ended or failed")
+)
+
+// fallbackFrame is the Annex B keyframe read from -fallback-frame, nil when it is not set
+var fallbackFrame []byte
+
+func validateFallbackFrame() error {
+	if *fallbackFrameFile == "" {
+		return nil
+	}
+	if !usesFfmpeg() {
+		return errors.New("only the ffmpeg source can be restarted after it ended")
+	}
+	if *fallbackInterval <= 0 || *fallbackRetry <= 0 {
+		return errors.New("-fallback-interval and -fallback-retry must be positive")
+	}
+	return nil
+}
+
+// loadFallbackFrame reads the parameter sets and the first keyframe of -fallback-frame, like the output of
+// ffmpeg -i slate.png -frames:v 1 -c:v libx264 -f h264 slate.h264
+func loadFallbackFrame(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	h264, err := h264reader.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	frame := []byte{}
+	sps, pps, idr := false, false, false
+	for {
+		nal, err := h264.NextNAL()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if idr && (nal.UnitType != h264reader.NalUnitTypeCodedSliceIdr || startsPicture(nal)) {
+			// The keyframe ends at the first NAL unit that is not one of its slices
+			break
+		}
+		switch nal.UnitType {
+		case h264reader.NalUnitTypeSPS:
+			sps = true
+		case h264reader.NalUnitTypePPS:
+			pps = true
+		case h264reader.NalUnitTypeCodedSliceIdr:
+			idr = true
+		default:
+			continue
+		}
+		frame = append(append(frame, 0x00, 0x00, 0x00, 0x01), nal.Data...)
+	}
+	if !sps || !pps || !idr {
+		return nil, fmt.Errorf("%s does not contain an SPS, PPS and keyframe", path)
+	}
+	return frame, nil
+}
+
+// lose tells the supervisor of the source that the send loop reached its end, without blocking
+func (s *videoSource) lose() {
+	select {
+	case s.lost <- struct{}{}:
+	default:
+	}
+}
+
+// superviseSource restarts the source of the session whenever the send loop lost it, retrying every -fallback-retry
+// until ffmpeg produces a keyframe again. The send loop sends the fallback frame meanwhile.
+func superviseSource(s *session) {
+	for {
+		select {
+		case <-s.source.lost:
+		case <-s.closed:
+			return
+		}
+		for {
+			err := s.switchSource(s.playingSource())
+			if err == nil {
+				s.logger.Printf("The video source recovered\n")
+				break
+			}
+			if err == errSourceClosed {
+				return
+			}
+			s.logger.Printf("Cannot restart the video source, retrying in %v: %v\n", *fallbackRetry, err)
+			select {
+			case <-time.After(*fallbackRetry):
+			case <-s.closed:
+				return
+			}
+		}
+	}
+}
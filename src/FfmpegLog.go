@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ffmpegLogLevel = flag.String("ffmpeg-loglevel", "warning", "the -loglevel passed to every ffmpeg, like error, warning or info, so its stderr only holds relevant messages. Empty keeps the default of ffmpeg, which includes the banner")
+	ffmpegNoStats  = flag.Bool("ffmpeg-nostats", false, "pass -nostats to every ffmpeg, so it does not print a progress line for every encoded frame")
+)
+
+// ffmpegLogLevels are the names accepted by the -loglevel of ffmpeg, numbers are accepted too.
+// They may be prefixed by flags like repeat+ or level+.
+var ffmpegLogLevels = []string{"quiet", "panic", "fatal", "error", "warning", "info", "verbose", "debug", "trace"}
+
+func validateFfmpegLogLevel(level string) error {
+	if level == "" {
+		return nil
+	}
+	if i := strings.LastIndex(level, "+"); i >= 0 {
+		level = level[i+1:]
+	}
+	if _, err := strconv.Atoi(level); err == nil {
+		return nil
+	}
+	for _, known := range ffmpegLogLevels {
+		if level == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %s", level)
+}
+
+// withLogLevel puts -loglevel and -nostats before the arguments, as global options of ffmpeg.
+// A log level given in the arguments themselves is kept.
+func withLogLevel(args []string) []string {
+	global := []string{}
+	if *ffmpegLogLevel != "" && !hasFfmpegOption(args, "-loglevel", "-v") {
+		global = append(global, "-loglevel", *ffmpegLogLevel)
+	}
+	if *ffmpegNoStats && !hasFfmpegOption(args, "-nostats", "-stats") {
+		global = append(global, "-nostats")
+	}
+	if len(global) == 0 {
+		return args
+	}
+	return append(global, args...)
+}
+
+func hasFfmpegOption(args []string, names ...string) bool {
+	for _, arg := range args {
+		for _, name := range names {
+			if arg == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// frameLimits are the max-fr (frames per second) and max-fs (macroblocks of 16x16 pixels) the client can decode,
+// taken from the fmtp of the codec we send in its offer, 0 when it sets none
+type frameLimits struct {
+	maxFrameRate uint
+	maxFrameSize uint
+}
+
+var (
+	maxFrameRatePattern = regexp.MustCompile(`(?:^|;)\s*max-fr=(\d+)`)
+	maxFrameSizePattern = regexp.MustCompile(`(?:^|;)\s*max-fs=(\d+)`)
+)
+
+// offeredFrameLimits returns the limits of the first payload type of codec, a -codecs name, in the video sections of the offer.
+// H264 (RFC 6184) and VP8 (RFC 7741) both count max-fs in macroblocks.
+func offeredFrameLimits(offer string, codec string) frameLimits {
+	parsedOffer := &sdp.SessionDescription{}
+	if err := parsedOffer.Unmarshal([]byte(offer)); err != nil {
+		return frameLimits{}
+	}
+	for _, media := range parsedOffer.MediaDescriptions {
+		if media.MediaName.Media != "video" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.Atoi(format)
+			if err != nil {
+				continue
+			}
+			offered, err := parsedOffer.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil || !strings.EqualFold(offered.Name, codec) {
+				continue
+			}
+			limits := frameLimits{}
+			if match := maxFrameRatePattern.FindStringSubmatch(offered.Fmtp); match != nil {
+				maxFrameRate, _ := strconv.ParseUint(match[1], 10, 32)
+				limits.maxFrameRate = uint(maxFrameRate)
+			}
+			if match := maxFrameSizePattern.FindStringSubmatch(offered.Fmtp); match != nil {
+				maxFrameSize, _ := strconv.ParseUint(match[1], 10, 32)
+				limits.maxFrameSize = uint(maxFrameSize)
+			}
+			return limits
+		}
+	}
+	return frameLimits{}
+}
+
+func (l frameLimits) String() string {
+	limits := []string{}
+	if l.maxFrameRate > 0 {
+		limits = append(limits, fmt.Sprintf("max-fr %d fps", l.maxFrameRate))
+	}
+	if l.maxFrameSize > 0 {
+		limits = append(limits, fmt.Sprintf("max-fs %d macroblocks", l.maxFrameSize))
+	}
+	return strings.Join(limits, ", ")
+}
+
+// exceedsFrameRate tells whether the frame rate we send, paced by frameDuration, is above max-fr
+func (l frameLimits) exceedsFrameRate() bool {
+	return l.maxFrameRate > 0 && time.Second/time.Duration(l.maxFrameRate) > frameDuration()
+}
+
+// frameDuration returns the time between the frames of the connection, longer than frameDuration when
+// max-fr is lower. ffmpeg then outputs at max-fr, see ffmpegArgs.
+func (l frameLimits) frameDuration() time.Duration {
+	if l.exceedsFrameRate() {
+		return time.Second / time.Duration(l.maxFrameRate)
+	}
+	return frameDuration()
+}
+
+// ffmpegArgs makes ffmpeg output within the limits, before the output, the last argument. A frame rate above
+// max-fr is lowered with -r, and a picture larger than max-fs is scaled down keeping its aspect ratio, to a size
+// in whole macroblocks. The scale filter is added to the -vf of the arguments when they have one.
+func (l frameLimits) ffmpegArgs(args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+	output := len(args) - 1
+	limited := append([]string{}, args[:output]...)
+	if l.maxFrameSize > 0 {
+		// The macroblocks of the input picture, and the factor scaling both sides to fit max-fs
+		macroblocks := "ceil(iw/16)*ceil(ih/16)"
+		factor := fmt.Sprintf("sqrt(%d/(%s))", l.maxFrameSize, macroblocks)
+		scale := fmt.Sprintf("scale=w='if(lte(%[1]s,%[2]d),iw,trunc(iw*%[3]s/16)*16)':h='if(lte(%[1]s,%[2]d),ih,trunc(ih*%[3]s/16)*16)'", macroblocks, l.maxFrameSize, factor)
+		filtered := false
+		for i := 0; i+1 < len(limited); i++ {
+			if limited[i] == "-vf" || limited[i] == "-filter:v" {
+				limited[i+1] += "," + scale
+				filtered = true
+			}
+		}
+		if !filtered {
+			limited = append(limited, "-vf", scale)
+		}
+	}
+	if l.exceedsFrameRate() {
+		limited = append(limited, "-r", strconv.FormatUint(uint64(l.maxFrameRate), 10))
+	}
+	return append(limited, args[output:]...)
+}
+
+// exceededBy returns why the client cannot decode the stream with sps, empty when it is within max-fs
+func (l frameLimits) exceededBy(sps spsInfo) string {
+	macroblocks := ((sps.width + 15) / 16) * ((sps.height + 15) / 16)
+	if l.maxFrameSize == 0 || macroblocks <= l.maxFrameSize {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d is %d macroblocks, above the max-fs %d of the offer", sps.width, sps.height, macroblocks, l.maxFrameSize)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
+var (
+	frameSizeWarning = flag.Int("frame-size-warning", 1<<20, "log frames larger than this many bytes, at most once per second. 0 logs none")
+	maxFrameSize     = flag.Int("max-frame-size", 16<<20, "drop frames larger than this many bytes, like those of a corrupt input, and the frames up to the next keyframe. 0 sends every frame")
+)
+
+// rtpPayloadSize is about the payload of a packet as filled by the packetizer of pion, which splits samples
+// at its outbound MTU of 1200 bytes. Every packet also holds the RTP header and the fragmentation header of the codec.
+const rtpPayloadSize = 1200 - 12
+
+func validateFrameSize() error {
+	if *frameSizeWarning < 0 || *maxFrameSize < 0 {
+		return errors.New("the frame sizes cannot be negative")
+	}
+	return nil
+}
+
+// frameSizeChecker finds the frames of a connection that are unusually large, like a high resolution keyframe
+// with its parameter sets, or too large to be a real frame and probably a corrupt input.
+type frameSizeChecker struct {
+	logger      connectionLogger
+	lastWarning time.Time
+	// suppressed is the number of large frames not logged since the last warning
+	suppressed int
+}
+
+// allowed reports whether a frame of size bytes may be sent
+func (c *frameSizeChecker) allowed(size int) bool {
+	if *maxFrameSize > 0 && size > *maxFrameSize {
+		c.logger.Printf("Dropping a frame of %d bytes, larger than -max-frame-size, and the frames up to the next keyframe\n", size)
+		return false
+	}
+	if *frameSizeWarning <= 0 || size <= *frameSizeWarning {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(c.lastWarning) < time.Second {
+		c.suppressed++
+		return true
+	}
+	packets := (size + rtpPayloadSize - 1) / rtpPayloadSize
+	if c.suppressed > 0 {
+		c.logger.Printf("Sending a frame of %d bytes in about %d packets, larger than -frame-size-warning, %d more since the last warning\n", size, packets, c.suppressed)
+	} else {
+		c.logger.Printf("Sending a frame of %d bytes in about %d packets, larger than -frame-size-warning\n", size, packets)
+	}
+	c.lastWarning = now
+	c.suppressed = 0
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"math"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	frameSkip = flag.Int("frame-skip", 1, "only send every Nth frame, skipping the non-reference frames in between, to lower the frame rate and bitrate without re-encoding. IDR frames are always sent")
+)
+
+func validateFrameSkip(n int) error {
+	if n < 1 {
+		return errors.New("must be at least 1, 1 sends every frame")
+	}
+	return nil
+}
+
+// frameSkipper skips N-1 out of every N frames of -frame-skip, counting from the last IDR.
+//
+// Only non-reference frames can be skipped, the frames after a skipped reference frame could not be
+// decoded until the next IDR. A stream that only has reference frames, like x264 without B-frames,
+// is sent as is, the effective frame rate that is logged for every GOP shows how much was skipped.
+type frameSkipper struct {
+	logger connectionLogger
+	n      int
+	// frame is the number of the current frame since the last IDR
+	frame int
+	// sent is the number of frames sent since the last IDR
+	sent int
+	// loggedFps is the effective frame rate that was logged last
+	loggedFps float64
+}
+
+// shouldSkip reports whether nal must be skipped, frame is the duration of a frame at the source
+func (s *frameSkipper) shouldSkip(nal *h264reader.NAL, frame time.Duration) bool {
+	if s.n <= 1 || !isSlice(nal.UnitType) {
+		return false
+	}
+	if nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr {
+		s.logEffectiveFps(frame)
+		s.frame = 0
+		s.sent = 1
+		return false
+	}
+	s.frame++
+	if s.frame%s.n != 0 && nal.RefIdc == 0 {
+		return true
+	}
+	s.sent++
+	return false
+}
+
+// logEffectiveFps logs the frame rate sent during the last GOP, when it changed
+func (s *frameSkipper) logEffectiveFps(frame time.Duration) {
+	if s.sent == 0 || frame <= 0 {
+		return
+	}
+	fps := float64(s.sent) / float64(s.frame+1) * float64(time.Second) / float64(frame)
+	fps = math.Round(fps*10) / 10
+	if fps != s.loggedFps {
+		s.logger.Printf("Sending %d of %d frames after skipping, %g fps\n", s.sent, s.frame+1, fps)
+		s.loggedFps = fps
+	}
+}
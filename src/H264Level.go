@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	h264LevelCheck = flag.String("h264-level-check", "warn", "what to do when the SPS of the stream has a profile, level or resolution above the profile-level-id negotiated with the client: off, warn in the log, or refuse to send it by closing the connection")
+)
+
+func validateH264LevelCheck(mode string) error {
+	switch mode {
+	case "off", "warn", "refuse":
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, expected off, warn or refuse", mode)
+}
+
+// h264MaxFrameSizes is the MaxFS of table A-1 of the H264 spec, the largest frame in macroblocks a decoder
+// of the level must handle, by level_idc. Level 1b is level_idc 9, or 11 with constraint_set3_flag.
+var h264MaxFrameSizes = map[uint8]uint{
+	9: 99, 10: 99, 11: 396, 12: 396, 13: 396, 20: 396, 21: 792, 22: 1620, 30: 1620, 31: 3600, 32: 5120,
+	40: 8192, 41: 8192, 42: 8704, 50: 22080, 51: 36864, 52: 36864, 60: 139264, 61: 139264, 62: 139264,
+}
+
+// h264LevelOrder orders level_idc 9 (level 1b) between level 1 and 1.1
+func h264LevelOrder(levelIdc uint8) uint {
+	if levelIdc == 9 {
+		return 105
+	}
+	return uint(levelIdc) * 10
+}
+
+func h264LevelName(levelIdc uint8) string {
+	if levelIdc == 9 {
+		return "1b"
+	}
+	return fmt.Sprintf("%d.%d", levelIdc/10, levelIdc%10)
+}
+
+var fmtpProfileLevelIdPattern = regexp.MustCompile(`(?i)(?:^|;)\s*profile-level-id=([0-9a-f]{6})`)
+
+// trackFmtpLine returns the fmtp of the codec negotiated for track, empty when there is none
+func trackFmtpLine(peerConnection *webrtc.PeerConnection, track webrtc.TrackLocal) string {
+	for _, sender := range peerConnection.GetSenders() {
+		if sender.Track() != track {
+			continue
+		}
+		for _, codec := range sender.GetParameters().Codecs {
+			if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) {
+				return codec.SDPFmtpLine
+			}
+		}
+	}
+	return ""
+}
+
+// checkH264Level returns why the stream with sps cannot be decoded by a client that negotiated fmtp,
+// empty when it fits. With level-asymmetry-allowed the offered level is the one the client decodes,
+// so it is the one compared. The check is skipped when fmtp has no profile-level-id.
+func checkH264Level(sps spsInfo, fmtp string) []string {
+	match := fmtpProfileLevelIdPattern.FindStringSubmatch(fmtp)
+	if match == nil {
+		return nil
+	}
+	profileLevelId, _ := hex.DecodeString(match[1])
+	profileIdc, constraintFlags, levelIdc := profileLevelId[0], profileLevelId[1], profileLevelId[2]
+	if levelIdc == 11 && constraintFlags&0x10 != 0 && profileIdc != 100 {
+		levelIdc = 9
+	}
+	streamLevelIdc := sps.levelIdc
+	if streamLevelIdc == 11 && sps.constraintFlags&0x10 != 0 && sps.profileIdc != 100 {
+		streamLevelIdc = 9
+	}
+
+	problems := []string{}
+	if sps.profileIdc != profileIdc {
+		problems = append(problems, fmt.Sprintf("the stream has profile %d instead of %d", sps.profileIdc, profileIdc))
+	}
+	if h264LevelOrder(streamLevelIdc) > h264LevelOrder(levelIdc) {
+		problems = append(problems, fmt.Sprintf("the stream has level %s above %s", h264LevelName(streamLevelIdc), h264LevelName(levelIdc)))
+	}
+	if maxFrameSize, ok := h264MaxFrameSizes[levelIdc]; ok {
+		frameSize := ((sps.width + 15) / 16) * ((sps.height + 15) / 16)
+		if frameSize > maxFrameSize {
+			problems = append(problems, fmt.Sprintf("%dx%d is %d macroblocks, level %s allows at most %d", sps.width, sps.height, frameSize, h264LevelName(levelIdc), maxFrameSize))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	h264ProfileLevelId = flag.String("h264-profile-level-id", "", "only negotiate H264 with this profile-level-id, like 42e01f for constrained baseline level 3.1, and advertise it in the answer")
+)
+
+// ffmpegProfiles maps the values of ffmpeg's -profile:v to the profile_idc and constraint flags they produce
+var ffmpegProfiles = map[string]string{
+	"baseline": "42",
+	"main":     "4d",
+	"high":     "64",
+	"high10":   "6e",
+	"high422":  "7a",
+	"high444":  "f4",
+}
+
+// validateH264ProfileLevelId checks -h264-profile-level-id and warns when it doesn't match the
+// -profile:v given to ffmpeg, as browsers reject streams with a profile other than negotiated.
+func validateH264ProfileLevelId(profileLevelId string, args []string) error {
+	if profileLevelId == "" {
+		return nil
+	}
+	if decoded, err := hex.DecodeString(profileLevelId); err != nil || len(decoded) != 3 {
+		return fmt.Errorf("%q is not a 6 digit hexadecimal profile-level-id", profileLevelId)
+	}
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] != "-profile:v" && args[i] != "-profile" {
+			continue
+		}
+		profileIdc, ok := ffmpegProfiles[args[i+1]]
+		if !ok {
+			continue
+		}
+		if !strings.EqualFold(profileLevelId[:2], profileIdc) {
+			fmt.Printf("Warning: -h264-profile-level-id %s does not match the profile of ffmpeg's -profile:v %s (%s...)\n", profileLevelId, args[i+1], profileIdc)
+		}
+	}
+	return nil
+}
+
+// h264FmtpLine is the fmtp of the H264 codec we register and send when the profile-level-id is pinned
+func h264FmtpLine() string {
+	if *h264ProfileLevelId == "" {
+		return ""
+	}
+	return "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + strings.ToLower(*h264ProfileLevelId)
+}
+
+// registerCodecs registers the codecs we can negotiate, the pion defaults unless the H264 profile is pinned.
+// VP8 and VP9 are kept so they stay available as a fallback in -codecs.
+func registerCodecs(m *webrtc.MediaEngine) error {
+	if *h264ProfileLevelId == "" {
+		return m.RegisterDefaultCodecs()
+	}
+
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return err
+	}
+
+	videoRTCPFeedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: videoClockRate, SDPFmtpLine: h264FmtpLine(), RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        102,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: videoClockRate, SDPFmtpLine: "apt=102"},
+			PayloadType:        121,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: videoClockRate, RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        96,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: videoClockRate, SDPFmtpLine: "apt=96"},
+			PayloadType:        97,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: videoClockRate, SDPFmtpLine: "profile-id=0", RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        98,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: videoClockRate, SDPFmtpLine: "apt=98"},
+			PayloadType:        99,
+		},
+	} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var profileLevelIdPattern = regexp.MustCompile(`(?i)(a=fmtp:\d+ [^\r\n]*profile-level-id=)([0-9a-f]{6})`)
+
+// pinAnswerProfileLevelId replaces the level of the negotiated H264 profile-level-id in the answer with ours.
+// Only the level may differ between offer and answer (RFC 6184 section 8.2.2), the profile already matched.
+// This is applied to the SDP sent to the browser only, pion rejects a local description it did not generate.
+func pinAnswerProfileLevelId(answer string) string {
+	if *h264ProfileLevelId == "" {
+		return answer
+	}
+	pinned := strings.ToLower(*h264ProfileLevelId)
+	return profileLevelIdPattern.ReplaceAllStringFunc(answer, func(match string) string {
+		parts := profileLevelIdPattern.FindStringSubmatch(match)
+		if !strings.EqualFold(parts[2][:4], pinned[:4]) {
+			return match
+		}
+		return parts[1] + pinned
+	})
+}
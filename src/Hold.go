@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// holdState tells the send loops of a connection whether it is put on hold through POST /pause/{id} and POST /resume/{id}.
+//
+// While held, the media is still read and paced, so a live input does not queue up, but no samples are written.
+// The client keeps showing the last frame. After resuming, the video waits for a keyframe, as the frames it depends on were not sent.
+type holdState struct {
+	lock sync.Mutex
+	held bool
+}
+
+func (h *holdState) isHeld() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.held
+}
+
+// set puts the connection on hold or resumes it, it reports false when it already was
+func (h *holdState) set(held bool) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.held == held {
+		return false
+	}
+	h.held = held
+	return true
+}
+
+// handleHold returns the handler of POST /pause/{id} when held is true, otherwise of POST /resume/{id}
+func handleHold(held bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+		s := sessions.Get(id)
+		if s == nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if s.hold.set(held) {
+			if held {
+				s.logger.Printf("Holding the connection\n")
+			} else {
+				s.logger.Printf("Resuming the connection\n")
+				// Restarting ffmpeg gets the keyframe right away, instead of at the next one of the stream
+				s.keyframes.requested("resume")
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var (
+	tlsCert = flag.String("tls-cert", "", "PEM file with the certificate to serve the signaling over HTTPS, which also lets clients use HTTP/2. The media is sent over WebRTC either way")
+	tlsKey  = flag.String("tls-key", "", "PEM file with the private key of -tls-cert")
+	h2cMode = flag.Bool("h2c", false, "also accept HTTP/2 without TLS, for a reverse proxy talking HTTP/2 to the server")
+)
+
+// signalingTLS is the TLS configuration of the HTTP server, nil to serve plain HTTP
+var signalingTLS *tls.Config
+
+func validateSignalingTLS() error {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("both -tls-cert and -tls-key are required")
+	}
+	if *h2cMode && *tlsCert != "" {
+		return errors.New("HTTP/2 is already negotiated over TLS, -h2c is for plain HTTP")
+	}
+	return nil
+}
+
+// loadSignalingTLS loads the certificate configured using -tls-cert and -tls-key.
+// The HTTP server offers HTTP/2 with ALPN on top of it, next to HTTP/1.1.
+func loadSignalingTLS(certFile, keyFile string) (*tls.Config, error) {
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{keyPair}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// listenScheme is the scheme of the URL the HTTP server listens on
+func listenScheme() string {
+	if signalingTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// listenAndServe serves srv over HTTPS when configured, otherwise over plain HTTP, accepting HTTP/2 with -h2c
+func listenAndServe(srv *http.Server) error {
+	if signalingTLS != nil {
+		srv.TLSConfig = signalingTLS
+		return srv.ListenAndServeTLS("", "")
+	}
+	if *h2cMode {
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+	}
+	return srv.ListenAndServe()
+}
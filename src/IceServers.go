@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	relayAcceptanceWait = flag.Duration("relay-acceptance-wait", 2*time.Second, "only select a TURN relayed candidate pair when no direct pair connected within this time, so TURN is a fallback")
+	maxTurnServers      = flag.Int("max-turn-servers", 0, "only allocate relayed candidates on the first this many TURN servers of -ice-server, 0 for all")
+	maxRelayCandidates  = flag.Int("max-relay-candidates", 0, "answer with at most this many relayed candidates, those with the highest priority, 0 for all")
+)
+
+func isTurnURL(rawURL string) bool {
+	url, err := ice.ParseURL(rawURL)
+	return err == nil && (url.Scheme == ice.SchemeTypeTURN || url.Scheme == ice.SchemeTypeTURNS)
+}
+
+// gatheringIceServers returns the ICE servers to gather candidates from, leaving out the TURN servers beyond -max-turn-servers.
+// STUN servers are always used, they cost no relay bandwidth.
+func gatheringIceServers() []webrtc.ICEServer {
+	if *maxTurnServers <= 0 {
+		return iceServers.servers
+	}
+	servers := []webrtc.ICEServer{}
+	turnServers := 0
+	for _, server := range iceServers.servers {
+		urls := []string{}
+		isTurn := false
+		for _, rawURL := range server.URLs {
+			if !isTurnURL(rawURL) {
+				urls = append(urls, rawURL)
+			} else if turnServers < *maxTurnServers {
+				urls = append(urls, rawURL)
+				isTurn = true
+			}
+		}
+		if isTurn {
+			turnServers++
+		}
+		if len(urls) > 0 {
+			server.URLs = urls
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// turnServer is a configured TURN server whose relayed candidates can be recognized by their address
+type turnServer struct {
+	url      string
+	fallback bool
+	// index is the position of the server in -ice-server, the first one is preferred
+	index int
+}
+
+// turnServersByIP resolves the hosts of the configured TURN servers.
+// Relayed candidates are allocated on the address of the TURN server, this is how we find out which server a candidate came from.
+func turnServersByIP() map[string]turnServer {
+	servers := map[string]turnServer{}
+	for i, server := range iceServers.servers {
+		for _, rawURL := range server.URLs {
+			if !isTurnURL(rawURL) {
+				continue
+			}
+			url, _ := ice.ParseURL(rawURL)
+			ips, err := net.LookupIP(url.Host)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				if _, ok := servers[ip.String()]; !ok {
+					servers[ip.String()] = turnServer{url: rawURL, fallback: iceServers.fallback[i], index: i}
+				}
+			}
+		}
+	}
+	return servers
+}
+
+func hasFallbackIceServers() bool {
+	for _, fallback := range iceServers.fallback {
+		if fallback {
+			return true
+		}
+	}
+	return false
+}
+
+// relayCandidateAddress returns the address of an a=candidate line of type relay
+func relayCandidateAddress(line string) (string, bool) {
+	fields := strings.Fields(strings.TrimPrefix(line, "a=candidate:"))
+	if !strings.HasPrefix(line, "a=candidate:") || len(fields) < 8 || fields[7] != "relay" {
+		return "", false
+	}
+	return fields[4], true
+}
+
+// errNoIceCandidates is returned by setupConnection when gathering found no candidate to send, like on hosts with only a loopback interface
+var errNoIceCandidates = errors.New("no ICE candidates available, check the network configuration: the host needs a network interface other than loopback, or a -ice-server reachable from it")
+
+// hasCandidates tells whether the description has an a=candidate line
+func hasCandidates(description string) bool {
+	for _, line := range strings.Split(description, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneRelayCandidates removes the relayed candidates we don't want the client to use from the description we send
+func pruneRelayCandidates(logger connectionLogger, description string) string {
+	return limitRelayCandidates(logger, removeFallbackCandidates(logger, description))
+}
+
+// relayCandidateKey identifies the candidate of an a=candidate line, the lines of its RTP and RTCP components
+// and of other media sections have the same key
+func relayCandidateKey(line string) string {
+	fields := strings.Fields(strings.TrimPrefix(line, "a=candidate:"))
+	return fields[0] + " " + fields[4] + " " + fields[5]
+}
+
+// limitRelayCandidates keeps the -max-relay-candidates relayed candidates with the highest priority in the description, of equal ones
+// those of the TURN server listed first. Every relayed candidate the client uses can cost TURN bandwidth.
+// As Pion gathers them all, the others are only left out of the description we send.
+func limitRelayCandidates(logger connectionLogger, description string) string {
+	if *maxRelayCandidates <= 0 {
+		return description
+	}
+	lines := strings.Split(description, "\r\n")
+	servers := turnServersByIP()
+	priorities := map[string]uint64{}
+	serverIndex := map[string]int{}
+	relayed := []string{}
+	for _, line := range lines {
+		if address, ok := relayCandidateAddress(line); ok {
+			key := relayCandidateKey(line)
+			serverIndex[key] = len(iceServers.servers)
+			if server, known := servers[address]; known {
+				serverIndex[key] = server.index
+			}
+			priority, _ := strconv.ParseUint(strings.Fields(line)[3], 10, 32)
+			if _, seen := priorities[key]; !seen {
+				relayed = append(relayed, key)
+			}
+			if priority > priorities[key] {
+				priorities[key] = priority
+			}
+		}
+	}
+	if len(relayed) <= *maxRelayCandidates {
+		return description
+	}
+	sort.SliceStable(relayed, func(i, j int) bool {
+		if priorities[relayed[i]] != priorities[relayed[j]] {
+			return priorities[relayed[i]] > priorities[relayed[j]]
+		}
+		return serverIndex[relayed[i]] < serverIndex[relayed[j]]
+	})
+	removed := map[string]bool{}
+	for _, key := range relayed[*maxRelayCandidates:] {
+		removed[key] = true
+	}
+	logger.Printf("Leaving %d of %d relayed candidates out of the description\n", len(removed), len(relayed))
+
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if _, ok := relayCandidateAddress(line); ok && removed[relayCandidateKey(line)] {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\r\n")
+}
+
+// removeFallbackCandidates leaves the relayed candidates of fallback TURN servers out of the description we send,
+// when a TURN server that isn't a fallback provided a relayed candidate as well.
+func removeFallbackCandidates(logger connectionLogger, description string) string {
+	if !hasFallbackIceServers() {
+		return description
+	}
+	servers := turnServersByIP()
+	lines := strings.Split(description, "\r\n")
+
+	primaryRelayed := false
+	for _, line := range lines {
+		if address, ok := relayCandidateAddress(line); ok {
+			if server, known := servers[address]; known && !server.fallback {
+				primaryRelayed = true
+			}
+		}
+	}
+	if !primaryRelayed {
+		logger.Printf("No relayed candidate from a primary TURN server, offering the fallback servers as well\n")
+		return description
+	}
+
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if address, ok := relayCandidateAddress(line); ok && servers[address].fallback {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\r\n")
+}
+
+// logSelectedCandidatePair logs the candidate pair the connection uses, and the TURN server when it is relayed.
+// The TURN server is recorded in the usage, so relayed bandwidth can be accounted for when the connection closes.
+func logSelectedCandidatePair(logger connectionLogger, transport *webrtc.ICETransport, usage *connectionUsage) {
+	transport.OnSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+		via := ""
+		if pair.Local.Typ == webrtc.ICECandidateTypeRelay {
+			server, ok := turnServersByIP()[pair.Local.Address]
+			if !ok {
+				server.url = "an unknown TURN server"
+			}
+			via = " via " + server.url
+			usage.relayedVia(server.url)
+		} else {
+			usage.relayedVia("")
+		}
+		if pair.Local.Protocol == webrtc.ICEProtocolTCP {
+			via += " over TCP"
+			logger.Printf("Using the ICE-TCP fallback\n")
+		}
+		logger.Printf("Selected candidate pair: local %s %s:%d%s, remote %s %s:%d\n", pair.Local.Typ, pair.Local.Address, pair.Local.Port, via, pair.Remote.Typ, pair.Remote.Address, pair.Remote.Port)
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	iceInterfaces = flag.String("ice-interfaces", "", "comma separated network interface names or CIDRs, like eth0 or 203.0.113.0/24, to only gather ICE host candidates on the interfaces with that name or with an address in that network. Empty uses all interfaces")
+)
+
+// iceInterfaceFilter restricts the interfaces ICE gathers candidates on, nil when all are used
+var iceInterfaceFilter func(string) bool
+
+// setupInterfaceFilter parses -ice-interfaces, when it is set
+func setupInterfaceFilter() error {
+	if *iceInterfaces == "" {
+		return nil
+	}
+	names := map[string]bool{}
+	networks := []*net.IPNet{}
+	for _, value := range strings.Split(*iceInterfaces, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			names[value] = true
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("invalid -ice-interfaces: %v", err)
+		}
+		networks = append(networks, network)
+	}
+
+	// The addresses are looked up on every gathering, as they can change while running
+	filter := func(name string) bool {
+		if names[name] {
+			return true
+		}
+		if len(networks) == 0 {
+			return false
+		}
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return false
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, network := range networks {
+				if network.Contains(ipNet.IP) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	matching := []string{}
+	for _, iface := range interfaces {
+		if filter(iface.Name) {
+			matching = append(matching, iface.Name)
+		}
+	}
+	if len(matching) == 0 {
+		return errors.New("no network interface matches -ice-interfaces")
+	}
+	fmt.Printf("Gathering ICE candidates on %s\n", strings.Join(matching, ", "))
+	iceInterfaceFilter = filter
+	return nil
+}
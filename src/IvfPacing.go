@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+var (
+	ivfPacing = flag.String("ivf-pacing", "timestamps", "how VP8 and VP9 frames are paced: timestamps sends every frame when it is due by the timestamp in its IVF frame header, fps sends a frame every frame duration like H264, which /config/fps changes")
+)
+
+// ivfMaxGap is the largest time between two frames that is accepted as the timing of the stream,
+// a timestamp jumping further ahead or back starts the clock over at that frame
+const ivfMaxGap = 10 * time.Second
+
+func validateIvfPacing() error {
+	if *ivfPacing != "timestamps" && *ivfPacing != "fps" {
+		return errors.New("unknown pacing, use timestamps or fps")
+	}
+	return nil
+}
+
+// ivfClock paces the frames of an IVF stream by the timestamps of their frame headers, in units of the timebase of the file header.
+// The frames are due relative to the first frame, so time spent reading and sending does not add up to drift.
+type ivfClock struct {
+	numerator   uint64
+	denominator uint64
+	started     bool
+	// start is when the frame with timestamp first was sent
+	start time.Time
+	first uint64
+	last  uint64
+}
+
+// newIvfClock returns the clock of the stream with the header, nil when it is paced at the frame rate
+// because of -ivf-pacing fps or because the header has no usable timebase
+func newIvfClock(logger connectionLogger, header *ivfreader.IVFFileHeader) *ivfClock {
+	if *ivfPacing != "timestamps" {
+		return nil
+	}
+	if header == nil || header.TimebaseNumerator == 0 || header.TimebaseDenominator == 0 {
+		logger.Printf("The IVF header has no timebase, pacing the frames at the frame rate\n")
+		return nil
+	}
+	return &ivfClock{numerator: uint64(header.TimebaseNumerator), denominator: uint64(header.TimebaseDenominator)}
+}
+
+func (c *ivfClock) duration(ticks uint64) time.Duration {
+	return time.Duration(ticks * c.numerator * uint64(time.Second) / c.denominator)
+}
+
+// frame returns when the frame with the timestamp is due and how long after the previous frame it is.
+// The gap is 0 for the first frame and after the timestamps jumped, then the frame is due now.
+func (c *ivfClock) frame(timestamp uint64, now time.Time) (time.Time, time.Duration) {
+	if !c.started || timestamp <= c.last || c.duration(timestamp-c.last) > ivfMaxGap {
+		c.started = true
+		c.start = now
+		c.first = timestamp
+		c.last = timestamp
+		return now, 0
+	}
+	gap := c.duration(timestamp - c.last)
+	c.last = timestamp
+	return c.start.Add(c.duration(timestamp - c.first)), gap
+}
+
+// waitUntil waits for the time, or until closed is closed
+func waitUntil(due time.Time, closed <-chan struct{}) {
+	wait := time.Until(due)
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-closed:
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	keyframeInterval = flag.Duration("keyframe-interval", 0, "make ffmpeg encode a keyframe this often, like 2s, by setting -g and -force_key_frames in the ffmpeg arguments, so a client joining or recovering waits at most this long for one. Each keyframe is several times the size of the other frames, a shorter interval costs bandwidth. 0 leaves the keyframes to the ffmpeg arguments")
+)
+
+// keyframeIntervalWarning is the interval below which the bandwidth of the keyframes is warned about
+const keyframeIntervalWarning = time.Second
+
+func validateKeyframeInterval() error {
+	if *keyframeInterval < 0 {
+		return errors.New("-keyframe-interval cannot be negative")
+	}
+	if *keyframeInterval == 0 {
+		return nil
+	}
+	if *keyframeInterval < frameDuration() {
+		return fmt.Errorf("-keyframe-interval %v is shorter than a frame, %v", *keyframeInterval, frameDuration())
+	}
+	if *keyframeInterval < keyframeIntervalWarning {
+		fmt.Printf("Warning: -keyframe-interval %v encodes a keyframe more than once per second, which costs a lot of bandwidth\n", *keyframeInterval)
+	}
+	if !usesFfmpeg() {
+		fmt.Printf("Warning: -keyframe-interval only applies to the ffmpeg source, the keyframes of -source %s are sent as they come\n", *mediaSourceKind)
+	}
+	return nil
+}
+
+// keyframeIntervalArgs sets the -g and -force_key_frames of the ffmpeg arguments to -keyframe-interval, adding them
+// before the output, the last argument, when the arguments have none. -force_key_frames keeps the interval when the
+// frame rate is lowered, like for max-fr, -g in frames at the paced frame rate keeps the encoder from adding others
+// in between, scene cuts still do.
+func keyframeIntervalArgs(args []string) []string {
+	if *keyframeInterval == 0 || len(args) == 0 {
+		return args
+	}
+	gop := strconv.FormatInt(int64((*keyframeInterval+frameDuration()-1)/frameDuration()), 10)
+	forced := "expr:gte(t,n_forced*" + strconv.FormatFloat(keyframeInterval.Seconds(), 'f', -1, 64) + ")"
+
+	output := len(args) - 1
+	interval := append([]string{}, args[:output]...)
+	hasGop, hasForced := false, false
+	for i := 0; i+1 < len(interval); i++ {
+		switch interval[i] {
+		case "-g", "-g:v":
+			interval[i+1] = gop
+			hasGop = true
+		case "-force_key_frames", "-force_key_frames:v":
+			interval[i+1] = forced
+			hasForced = true
+		}
+	}
+	if !hasGop {
+		interval = append(interval, "-g", gop)
+	}
+	if !hasForced {
+		interval = append(interval, "-force_key_frames", forced)
+	}
+	return append(interval, args[output:]...)
+}
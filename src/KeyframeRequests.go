@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+var (
+	keyframeOnPli           = flag.Bool("keyframe-on-pli", false, "start a new ffmpeg for the connection when the client requests a keyframe with a PLI or FIR, so it recovers from loss without waiting for the next keyframe. A file input starts over")
+	keyframeRequestInterval = flag.Duration("keyframe-request-interval", time.Second, "honor at most one keyframe request of a connection per interval, the others are suppressed")
+)
+
+func validateKeyframeRequests() error {
+	if *keyframeOnPli && !usesFfmpeg() {
+		return errors.New("only the ffmpeg source can be restarted for a keyframe")
+	}
+	return nil
+}
+
+// keyframeRequests honors the keyframe requests of a connection, the PLI and FIR its client sends after losing packets.
+//
+// ffmpeg cannot be told to encode a keyframe, so a request is honored by switching the connection to a new ffmpeg
+// with the same arguments, which starts with one. That is expensive and every keyframe costs bitrate, so a client
+// sending many requests, for example on a flapping connection, gets at most one per -keyframe-request-interval.
+type keyframeRequests struct {
+	logger connectionLogger
+	lock   sync.Mutex
+	// session is nil until the connection was set up, requests before that are ignored
+	session *session
+	// lastHonored is when the last request was honored
+	lastHonored time.Time
+	// restarting is set while a new ffmpeg is starting
+	restarting bool
+	// suppressed is the number of requests suppressed since the last honored request
+	suppressed int
+}
+
+// attach starts honoring requests for the session
+func (k *keyframeRequests) attach(s *session) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.session = s
+}
+
+// handleRTCP honors the keyframe requests among the received RTCP packets
+func (k *keyframeRequests) handleRTCP(packets []rtcp.Packet) {
+	for _, packet := range packets {
+		switch packet.(type) {
+		case *rtcp.PictureLossIndication:
+			k.requested("PLI")
+		case *rtcp.FullIntraRequest:
+			k.requested("FIR")
+		}
+	}
+}
+
+func (k *keyframeRequests) requested(kind string) {
+	if !*keyframeOnPli {
+		return
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.session == nil {
+		return
+	}
+	now := time.Now()
+	if k.restarting || now.Sub(k.lastHonored) < *keyframeRequestInterval {
+		k.suppressed++
+		return
+	}
+	if k.suppressed > 0 {
+		k.logger.Printf("Received a keyframe request (%s), suppressed %d since the last one\n", kind, k.suppressed)
+	} else {
+		k.logger.Printf("Received a keyframe request (%s)\n", kind)
+	}
+	k.lastHonored = now
+	k.suppressed = 0
+	k.restarting = true
+	go k.restart(k.session)
+}
+
+func (k *keyframeRequests) restart(s *session) {
+	if err := s.switchSource(s.playingSource()); err != nil && err != errSourceClosed {
+		s.logger.Printf("Cannot restart ffmpeg for a keyframe: %v\n", err)
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.restarting = false
+}
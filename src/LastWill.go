@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// lastWillOnce sends the last will once, when several goroutines panic at the same time
+var lastWillOnce sync.Once
+
+// sendLastWill posts a "server_shutdown" event with the ids of the open connections to -webhook-url, as the
+// process is about to die without closing them. A clean shutdown closes the connections, which sends their
+// "disconnected" events instead. It is posted once without retries, the process cannot wait.
+func sendLastWill(reason string) {
+	lastWillOnce.Do(func() {
+		if *webhookURL == "" {
+			return
+		}
+		connectionIds := []int{}
+		for _, s := range sessions.List() {
+			connectionIds = append(connectionIds, s.id)
+		}
+		fmt.Printf("Exiting unexpectedly (%s), reporting %d connections to the webhook\n", reason, len(connectionIds))
+		body, err := json.Marshal(webhookEvent{Event: "server_shutdown", Reason: reason, ConnectionIds: connectionIds, Timestamp: time.Now()})
+		if err != nil {
+			fmt.Printf("cannot encode webhook: %v\n", err)
+			return
+		}
+		if err := postWebhook(body); err != nil {
+			fmt.Printf("webhook server_shutdown failed: %v\n", err)
+		}
+	})
+}
+
+// lastWill sends the last will when the goroutine panics and panics again, so the process still crashes with the
+// stack trace of the panic. It is deferred at the top of main and of the goroutines of a connection, as a panic can
+// only be recovered in the goroutine it happened in. The panics of HTTP handlers are recovered by net/http already.
+func lastWill() {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	sendLastWill(fmt.Sprintf("panic: %v", recovered))
+	panic(recovered)
+}
@@ -0,0 +1,150 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// TestConnectionsDoNotLeakGoroutines sets up connections and tears them down at several points, and checks that the
+// goroutines of their PeerConnections, send loops and RTCP readers are all gone afterwards
+func TestConnectionsDoNotLeakGoroutines(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams for several seconds")
+	}
+	fakeFfmpeg(t)
+
+	// The first connection starts the goroutines that live as long as the process
+	testConnection(t, true)
+	baseline := settledGoroutines(0)
+
+	for i := 0; i < 5; i++ {
+		// A connection that streams until both ends close it
+		testConnection(t, true)
+		// A connection closed before it connected, while its send loop waits for ICE
+		testConnection(t, false)
+		// An offer that is rejected
+		if _, _, err := setupConnection(signalingRequest{offer: "not an offer"}); err == nil {
+			t.Fatal("an invalid offer was answered")
+		}
+	}
+
+	if count := settledGoroutines(baseline); count > baseline {
+		buffer := make([]byte, 1<<20)
+		t.Fatalf("%d goroutines are left after the connections closed, %d before them:\n%s", count, baseline, buffer[:runtime.Stack(buffer, true)])
+	}
+}
+
+// settledGoroutines waits up to 10 seconds for the number of goroutines to stop changing, or to reach the target
+func settledGoroutines(target int) int {
+	count := runtime.NumGoroutine()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		time.Sleep(200 * time.Millisecond)
+		previous := count
+		count = runtime.NumGoroutine()
+		if target > 0 && count <= target || target == 0 && count == previous {
+			break
+		}
+	}
+	return count
+}
+
+// testConnection sets up a connection from a receiver in this process, streams until the first video packet
+// arrived when connect is set, and then closes both ends
+func testConnection(t *testing.T, connect bool) {
+	t.Helper()
+	receiver, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	if _, err = receiver.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan struct{})
+	receiver.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for first := true; ; first = false {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+			if first {
+				close(received)
+			}
+		}
+	})
+	offer, err := receiver.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(receiver)
+	if err = receiver.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+
+	answer, connectionId, err := setupConnection(signalingRequest{offer: receiver.LocalDescription().SDP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sessions.Get(connectionId)
+	if s == nil {
+		t.Fatalf("session %d is not registered", connectionId)
+	}
+	defer s.peerConnection.Close()
+	if !connect {
+		return
+	}
+	if err = receiver.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no video received within 10s")
+	}
+}
+
+// fakeFfmpeg puts an ffmpeg first in the PATH that runs TestHelperFfmpeg of this test binary
+func fakeFfmpeg(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\nFAKE_FFMPEG=1 exec %q -test.run='^TestHelperFfmpeg$'\n", os.Args[0])
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// TestHelperFfmpeg is not a test, it is the ffmpeg started by fakeFfmpeg. It writes an H264 stream of a keyframe and
+// 29 other pictures every second until its stdout is closed.
+func TestHelperFfmpeg(t *testing.T) {
+	if os.Getenv("FAKE_FFMPEG") != "1" {
+		return
+	}
+	picture := make([]byte, 500)
+	for i := range picture {
+		picture[i] = 0xaa
+	}
+	copy(picture, []byte{0, 0, 0, 1, 0x41, 0x9a})
+	keyframe := append([]byte{0, 0, 0, 1, 0x65, 0x88}, picture[6:]...)
+	for i := 0; ; i++ {
+		data := picture
+		if i%30 == 0 {
+			data = keyframe
+		}
+		if _, err := os.Stdout.Write(data); err != nil {
+			os.Exit(0)
+		}
+		time.Sleep(time.Second / 30)
+	}
+}
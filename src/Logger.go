@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+var (
+	debugLog    = flag.Bool("debug", false, "also log what only helps debugging, like the samples that could not be sent because the connection was closing and every frame sent")
+	debugHeader = flag.Bool("debug-header", false, "let a request enable -debug for its own connection only with the X-Debug: 1 header")
+)
+
+// connectionLogger prefixes every line with the connection id and the request id
+// it was created for, so logs can be correlated with a reverse proxy.
+type connectionLogger struct {
+	connectionId int
+	requestId    string
+	// debug logs Debugf for this connection without -debug
+	debug bool
+}
+
+func (l connectionLogger) Printf(format string, a ...interface{}) {
+	fmt.Printf("[%d %s] "+format, append([]interface{}{l.connectionId, l.requestId}, a...)...)
+}
+
+// Debugf is Printf, but only logs with -debug or for a connection that asked for it
+func (l connectionLogger) Debugf(format string, a ...interface{}) {
+	if *debugLog || l.debug {
+		l.Printf(format, a...)
+	}
+}
+
+// requestedDebug tells whether the request enables debug logging for its connection, when -debug-header allows so
+func requestedDebug(r *http.Request) bool {
+	debug, _ := strconv.ParseBool(r.Header.Get("X-Debug"))
+	return *debugHeader && debug
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	mediaSourceKind = flag.String("source", "ffmpeg", "where the video comes from: ffmpeg, file:<path> for an H264 elementary stream or an IVF file, stdin for H264 piped in, or rtp for -rtp-listen")
+)
+
+// MediaSource produces the video stream of the connections, in the codec its connection negotiated
+type MediaSource interface {
+	// Open starts the stream for a connection, args are the ffmpeg arguments for its codec and bitrate.
+	// H264 is returned as an annex B elementary stream, VP8 and VP9 in an IVF container, or either in a container
+	// of -source-format that demuxSource reads.
+	Open(logger connectionLogger, args []string) (io.ReadCloser, error)
+	// Codecs returns the names of the codecs in -codecs that the source can produce
+	Codecs() []string
+}
+
+// mediaSource is the source of all connections, chosen by -source
+var mediaSource MediaSource = ffmpegMediaSource{}
+
+// usesFfmpeg reports whether -source runs ffmpeg, the ffmpeg arguments are not needed otherwise
+func usesFfmpeg() bool {
+	return *mediaSourceKind == "ffmpeg" && *rtpListen == 0
+}
+
+// newMediaSource returns the source selected by -source, -rtp-listen alone selects the RTP source as well
+func newMediaSource(kind string) (MediaSource, error) {
+	switch {
+	case kind == "rtp" || kind == "ffmpeg" && *rtpListen != 0:
+		if *rtpListen == 0 {
+			return nil, errors.New("the rtp source needs -rtp-listen")
+		}
+		return rtpMediaSource{}, nil
+	case kind == "ffmpeg":
+		return ffmpegMediaSource{}, nil
+	case kind == "stdin":
+		return &stdinMediaSource{}, nil
+	case strings.HasPrefix(kind, "file:"):
+		path := strings.TrimPrefix(kind, "file:")
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		return fileMediaSource{path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown source %q, use ffmpeg, file:<path>, stdin or rtp", kind)
+}
+
+// validateMediaSource checks that the source can produce every codec of -codecs
+func validateMediaSource(source MediaSource) error {
+	if _, ok := source.(ffmpegMediaSource); !ok && *playlistFile != "" {
+		return errors.New("-playlist can only be used with the ffmpeg source")
+	}
+	for _, codec := range preferredCodecs() {
+		supported := false
+		for _, sourceCodec := range source.Codecs() {
+			supported = supported || sourceCodec == codec
+		}
+		if !supported {
+			return fmt.Errorf("the source cannot produce %s, remove it from -codecs", codec)
+		}
+	}
+	return nil
+}
+
+// ffmpegMediaSource starts an ffmpeg for every connection, playing the playlist when the arguments contain {input}
+type ffmpegMediaSource struct{}
+
+func (ffmpegMediaSource) Open(logger connectionLogger, args []string) (io.ReadCloser, error) {
+	if len(playlistItems) > 0 && strings.Contains(strings.Join(args, " "), playlistInputPlaceholder) {
+		return RunPlaylist(logger, playlistItems, args...)
+	}
+	if pipe := warmPool.take(args); pipe != nil {
+		logger.Printf("Using a warm ffmpeg\n")
+		return pipe, nil
+	}
+	return StartFfmpeg(logger, args...)
+}
+
+func (ffmpegMediaSource) Codecs() []string {
+	return []string{"h264", "vp8", "vp9"}
+}
+
+// fileMediaSource sends a file to every connection from its start, paced at the frame rate.
+// Files ending in .ivf contain VP8 or VP9, other files H264, as an elementary stream or in a container of -source-format.
+type fileMediaSource struct {
+	path string
+}
+
+func (s fileMediaSource) Open(logger connectionLogger, args []string) (io.ReadCloser, error) {
+	logger.Printf("Sending %s\n", s.path)
+	return os.Open(s.path)
+}
+
+func (s fileMediaSource) Codecs() []string {
+	if strings.EqualFold(filepath.Ext(s.path), ".ivf") {
+		return []string{ivfFileCodec(s.path)}
+	}
+	return []string{"h264"}
+}
+
+// ivfFileCodec returns the codec of an IVF file from the fourcc in its header, VP8 when it cannot be read
+func ivfFileCodec(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return "vp8"
+	}
+	defer file.Close()
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return "vp8"
+	}
+	if string(header[8:12]) == "VP90" {
+		return "vp9"
+	}
+	return "vp8"
+}
+
+// rtpMediaSource sends the H264 received on -rtp-listen
+type rtpMediaSource struct{}
+
+func (rtpMediaSource) Open(logger connectionLogger, args []string) (io.ReadCloser, error) {
+	return ingest.subscribe(), nil
+}
+
+func (rtpMediaSource) Codecs() []string {
+	return []string{"h264"}
+}
+
+// stdinMediaSource reads an H264 elementary stream piped into the process, every connection joins it at the next keyframe.
+// It starts reading with the first connection and keeps reading after that, so the connections get it live.
+type stdinMediaSource struct {
+	start       sync.Once
+	broadcaster nalBroadcaster
+}
+
+func (s *stdinMediaSource) Open(logger connectionLogger, args []string) (io.ReadCloser, error) {
+	s.start.Do(func() {
+		go s.read(os.Stdin)
+	})
+	return s.broadcaster.subscribe(), nil
+}
+
+func (s *stdinMediaSource) Codecs() []string {
+	return []string{"h264"}
+}
+
+func (s *stdinMediaSource) read(stream io.Reader) {
+	defer s.broadcaster.end()
+	h264, err := h264reader.NewReader(stream)
+	if err != nil {
+		fmt.Printf("Cannot read H264 from stdin: %v\n", err)
+		return
+	}
+	for {
+		nal, err := h264.NextNAL()
+		if err == io.EOF {
+			fmt.Printf("All video frames read from stdin\n")
+			return
+		}
+		if err != nil {
+			fmt.Printf("Cannot read H264 from stdin: %v\n", err)
+			return
+		}
+		s.broadcaster.broadcast(append([]byte{0x00, 0x00, 0x00, 0x01}, nal.Data...))
+	}
+}
+
+// nalBufferSize is the number of NAL units a connection can fall behind a broadcast before it skips to the next keyframe
+const nalBufferSize = 512
+
+// nalBroadcaster hands the NAL units of a single stream to every connection, so it feeds all of them without a transcode
+type nalBroadcaster struct {
+	lock        sync.Mutex
+	subscribers map[*nalSubscriber]bool
+	// ended is set when the stream ended, later subscribers get an empty stream
+	ended bool
+}
+
+// broadcast hands annex B NAL units to every connection
+func (b *nalBroadcaster) broadcast(annexB []byte) {
+	// Every NAL unit is prefixed with a 4 byte start code, the first NAL unit tells whether a keyframe starts here
+	unitType := annexB[4] & 0x1f
+	keyframe := unitType == 7 || unitType == 5
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for subscriber := range b.subscribers {
+		subscriber.write(annexB, keyframe)
+	}
+}
+
+// resync makes every connection skip to the next keyframe, after a part of the stream was lost
+func (b *nalBroadcaster) resync() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for subscriber := range b.subscribers {
+		subscriber.waitForKeyframe = true
+	}
+}
+
+// end ends the streams of all connections
+func (b *nalBroadcaster) end() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ended = true
+	for subscriber := range b.subscribers {
+		delete(b.subscribers, subscriber)
+		close(subscriber.units)
+	}
+}
+
+// subscribe returns a stream of the NAL units for a connection, starting at the next keyframe
+func (b *nalBroadcaster) subscribe() io.ReadCloser {
+	subscriber := &nalSubscriber{broadcaster: b, units: make(chan []byte, nalBufferSize), waitForKeyframe: true}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.ended {
+		close(subscriber.units)
+		return subscriber
+	}
+	if b.subscribers == nil {
+		b.subscribers = map[*nalSubscriber]bool{}
+	}
+	b.subscribers[subscriber] = true
+	return subscriber
+}
+
+// nalSubscriber is the annex B stream of a single connection
+type nalSubscriber struct {
+	broadcaster *nalBroadcaster
+	units       chan []byte
+	// pending is what is left of the NAL unit being read
+	pending []byte
+	// waitForKeyframe is only accessed with the lock of the broadcaster held
+	waitForKeyframe bool
+	closeOnce       sync.Once
+}
+
+// write queues the NAL units, when the connection cannot keep up it skips to the next keyframe instead of blocking the others
+func (s *nalSubscriber) write(annexB []byte, keyframe bool) {
+	if s.waitForKeyframe && !keyframe {
+		return
+	}
+	select {
+	case s.units <- annexB:
+		s.waitForKeyframe = false
+	default:
+		s.waitForKeyframe = true
+	}
+}
+
+func (s *nalSubscriber) Read(b []byte) (int, error) {
+	if len(s.pending) == 0 {
+		units, ok := <-s.units
+		if !ok {
+			return 0, io.EOF
+		}
+		s.pending = units
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *nalSubscriber) Close() error {
+	s.closeOnce.Do(func() {
+		s.broadcaster.lock.Lock()
+		defer s.broadcaster.lock.Unlock()
+		if s.broadcaster.subscribers[s] {
+			delete(s.broadcaster.subscribers, s)
+			close(s.units)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+// testStream is an H264 elementary stream of 60 frames at 30 fps, with a keyframe every 30 frames
+const testStream = "testdata/stream.h264"
+
+func TestFileMediaSource(t *testing.T) {
+	source := fileMediaSource{path: testStream}
+	if codecs := source.Codecs(); len(codecs) != 1 || codecs[0] != "h264" {
+		t.Fatalf("Codecs() = %v, want [h264]", codecs)
+	}
+	stream, err := source.Open(connectionLogger{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	reader, err := h264reader.NewReader(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	units := []h264reader.NalUnitType{}
+	for {
+		nal, err := reader.NextNAL()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nal.UnitType == h264reader.NalUnitTypeSPS {
+			if info, err := parseSps(nal.Data); err != nil || info.width != 1920 || info.height != 1080 {
+				t.Errorf("the SPS is %v, %v, want 1920x1080", info, err)
+			}
+		}
+		units = append(units, nal.UnitType)
+	}
+
+	want := []h264reader.NalUnitType{}
+	for i := 0; i < 60; i++ {
+		if i%30 == 0 {
+			want = append(want, h264reader.NalUnitTypeSPS, h264reader.NalUnitTypePPS, h264reader.NalUnitTypeCodedSliceIdr)
+		} else {
+			want = append(want, h264reader.NalUnitTypeCodedSliceNonIdr)
+		}
+	}
+	if len(units) != len(want) {
+		t.Fatalf("read %d NAL units, want %d", len(units), len(want))
+	}
+	for i := range units {
+		if units[i] != want[i] {
+			t.Fatalf("NAL unit %d is a %v, want a %v", i, units[i], want[i])
+		}
+	}
+}
+
+func TestFileMediaSourceIvfCodec(t *testing.T) {
+	for fourcc, want := range map[string]string{"VP80": "vp8", "VP90": "vp9"} {
+		path := filepath.Join(t.TempDir(), "stream.ivf")
+		header := append([]byte("DKIF\x00\x00\x20\x00"), fourcc...)
+		if err := os.WriteFile(path, append(header, make([]byte, 20)...), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if codecs := (fileMediaSource{path: path}).Codecs(); len(codecs) != 1 || codecs[0] != want {
+			t.Errorf("Codecs() of a %s file = %v, want [%s]", fourcc, codecs, want)
+		}
+	}
+}
+
+func TestNewMediaSourceMissingFile(t *testing.T) {
+	if _, err := newMediaSource("file:" + filepath.Join(t.TempDir(), "missing.h264")); err == nil {
+		t.Error("a missing file was accepted as the source")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// allowedMethods returns the methods the routes of router accept for the path of r
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	methods := []string{}
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		routeMethods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range routeMethods {
+			request := r.Clone(r.Context())
+			request.Method = method
+			if route.Match(request, &mux.RouteMatch{}) {
+				methods = append(methods, method)
+			}
+		}
+		return nil
+	})
+	return append(methods, http.MethodOptions)
+}
+
+// methodNotAllowed answers requests whose path is routed, but not for their method, with the Allow header
+// listing the methods that are. OPTIONS requests, like a CORS preflight, get the Allow header without an error.
+func methodNotAllowed(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(router, r), ", "))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	nackBuffer = flag.Uint("nack-buffer", 8192, "number of sent video packets kept per connection to retransmit when the client reports them lost with a NACK, a power of two. 0 disables retransmissions")
+)
+
+func validateNackBuffer(size uint) error {
+	if size == 0 {
+		return nil
+	}
+	if size > 1<<15 || size&(size-1) != 0 {
+		return fmt.Errorf("%d is not a power of two up to 32768", size)
+	}
+	return nil
+}
+
+// registerInterceptors sets up the RTCP reports and, unless disabled, negotiates NACK and retransmits the packets the client reports lost
+func registerInterceptors(logger connectionLogger, m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	receiver, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return err
+	}
+	i.Add(receiver)
+	if *senderReportInterval > 0 {
+		i.Add(newSenderReports(logger, *senderReportInterval))
+	}
+	if *nackBuffer == 0 {
+		return nil
+	}
+
+	responder, err := nack.NewResponderInterceptor(nack.ResponderSize(uint16(*nackBuffer)))
+	if err != nil {
+		return err
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	i.Add(responder)
+	i.Add(&nackCounter{logger: logger})
+	return nil
+}
+
+// nackCounter counts the retransmissions requested by the client and logs them when the connection closes
+type nackCounter struct {
+	interceptor.NoOp
+	logger    connectionLogger
+	nacks     uint64
+	requested uint64
+}
+
+func (n *nackCounter) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		i, attr, err := reader.Read(b, a)
+		if err != nil {
+			return 0, nil, err
+		}
+		packets, err := rtcp.Unmarshal(b[:i])
+		if err != nil {
+			return i, attr, nil
+		}
+		for _, packet := range packets {
+			if transportNack, ok := packet.(*rtcp.TransportLayerNack); ok {
+				atomic.AddUint64(&n.nacks, 1)
+				for _, pair := range transportNack.Nacks {
+					atomic.AddUint64(&n.requested, uint64(len(pair.PacketList())))
+				}
+			}
+		}
+		return i, attr, nil
+	})
+}
+
+func (n *nackCounter) Close() error {
+	if nacks := atomic.LoadUint64(&n.nacks); nacks > 0 {
+		n.logger.Printf("Received %d NACKs requesting %d retransmissions\n", nacks, atomic.LoadUint64(&n.requested))
+	}
+	return nil
+}
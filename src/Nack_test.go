@@ -0,0 +1,214 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// lossyInterceptor drops every nth RTP packet a sender writes, the first time it is written. It drops them before
+// they are encrypted, as the SRTP replay protection of the receiver would reject a retransmission of a packet it read.
+// The RTCP of the receiver is only read once released is closed: the NACK responder of pion/interceptor v0.0.15
+// reads its send buffer for a NACK without a lock, so NACKs are only read after the last packet was written.
+type lossyInterceptor struct {
+	interceptor.NoOp
+	n        int
+	released chan struct{}
+
+	lock    sync.Mutex
+	written int
+	dropped map[uint16]bool
+	// last is the sequence number written last, the receiver cannot tell it was lost as no packet follows it
+	last uint16
+}
+
+func (l *lossyInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		l.lock.Lock()
+		l.written++
+		drop := l.written%l.n == 0 && !l.dropped[header.SequenceNumber]
+		if !l.dropped[header.SequenceNumber] {
+			l.last = header.SequenceNumber
+		}
+		if drop {
+			l.dropped[header.SequenceNumber] = true
+		}
+		l.lock.Unlock()
+		if drop {
+			return header.MarshalSize() + len(payload), nil
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+func (l *lossyInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		<-l.released
+		return reader.Read(b, attributes)
+	})
+}
+
+// TestNackRetransmission streams between two PeerConnections in this process, every 10th packet is lost on the way
+// and the receiver sends NACKs for them, the interceptors of the sender have to retransmit each of them once it wrote them all
+func TestNackRetransmission(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams between two PeerConnections")
+	}
+	senderMedia := &webrtc.MediaEngine{}
+	if err := senderMedia.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	senderInterceptors := &interceptor.Registry{}
+	// The packets are lost after the interceptors of the connection kept them for retransmission
+	lossy := &lossyInterceptor{n: 10, released: make(chan struct{}), dropped: map[uint16]bool{}}
+	senderInterceptors.Add(lossy)
+	if err := registerInterceptors(connectionLogger{}, senderMedia, senderInterceptors); err != nil {
+		t.Fatal(err)
+	}
+	sender, err := webrtc.NewAPI(webrtc.WithMediaEngine(senderMedia), webrtc.WithInterceptorRegistry(senderInterceptors)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	receiverMedia := &webrtc.MediaEngine{}
+	if err := receiverMedia.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	receiverInterceptors := &interceptor.Registry{}
+	generator, err := nack.NewGeneratorInterceptor(nack.GeneratorInterval(20 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverInterceptors.Add(generator)
+	// The packets are only retransmitted after all were written, the replay protection must not reject them as too old
+	receiverSettings := webrtc.SettingEngine{}
+	receiverSettings.SetSRTPReplayProtectionWindow(1024)
+	receiver, err := webrtc.NewAPI(webrtc.WithMediaEngine(receiverMedia), webrtc.WithInterceptorRegistry(receiverInterceptors), webrtc.WithSettingEngine(receiverSettings)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, "video", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtpSender, err := sender.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The NACKs are read by the interceptors of the sender while the RTCP is read
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			if _, _, err := rtpSender.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+
+	var lock sync.Mutex
+	received := map[uint16]int{}
+	receiver.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			packet, _, err := remote.ReadRTP()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			received[packet.SequenceNumber]++
+			lock.Unlock()
+		}
+	})
+	connected := make(chan struct{})
+	var connectedOnce sync.Once
+	sender.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateConnected {
+			connectedOnce.Do(func() { close(connected) })
+		}
+	})
+
+	if err := signalPair(sender, receiver); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("not connected within 10s")
+	}
+
+	// Keyframes of 3 packets each, written faster than their duration
+	picture := annexB(append([]byte{0x65, 0x88}, make([]byte, 3000)...))
+	for i := range picture[6:] {
+		picture[6+i] = byte(i%250) + 1
+	}
+	for i := 0; i < 60; i++ {
+		if err := track.WriteSample(media.Sample{Data: picture, Duration: time.Second / 30}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The lost packets are retransmitted once the NACKs the receiver kept sending are read
+	close(lossy.released)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		missing := []uint16{}
+		lossy.lock.Lock()
+		lock.Lock()
+		for sequence := range lossy.dropped {
+			if received[sequence] == 0 && sequence != lossy.last {
+				missing = append(missing, sequence)
+			}
+		}
+		dropped := len(lossy.dropped)
+		lock.Unlock()
+		lossy.lock.Unlock()
+		if dropped == 0 {
+			t.Fatal("no packets were dropped")
+		}
+		if len(missing) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of the %d packets lost were not retransmitted: %v", len(missing), dropped, missing)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// signalPair does the offer/answer exchange between two PeerConnections in this process, with all candidates
+func signalPair(offerer, answerer *webrtc.PeerConnection) error {
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(offerer)
+	if err = offerer.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gatherComplete
+	if err = answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		return err
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	gatherComplete = webrtc.GatheringCompletePromise(answerer)
+	if err = answerer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	<-gatherComplete
+	return offerer.SetRemoteDescription(*answerer.LocalDescription())
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	offerFile  = flag.String("offer-file", "", "read a single offer from this file, - for stdin, and write the answer to -answer-file instead of running the HTTP server")
+	answerFile = flag.String("answer-file", "-", "file the answer to -offer-file is written to, - for stdout")
+)
+
+func validateOfflineSignaling() error {
+	if *offerFile == "-" && *mediaSourceKind == "stdin" {
+		return errors.New("cannot read the offer from stdin when the video is read from stdin")
+	}
+	return nil
+}
+
+// decodeOffer returns the SDP of an offer, given as SDP or as the base64 encoded JSON session description
+// the pion examples and their jsfiddles exchange. encoded tells whether the answer should be encoded too.
+func decodeOffer(data []byte) (offer string, encoded bool, err error) {
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "v=") {
+		return text + "\r\n", false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return "", false, errors.New("the offer is neither SDP nor base64")
+	}
+	description := webrtc.SessionDescription{}
+	if err := json.Unmarshal(decoded, &description); err != nil {
+		return "", false, fmt.Errorf("the base64 offer is not a session description: %v", err)
+	}
+	return description.SDP, true, nil
+}
+
+func encodeAnswer(answer string) (string, error) {
+	data, err := json.Marshal(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func readOfferFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func writeAnswerFile(path string, answer string) error {
+	if path == "-" {
+		_, err := fmt.Println(answer)
+		return err
+	}
+	return os.WriteFile(path, []byte(answer+"\n"), 0644)
+}
+
+// runOffline answers the offer of -offer-file for signaling through files or copy and paste instead of HTTP,
+// then sends until the connection closes or SIGINT or SIGTERM is received.
+func runOffline() int {
+	data, err := readOfferFile(*offerFile)
+	if err != nil {
+		fmt.Printf("Cannot read the offer: %v\n", err)
+		return 1
+	}
+	offer, encoded, err := decodeOffer(data)
+	if err != nil {
+		fmt.Printf("Cannot read the offer: %v\n", err)
+		return 1
+	}
+
+	answer, connectionId, err := setupConnection(signalingRequest{offer: offer, requestId: uuid.New().String(), remoteAddr: "offline", clientIp: "offline", receivedAt: time.Now(), audioArgs: defaultAudioArgs()})
+	if err != nil {
+		fmt.Printf("Cannot answer the offer: %v\n", err)
+		return 1
+	}
+	if encoded {
+		if answer, err = encodeAnswer(answer); err != nil {
+			fmt.Printf("Cannot encode the answer: %v\n", err)
+			return 1
+		}
+	}
+	if err := writeAnswerFile(*answerFile, answer); err != nil {
+		fmt.Printf("Cannot write the answer: %v\n", err)
+		return 1
+	}
+	if *answerFile != "-" {
+		fmt.Printf("Answer written to %s\n", *answerFile)
+	}
+
+	s := sessions.Get(connectionId)
+	if s == nil {
+		// The connection was closed already
+		return 0
+	}
+	go switchSourceOnHangup()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case <-s.closed:
+		fmt.Printf("Connection closed\n")
+	case sig := <-signals:
+		fmt.Printf("Received %v, closing the connection\n", sig)
+		if err := s.peerConnection.Close(); err != nil {
+			s.logger.Printf("cannot close peerConnection: %v\n", err)
+		}
+	}
+	warmPool.close()
+	return 0
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	sharedPacing = flag.Bool("shared-pacer", false, "pace the send loops of all connections with a single ticker that fans its ticks out to them, instead of a ticker per connection. With many connections fewer timers reduce the scheduling jitter")
+)
+
+// frameTicker wakes a send loop up every frame, like a time.Ticker it drops ticks when the loop falls behind
+type frameTicker interface {
+	ticks() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// newFrameTicker returns the ticker of a send loop, a subscription to the shared pacer with -shared-pacer
+func newFrameTicker(d time.Duration) frameTicker {
+	if *sharedPacing {
+		return pacer.subscribe(d)
+	}
+	return ownTicker{time.NewTicker(d)}
+}
+
+// ownTicker is a ticker used by a single send loop
+type ownTicker struct {
+	*time.Ticker
+}
+
+func (t ownTicker) ticks() <-chan time.Time {
+	return t.C
+}
+
+// sharedPacer ticks once for all send loops with the same frame duration, which usually is all of them.
+// A send loop changing its frame duration moves over to the ticker of the new duration.
+type sharedPacer struct {
+	lock   sync.Mutex
+	groups map[time.Duration]*pacerGroup
+}
+
+// pacerGroup are the subscriptions sharing the ticker of one frame duration
+type pacerGroup struct {
+	subscriptions map[*pacerSubscription]bool
+	// stop is closed when the last subscription left, which stops the ticker
+	stop chan struct{}
+}
+
+var pacer = &sharedPacer{groups: map[time.Duration]*pacerGroup{}}
+
+// pacerSubscription is the frameTicker of a send loop using the shared pacer
+type pacerSubscription struct {
+	pacer *sharedPacer
+	c     chan time.Time
+	// duration and stopped are guarded by the lock of the pacer
+	duration time.Duration
+	stopped  bool
+}
+
+func (p *sharedPacer) subscribe(d time.Duration) *pacerSubscription {
+	s := &pacerSubscription{pacer: p, c: make(chan time.Time, 1)}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.add(s, d)
+	return s
+}
+
+// add starts the ticker of the duration for its first subscription, the lock must be held
+func (p *sharedPacer) add(s *pacerSubscription, d time.Duration) {
+	s.duration = d
+	group := p.groups[d]
+	if group == nil {
+		group = &pacerGroup{subscriptions: map[*pacerSubscription]bool{}, stop: make(chan struct{})}
+		p.groups[d] = group
+		go p.run(d, group)
+	}
+	group.subscriptions[s] = true
+}
+
+// remove stops the ticker of the duration after its last subscription, the lock must be held
+func (p *sharedPacer) remove(s *pacerSubscription) {
+	group := p.groups[s.duration]
+	delete(group.subscriptions, s)
+	if len(group.subscriptions) == 0 {
+		delete(p.groups, s.duration)
+		close(group.stop)
+	}
+}
+
+// run hands every tick to the subscriptions of the group, without waiting for the ones that did not take the previous tick yet
+func (p *sharedPacer) run(d time.Duration, group *pacerGroup) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.lock.Lock()
+			for s := range group.subscriptions {
+				select {
+				case s.c <- now:
+				default:
+				}
+			}
+			p.lock.Unlock()
+		case <-group.stop:
+			return
+		}
+	}
+}
+
+func (s *pacerSubscription) ticks() <-chan time.Time {
+	return s.c
+}
+
+// Reset moves the subscription to the ticker of the duration. Like time.Ticker.Reset it forgets the queued tick,
+// but the ticks keep the phase of the shared ticker.
+func (s *pacerSubscription) Reset(d time.Duration) {
+	s.pacer.lock.Lock()
+	defer s.pacer.lock.Unlock()
+	if s.stopped {
+		return
+	}
+	if d != s.duration {
+		s.pacer.remove(s)
+		s.pacer.add(s, d)
+	}
+	select {
+	case <-s.c:
+	default:
+	}
+}
+
+func (s *pacerSubscription) Stop() {
+	s.pacer.lock.Lock()
+	defer s.pacer.lock.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	s.pacer.remove(s)
+}
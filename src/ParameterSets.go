@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	repeatParameterSets = flag.Bool("repeat-parameter-sets", true, "send the last SPS and PPS seen before every keyframe, for encoders that write them only at the start of the stream. false only sends the parameter sets the stream repeats itself")
+)
+
+// parameterSet is a SPS or PPS in annex B format, with its seq_parameter_set_id or pic_parameter_set_id
+type parameterSet struct {
+	id   uint
+	data []byte
+}
+
+// parameterSetCache holds the SPS and PPS to send with the next keyframe, the browser cannot decode a keyframe
+// without them. When persistent, it keeps the last one seen with every id and sends them before every keyframe,
+// otherwise only those read since the last keyframe are sent, once.
+type parameterSetCache struct {
+	persistent bool
+	sps        []parameterSet
+	pps        []parameterSet
+	// announced are the parameter sets the client already got in the answer, which are not sent again
+	announced []byte
+}
+
+// add caches the annex B parameter set of type unitType, replacing the one with the same id
+func (c *parameterSetCache) add(unitType h264reader.NalUnitType, annexB []byte) {
+	sets := &c.pps
+	if unitType == h264reader.NalUnitTypeSPS {
+		sets = &c.sps
+	}
+	set := parameterSet{id: parameterSetId(unitType, annexB), data: annexB}
+	for i, cached := range *sets {
+		if cached.id == set.id {
+			(*sets)[i] = set
+			return
+		}
+	}
+	*sets = append(*sets, set)
+}
+
+// keyframe returns the parameter sets to prepend to a keyframe, the SPS before the PPS referring to them
+func (c *parameterSetCache) keyframe() []byte {
+	var buffer bytes.Buffer
+	for _, set := range c.sps {
+		buffer.Write(set.data)
+	}
+	for _, set := range c.pps {
+		buffer.Write(set.data)
+	}
+	if !c.persistent {
+		c.reset()
+	}
+	if c.announced != nil && bytes.Equal(buffer.Bytes(), c.announced) {
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+// droppedKeyframe forgets the parameter sets that were only for the dropped keyframe
+func (c *parameterSetCache) droppedKeyframe() {
+	if !c.persistent {
+		c.reset()
+	}
+}
+
+// reset forgets all parameter sets, like when switching to a source with sets of its own
+func (c *parameterSetCache) reset() {
+	c.sps = nil
+	c.pps = nil
+}
+
+// parameterSetId returns the id of the parameter set, following its 4 byte start code and NAL header. It is the first
+// field after the profile and level of a SPS and the first field of a PPS. A set too short to hold one gets id 0.
+func parameterSetId(unitType h264reader.NalUnitType, annexB []byte) uint {
+	if len(annexB) < 6 {
+		return 0
+	}
+	rbsp := unescapeRbsp(annexB[5:])
+	if unitType == h264reader.NalUnitTypeSPS {
+		if len(rbsp) < 3 {
+			return 0
+		}
+		rbsp = rbsp[3:]
+	}
+	r := &bitReader{data: rbsp}
+	id, err := r.ue()
+	if err != nil {
+		return 0
+	}
+	return id
+}
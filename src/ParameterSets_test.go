@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	testSpsAnnexB = append([]byte{0, 0, 0, 1}, craftSps(testSps{widthInMbs: 40, heightInMbs: 30})...)
+	testPpsAnnexB = []byte{0, 0, 0, 1, 0x68, 0xeb, 0xec, 0xb2, 0x2c}
+)
+
+// testPps returns an annex B PPS with the pic_parameter_set_id
+func testPps(id uint) []byte {
+	w := &bitWriter{}
+	w.ue(id)
+	// seq_parameter_set_id
+	w.ue(0)
+	return append([]byte{0, 0, 0, 1, 0x68}, w.rbsp()...)
+}
+
+func TestParameterSetCacheKeyframes(t *testing.T) {
+	parameterSets := append(append([]byte{}, testSpsAnnexB...), testPpsAnnexB...)
+	tests := []struct {
+		name       string
+		persistent bool
+		// want is what every keyframe after the parameter sets gets
+		want [][]byte
+	}{
+		{"-repeat-parameter-sets", true, [][]byte{parameterSets, parameterSets, parameterSets}},
+		{"-repeat-parameter-sets=false", false, [][]byte{parameterSets, nil, nil}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The parameter sets are only at the start of the stream
+			cache := &parameterSetCache{persistent: test.persistent}
+			cache.add(h264reader.NalUnitTypeSPS, testSpsAnnexB)
+			cache.add(h264reader.NalUnitTypePPS, testPpsAnnexB)
+			for i, want := range test.want {
+				if got := cache.keyframe(); !bytes.Equal(got, want) {
+					t.Errorf("keyframe %d got %x, want %x", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParameterSetCacheReplacesById(t *testing.T) {
+	cache := &parameterSetCache{persistent: true}
+	cache.add(h264reader.NalUnitTypeSPS, testSpsAnnexB)
+	cache.add(h264reader.NalUnitTypePPS, testPps(0))
+	cache.add(h264reader.NalUnitTypePPS, testPps(1))
+	// The PPS is sent again with the same id and other contents
+	replaced := append(testPps(1), 0x80)
+	cache.add(h264reader.NalUnitTypePPS, replaced)
+
+	want := append(append(append([]byte{}, testSpsAnnexB...), testPps(0)...), replaced...)
+	if got := cache.keyframe(); !bytes.Equal(got, want) {
+		t.Errorf("keyframe got %x, want %x", got, want)
+	}
+}
+
+func TestParameterSetCacheAnnounced(t *testing.T) {
+	parameterSets := append(append([]byte{}, testSpsAnnexB...), testPpsAnnexB...)
+	cache := &parameterSetCache{persistent: true, announced: parameterSets}
+	cache.add(h264reader.NalUnitTypeSPS, testSpsAnnexB)
+	cache.add(h264reader.NalUnitTypePPS, testPpsAnnexB)
+	if got := cache.keyframe(); got != nil {
+		t.Errorf("keyframe got the parameter sets of the answer again: %x", got)
+	}
+	// A new SPS is not in the answer
+	sps := append([]byte{0, 0, 0, 1}, craftSps(testSps{widthInMbs: 80, heightInMbs: 45})...)
+	cache.add(h264reader.NalUnitTypeSPS, sps)
+	if got, want := cache.keyframe(), append(append([]byte{}, sps...), testPpsAnnexB...); !bytes.Equal(got, want) {
+		t.Errorf("keyframe got %x, want %x", got, want)
+	}
+}
+
+func TestParameterSetCacheDroppedKeyframe(t *testing.T) {
+	for _, persistent := range []bool{true, false} {
+		cache := &parameterSetCache{persistent: persistent}
+		cache.add(h264reader.NalUnitTypeSPS, testSpsAnnexB)
+		cache.add(h264reader.NalUnitTypePPS, testPpsAnnexB)
+		cache.droppedKeyframe()
+		// Only the persistent cache still has them for the next keyframe
+		if got := cache.keyframe(); (len(got) > 0) != persistent {
+			t.Errorf("persistent %v: keyframe after a dropped one got %x", persistent, got)
+		}
+	}
+}
+
+func TestParameterSetId(t *testing.T) {
+	for id := uint(0); id < 40; id += 7 {
+		if got := parameterSetId(h264reader.NalUnitTypePPS, testPps(id)); got != id {
+			t.Errorf("parameterSetId of a PPS with id %d = %d", id, got)
+		}
+	}
+	if got := parameterSetId(h264reader.NalUnitTypeSPS, testSpsAnnexB); got != 0 {
+		t.Errorf("parameterSetId of a SPS with id 0 = %d", got)
+	}
+	if got := parameterSetId(h264reader.NalUnitTypeSPS, []byte{0, 0, 0, 1, 0x67}); got != 0 {
+		t.Errorf("parameterSetId of a truncated SPS = %d", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	mdnsMode = flag.String("mdns", "query", "mDNS mode for ICE: disabled, query (accept remote .local candidates) or gather (also gather .local candidates)")
+	dtlsCert = flag.String("dtls-cert", "", "PEM file with the DTLS certificate, for a stable fingerprint across connections and restarts")
+	dtlsKey  = flag.String("dtls-key", "", "PEM file with the private key of -dtls-cert")
+)
+
+// dtlsCertificates are used by every PeerConnection, empty to let pion generate one per connection
+var dtlsCertificates []webrtc.Certificate
+
+// loadDTLSCertificate loads the certificate configured using -dtls-cert and -dtls-key
+func loadDTLSCertificate(certFile, keyFile string) (webrtc.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return webrtc.Certificate{}, errors.New("both -dtls-cert and -dtls-key are required")
+	}
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	return webrtc.CertificateFromX509(keyPair.PrivateKey, certificate), nil
+}
+
+// connectionClosing reports whether Close was called on peerConnection. Close stops the tracks before the
+// connection state changes to closed, so writing a sample can fail in between, that is no error of its own.
+func connectionClosing(peerConnection *webrtc.PeerConnection) bool {
+	return peerConnection.SignalingState() == webrtc.SignalingStateClosed
+}
+
+// parseMulticastDNSMode maps the -mdns flag to the ICE multicast DNS mode
+func parseMulticastDNSMode(mode string) (ice.MulticastDNSMode, error) {
+	switch mode {
+	case "disabled":
+		return ice.MulticastDNSModeDisabled, nil
+	case "query":
+		return ice.MulticastDNSModeQueryOnly, nil
+	case "gather":
+		return ice.MulticastDNSModeQueryAndGather, nil
+	}
+	return 0, fmt.Errorf("unknown mDNS mode %q, expected disabled, query or gather", mode)
+}
+
+// NewPeerConnection creates a PeerConnection with our codecs and interceptors,
+// configured using our command line flags. The congestion controller, when not nil, is one of the interceptors.
+// A new API is created every time, as interceptors cannot be shared between PeerConnections.
+func NewPeerConnection(logger connectionLogger, configuration webrtc.Configuration, congestion congestionController) (*webrtc.PeerConnection, error) {
+	m := &webrtc.MediaEngine{}
+	if err := registerCodecs(m); err != nil {
+		return nil, err
+	}
+
+	i := &interceptor.Registry{}
+	if err := registerInterceptors(logger, m, i); err != nil {
+		return nil, err
+	}
+	if err := registerPlayoutDelay(m, i); err != nil {
+		return nil, err
+	}
+	if congestion != nil {
+		if err := congestion.register(m); err != nil {
+			return nil, err
+		}
+		i.Add(congestion)
+	}
+
+	s := webrtc.SettingEngine{}
+	multicastDNSMode, err := parseMulticastDNSMode(*mdnsMode)
+	if err != nil {
+		return nil, err
+	}
+	s.SetICEMulticastDNSMode(multicastDNSMode)
+	s.SetRelayAcceptanceMinWait(*relayAcceptanceWait)
+	if iceInterfaceFilter != nil {
+		s.SetInterfaceFilter(iceInterfaceFilter)
+	}
+	if iceUDPMux != nil {
+		s.SetICEUDPMux(iceUDPMux)
+	}
+	if iceTCPMux != nil {
+		s.SetICETCPMux(iceTCPMux)
+		s.SetNetworkTypes(iceNetworkTypes())
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
+	return api.NewPeerConnection(configuration)
+}
+
+// senderTransceiver returns the transceiver the sender belongs to
+func senderTransceiver(peerConnection *webrtc.PeerConnection, sender *webrtc.RTPSender) *webrtc.RTPTransceiver {
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Sender() == sender {
+			return transceiver
+		}
+	}
+	return nil
+}
+
+// inactivateUnusedTransceivers stops the transceivers Pion created for media sections of the offer we have no track for,
+// like the audio a browser offers by default. Otherwise Pion answers them recvonly, or sendonly without a track,
+// while we never receive or send anything on them. Stopped they are answered with a=inactive.
+func inactivateUnusedTransceivers(logger connectionLogger, peerConnection *webrtc.PeerConnection) {
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if sender := transceiver.Sender(); sender != nil && sender.Track() != nil {
+			continue
+		}
+		if transceiver.Direction() == webrtc.RTPTransceiverDirectionInactive {
+			continue
+		}
+		logger.Printf("Answering the %s media section %s as inactive, there is no track for it\n", transceiver.Kind(), transceiver.Mid())
+		if err := transceiver.Stop(); err != nil {
+			logger.Printf("cannot stop transceiver: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const playlistInputPlaceholder = "{input}"
+
+// ReadPlaylist reads the inputs listed in a playlist file, one per line.
+// Empty lines and lines starting with # are ignored.
+func ReadPlaylist(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	items := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items = append(items, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.New("playlist " + path + " contains no inputs")
+	}
+	return items, nil
+}
+
+// RunPlaylist starts ffmpeg for each playlist item in turn, substituting the
+// item for every {input} in arg. The returned reader yields the output of all
+// items back-to-back, starting the next ffmpeg when the previous one reaches EOF.
+func RunPlaylist(logger connectionLogger, items []string, arg ...string) (io.ReadCloser, error) {
+	p := &playlistReader{
+		logger: logger,
+		items:  items,
+		arg:    arg,
+	}
+	if err := p.startNext(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type playlistReader struct {
+	logger connectionLogger
+	items  []string
+	arg    []string
+	// lock guards next, current and closed, Close is called from other goroutines while Read is blocked
+	lock    sync.Mutex
+	next    int
+	current io.ReadCloser
+	// closed is set by Close, no other ffmpeg is started after it
+	closed bool
+}
+
+// startNext starts ffmpeg for the next item, with the lock held
+func (p *playlistReader) startNext() error {
+	item := p.items[p.next]
+	p.next++
+
+	arg := make([]string, len(p.arg))
+	for i, a := range p.arg {
+		arg[i] = strings.ReplaceAll(a, playlistInputPlaceholder, item)
+	}
+
+	p.logger.Printf("Playing playlist item %d/%d: %s\n", p.next, len(p.items), item)
+	dataPipe, err := StartFfmpeg(p.logger, arg...)
+	if err != nil {
+		return err
+	}
+	p.current = dataPipe
+	return nil
+}
+
+func (p *playlistReader) Read(b []byte) (int, error) {
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return 0, io.EOF
+		}
+		if p.current == nil {
+			if p.next >= len(p.items) {
+				p.lock.Unlock()
+				return 0, io.EOF
+			}
+			if err := p.startNext(); err != nil {
+				p.lock.Unlock()
+				return 0, err
+			}
+		}
+		current := p.current
+		p.lock.Unlock()
+
+		n, err := current.Read(b)
+		if err == io.EOF {
+			p.lock.Lock()
+			// Close may have closed it already
+			if p.current == current {
+				if cErr := current.Close(); cErr != nil {
+					p.logger.Printf("cannot close dataPipe: %v\n", cErr)
+				}
+				p.current = nil
+			}
+			p.lock.Unlock()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (p *playlistReader) Close() error {
+	p.lock.Lock()
+	current := p.current
+	p.current = nil
+	p.closed = true
+	p.lock.Unlock()
+	if current == nil {
+		return nil
+	}
+	return current.Close()
+}
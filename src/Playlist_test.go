@@ -0,0 +1,44 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPlaylistCloseWhileReading(t *testing.T) {
+	fakeFfmpeg(t)
+	stream, err := RunPlaylist(connectionLogger{}, []string{"first.mp4", "second.mp4"}, "-i", playlistInputPlaceholder, "pipe:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			if _, err := stream.Read(buffer); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := stream.Close(); err != nil {
+		t.Logf("Close: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read did not return after Close")
+	}
+
+	if _, err := stream.Read(make([]byte, 1500)); err != io.EOF {
+		t.Errorf("Read after Close returned %v, want EOF", err)
+	}
+	if next := stream.(*playlistReader).next; next != 1 {
+		t.Errorf("started %d items, a closed playlist must not start the next one", next)
+	}
+}
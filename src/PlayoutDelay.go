@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const playoutDelayURI = "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"
+
+// playoutDelayMax is the largest delay the 12 bit fields of the extension can express, in steps of 10ms
+const playoutDelayMax = 4095 * 10 * time.Millisecond
+
+var (
+	playoutDelay = flag.String("playout-delay", "", "hint the receiver to buffer between <min>,<max> before playing, like 0ms,100ms for low latency. Not sent by default")
+)
+
+// parsePlayoutDelay parses the -playout-delay value, it returns false when it is not set
+func parsePlayoutDelay(value string) (time.Duration, time.Duration, bool, error) {
+	if value == "" {
+		return 0, 0, false, nil
+	}
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, false, fmt.Errorf("%q is not in the form <min>,<max>", value)
+	}
+	min, err := time.ParseDuration(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	max, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if min < 0 || max > playoutDelayMax || min > max {
+		return 0, 0, false, fmt.Errorf("the delays must be between 0 and %v, with min <= max", playoutDelayMax)
+	}
+	return min, max, true, nil
+}
+
+// registerPlayoutDelay negotiates the playout-delay header extension and adds it to every video packet
+func registerPlayoutDelay(m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	min, max, ok, err := parsePlayoutDelay(*playoutDelay)
+	if err != nil || !ok {
+		return err
+	}
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: playoutDelayURI}, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+	i.Add(&playoutDelayInterceptor{payload: playoutDelayPayload(min, max)})
+	return nil
+}
+
+// playoutDelayPayload encodes the extension: 12 bits minimum and 12 bits maximum delay, in steps of 10ms
+func playoutDelayPayload(min, max time.Duration) []byte {
+	minSteps := uint32(min / (10 * time.Millisecond))
+	maxSteps := uint32((max + 10*time.Millisecond - 1) / (10 * time.Millisecond))
+	value := minSteps<<12 | maxSteps
+	return []byte{byte(value >> 16), byte(value >> 8), byte(value)}
+}
+
+type playoutDelayInterceptor struct {
+	interceptor.NoOp
+	payload []byte
+}
+
+func (p *playoutDelayInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(info.MimeType, "video/") {
+		return writer
+	}
+	id := 0
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == playoutDelayURI {
+			id = extension.ID
+		}
+	}
+	if id == 0 {
+		// The client did not negotiate the extension
+		return writer
+	}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if err := header.SetExtension(uint8(id), p.payload); err != nil {
+			return 0, err
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	prebuffer     = flag.String("prebuffer", "0", "buffer this many frames, like 10, or this long, like 500ms, of the source before sending starts, so bursts and hiccups of a jittery source are absorbed at the cost of that much latency. 0 sends right away")
+	prebufferSize = flag.Int("prebuffer-size", 32<<20, "with -prebuffer, the most bytes of the source buffered per connection. The source is not read while the buffer is full")
+)
+
+func validatePrebuffer() error {
+	if _, err := prebufferDuration(); err != nil {
+		return err
+	}
+	if *prebufferSize <= 0 {
+		return errors.New("-prebuffer-size must be positive")
+	}
+	return nil
+}
+
+// prebufferDuration returns how long the source is buffered before sending, -prebuffer is a number of frames or a duration
+func prebufferDuration() (time.Duration, error) {
+	if frames, err := strconv.Atoi(*prebuffer); err == nil {
+		if frames < 0 {
+			return 0, errors.New("the number of frames cannot be negative")
+		}
+		return time.Duration(frames) * frameDuration(), nil
+	}
+	duration, err := time.ParseDuration(*prebuffer)
+	if err != nil || duration < 0 {
+		return 0, errors.New("use a number of frames like 10 or a duration like 500ms")
+	}
+	return duration, nil
+}
+
+// waitForPrebuffer gives the source the head start of -prebuffer after the connection was established,
+// while its output is buffered by the prebufferedPipe
+func waitForPrebuffer(logger connectionLogger, closed <-chan struct{}) {
+	duration, _ := prebufferDuration()
+	if duration <= 0 {
+		return
+	}
+	logger.Printf("Buffering %v of the source before sending\n", duration)
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-closed:
+	}
+}
+
+// withPrebuffer buffers the source when -prebuffer is set
+func withPrebuffer(logger connectionLogger, pipe io.ReadCloser) io.ReadCloser {
+	if duration, _ := prebufferDuration(); duration <= 0 {
+		return pipe
+	}
+	p := &prebufferedPipe{pipe: pipe, logger: logger}
+	p.changed = sync.NewCond(&p.lock)
+	go p.fill()
+	return p
+}
+
+// prebufferedPipe reads the source in the background into a buffer the send loop reads from, so the source is not held up
+// while the send loop waits for its head start or for the next frame. The cushion it built up absorbs the hiccups of the source.
+type prebufferedPipe struct {
+	pipe    io.ReadCloser
+	logger  connectionLogger
+	lock    sync.Mutex
+	changed *sync.Cond
+	data    []byte
+	// err is the error reading the source, returned once the buffered data was read
+	err    error
+	closed bool
+	// started is set once the send loop read data, underruns are the reads after that which found the buffer empty
+	started   bool
+	underruns int
+	// peak is the most bytes that were buffered
+	peak int
+}
+
+func (p *prebufferedPipe) fill() {
+	chunk := make([]byte, 32*1024)
+	for {
+		p.lock.Lock()
+		for len(p.data) >= *prebufferSize && !p.closed {
+			p.changed.Wait()
+		}
+		closed := p.closed
+		p.lock.Unlock()
+		if closed {
+			return
+		}
+
+		n, err := p.pipe.Read(chunk)
+		p.lock.Lock()
+		p.data = append(p.data, chunk[:n]...)
+		if len(p.data) > p.peak {
+			p.peak = len(p.data)
+		}
+		if err != nil {
+			p.err = err
+		}
+		p.changed.Broadcast()
+		p.lock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *prebufferedPipe) Read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.data) == 0 && p.err == nil && !p.closed && p.started {
+		p.underruns++
+	}
+	for len(p.data) == 0 && p.err == nil && !p.closed {
+		p.changed.Wait()
+	}
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p.data) == 0 {
+		return 0, p.err
+	}
+	n := copy(b, p.data)
+	p.data = p.data[n:]
+	p.started = true
+	p.changed.Broadcast()
+	return n, nil
+}
+
+// Close stops the source and logs how often the buffer ran empty, which shows whether the head start was long enough
+func (p *prebufferedPipe) Close() error {
+	p.lock.Lock()
+	wasClosed := p.closed
+	p.closed = true
+	p.changed.Broadcast()
+	underruns, peak := p.underruns, p.peak
+	p.lock.Unlock()
+	if !wasClosed {
+		p.logger.Printf("The source buffer ran empty %d times while sending, at most %d bytes were buffered\n", underruns, peak)
+	}
+	return p.pipe.Close()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"runtime"
+)
+
+var (
+	ffmpegNice   = flag.Int("ffmpeg-nice", 0, "nice value of the started ffmpeg processes, from -20 to 19, higher values leave more CPU to the server and other processes. 0 keeps the priority of the server")
+	ffmpegIdleIo = flag.Bool("ffmpeg-idle-io", false, "give the started ffmpeg processes the idle IO scheduling class, so they only read from disk when nothing else does. Linux only")
+)
+
+func validateFfmpegNice(nice int) error {
+	if nice < -20 || nice > 19 {
+		return errors.New("must be between -20 and 19")
+	}
+	return nil
+}
+
+func validateFfmpegIdleIo(idle bool) error {
+	if idle && runtime.GOOS != "linux" {
+		return errors.New("only supported on linux")
+	}
+	return nil
+}
+
+// applyProcessPriority lowers the priority of a started ffmpeg as configured, so a runaway encode cannot starve the server.
+// It is applied right after the start, the threads ffmpeg starts after that inherit it.
+func applyProcessPriority(pid int) {
+	if *ffmpegNice != 0 {
+		if err := setNice(pid, *ffmpegNice); err != nil {
+			fmt.Printf("Cannot set the nice value of ffmpeg to %d: %v\n", *ffmpegNice, err)
+		}
+	}
+	if *ffmpegIdleIo {
+		if err := setIdleIo(pid); err != nil {
+			fmt.Printf("Cannot set the IO scheduling class of ffmpeg: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// setIdleIo sets the IO scheduling class of a process to idle, like ionice -c 3
+func setIdleIo(pid int) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), ioprioClassIdle<<ioprioClassShift); errno != 0 {
+		return errno
+	}
+	return nil
+}
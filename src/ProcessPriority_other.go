@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func setIdleIo(pid int) error {
+	return errors.New("only supported on linux")
+}
@@ -0,0 +1,12 @@
+//go:build !windows && !js
+// +build !windows,!js
+
+package main
+
+import (
+	"syscall"
+)
+
+func setNice(pid int, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice)
+}
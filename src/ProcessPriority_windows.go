@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+)
+
+func setNice(pid int, nice int) error {
+	return errors.New("not supported on windows")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// videoClockRate is the RTP clock rate used for video (RFC 6184 for H264)
+	videoClockRate = 90000
+	// audioClockRate is the RTP clock rate used for Opus audio (RFC 7587), regardless of the actual sample rate
+	audioClockRate = 48000
+)
+
+var (
+	timestampClockRate = flag.Uint("video-clock-rate", videoClockRate, "RTP clock rate in Hz of the timestamps of the video, for receivers bridging to a system with another timebase. Browsers play video at any other rate than the standard 90000 at the wrong speed")
+)
+
+func validateTimestampClockRate() error {
+	if *timestampClockRate < 1000 || *timestampClockRate > 1000000 {
+		return errors.New("the clock rate must be from 1000 to 1000000 Hz")
+	}
+	if *timestampClockRate != videoClockRate {
+		fmt.Printf("Warning: -video-clock-rate %d is not the 90000 Hz of the video codecs in the SDP, browsers expect that one\n", *timestampClockRate)
+	}
+	return nil
+}
+
+// trackClockRate returns the clock rate of the codec negotiated for track, which WriteSample converts the sample durations with
+func trackClockRate(peerConnection *webrtc.PeerConnection, track webrtc.TrackLocal) uint32 {
+	for _, sender := range peerConnection.GetSenders() {
+		if sender.Track() != track {
+			continue
+		}
+		for _, codec := range sender.GetParameters().Codecs {
+			if codec.ClockRate != 0 {
+				return codec.ClockRate
+			}
+		}
+	}
+	return videoClockRate
+}
+
+// rtpClock maps the presentation time of frames to RTP timestamp increments.
+//
+// WriteSample advances the RTP timestamp by sample.Duration times the clock rate, truncated to
+// whole ticks. A frame duration that isn't a whole number of ticks (like 1/30s at 90kHz) would
+// make the timestamps drift from the presentation time, which breaks A/V sync once a second track
+// with its own clock is sent. rtpClock keeps the total number of ticks handed out equal to the
+// total presentation time, and returns durations that WriteSample converts to exactly that increment.
+//
+// Our elementary stream has no PTS, so the presentation time of a frame is the sum of the
+// durations of the frames before it, the same time base the send loop paces with.
+//
+// The timestamps can run at another rate than the one WriteSample converts with, the rate the track
+// was negotiated with, for -video-clock-rate. The durations are then scaled to make up for it.
+type rtpClock struct {
+	clockRate uint64
+	// writeRate is the clock rate WriteSample converts the durations with
+	writeRate uint64
+	// elapsed is the presentation time of the next frame
+	elapsed time.Duration
+	// ticks is elapsed converted to clock ticks
+	ticks uint64
+}
+
+func newRTPClock(clockRate uint32, writeRate uint32) *rtpClock {
+	return &rtpClock{clockRate: uint64(clockRate), writeRate: uint64(writeRate)}
+}
+
+// sampleDuration returns the sample duration to pass to WriteSample for a frame lasting frame
+func (c *rtpClock) sampleDuration(frame time.Duration) time.Duration {
+	c.elapsed += frame
+	seconds := uint64(c.elapsed / time.Second)
+	remainder := uint64(c.elapsed % time.Second)
+	ticks := seconds*c.clockRate + remainder*c.clockRate/uint64(time.Second)
+	increment := ticks - c.ticks
+	c.ticks = ticks
+	// Round up, so the truncating conversion back to ticks in WriteSample ends up at increment and not just below it
+	return time.Duration((increment*uint64(time.Second) + c.writeRate - 1) / c.writeRate)
+}
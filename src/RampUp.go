@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	rampUpDuration = flag.Duration("ramp-up-duration", 0, "start ffmpeg at a lower bitrate and raise it to the -b:v of the ffmpeg arguments over this time after the connection is established, so the first seconds don't overwhelm the link before congestion control knows it. Every step restarts ffmpeg, which costs a keyframe. 0 starts at the full bitrate")
+	rampUpStart    = flag.Float64("ramp-up-start", 0.25, "fraction of the bitrate -ramp-up-duration starts at, which then doubles every step until the full bitrate")
+)
+
+func validateRampUp() error {
+	if *rampUpDuration < 0 {
+		return errors.New("-ramp-up-duration cannot be negative")
+	}
+	if *rampUpStart <= 0 || *rampUpStart >= 1 {
+		return errors.New("-ramp-up-start must be above 0 and below 1")
+	}
+	return nil
+}
+
+// videoBitrate returns the -b:v of the ffmpeg arguments in kbps, 0 when they set none
+func videoBitrate(args []string) uint64 {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] != "-b:v" {
+			continue
+		}
+		if bitrate, ok := parseFfmpegBitrate(args[i+1]); ok {
+			return bitrate / 1000
+		}
+	}
+	return 0
+}
+
+// rampUpSteps returns the bitrates in kbps ffmpeg is started with while ramping up to target, from
+// -ramp-up-start of it doubling up to below target. It is empty when the ramp up is disabled.
+func rampUpSteps(target uint64) []uint64 {
+	if *rampUpDuration == 0 || target == 0 {
+		return nil
+	}
+	steps := []uint64{}
+	for fraction := *rampUpStart; fraction < 1; fraction *= 2 {
+		steps = append(steps, uint64(math.Max(1, math.Round(float64(target)*fraction))))
+	}
+	return steps
+}
+
+// rampUpArgs lowers the ffmpeg arguments to the bitrate the ramp up of the session is at
+func (s *session) rampUpArgs(args []string) []string {
+	if limit := atomic.LoadUint64(&s.rampUpLimit); limit > 0 {
+		return limitBitrate(args, limit)
+	}
+	return args
+}
+
+// rampUp raises the bitrate of the session through steps once it is connected, with equal time spent at each step
+// and the full bitrate at the end of -ramp-up-duration. ffmpeg is restarted make-before-break like when switching the
+// source, with the source the connection plays then. The first step is the bitrate the connection started with.
+func rampUp(s *session, steps []uint64, connected <-chan struct{}) {
+	select {
+	case <-connected:
+	case <-s.closed:
+		return
+	}
+	interval := *rampUpDuration / time.Duration(len(steps))
+	for i := 1; i <= len(steps); i++ {
+		select {
+		case <-time.After(interval):
+		case <-s.closed:
+			return
+		}
+		limit, description := uint64(0), "the full bitrate"
+		if i < len(steps) {
+			limit, description = steps[i], strconv.FormatUint(steps[i], 10)+" kbps"
+		}
+		atomic.StoreUint64(&s.rampUpLimit, limit)
+		s.logger.Printf("Ramping up the video bitrate to %s\n", description)
+		if err := s.switchSource(s.playingSource()); err != nil {
+			if err != errSourceClosed {
+				s.logger.Printf("Cannot ramp up the video bitrate: %v\n", err)
+			}
+			// Later restarts of the source are not held back by the ramp up that stopped
+			atomic.StoreUint64(&s.rampUpLimit, 0)
+			return
+		}
+	}
+}
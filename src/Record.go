@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	recordDir       = flag.String("record-dir", "", "directory to record the H264 sent to every connection in, as connection-<id>-<time>.h264")
+	recordStartCode = flag.Int("record-start-code", 4, "length of the start codes in recordings: 4 writes 00 00 00 01 before every NAL unit, 3 writes 00 00 01 except before parameter sets and the first NAL unit of an access unit, which need 4 bytes")
+)
+
+var (
+	longStartCode  = []byte{0x00, 0x00, 0x00, 0x01}
+	shortStartCode = []byte{0x00, 0x00, 0x01}
+)
+
+func validateRecordStartCode(length int) error {
+	if length != 3 && length != 4 {
+		return fmt.Errorf("%d is not a start code length, use 3 or 4", length)
+	}
+	return nil
+}
+
+func validateRecordDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// recording writes the NAL units sent to a connection to a raw Annex-B file, which ffmpeg can remux later.
+// A failed write is logged once and stops the recording, the stream itself continues.
+type recording struct {
+	logger connectionLogger
+	path   string
+	file   *os.File
+	err    error
+	// accessUnitStarted is set when NAL units of the access unit of the next picture were written already
+	accessUnitStarted bool
+}
+
+// startRecording creates the recording of a connection, or returns nil when -record-dir isn't set
+func startRecording(logger connectionLogger, connectionId int) *recording {
+	if *recordDir == "" {
+		return nil
+	}
+	path := filepath.Join(*recordDir, fmt.Sprintf("connection-%d-%s.h264", connectionId, time.Now().Format("20060102-150405")))
+	file, err := os.Create(path)
+	if err != nil {
+		logger.Printf("Cannot start recording: %v\n", err)
+		return nil
+	}
+	logger.Printf("Recording to %s\n", path)
+	r := &recording{logger: logger, path: path, file: file}
+	// The parameter sets announced in the answer are not sent in-band, the file needs them to be decodable
+	r.write(announcedParameterSets)
+	return r
+}
+
+// write appends data, which must consist of NAL units each starting with a 4 byte start code
+func (r *recording) write(data []byte) {
+	if r == nil || r.err != nil {
+		return
+	}
+	if *recordStartCode == 3 {
+		data = r.shortenStartCodes(data)
+	}
+	if _, r.err = r.file.Write(data); r.err != nil {
+		r.logger.Printf("Stopped recording to %s: %v\n", r.path, r.err)
+	}
+}
+
+// shortenStartCodes replaces the start codes of data by 3 byte ones, except where Annex B requires the zero_byte:
+// before parameter sets and before the first NAL unit of an access unit (ITU-T H.264 section B.1.2).
+func (r *recording) shortenStartCodes(data []byte) []byte {
+	shortened := make([]byte, 0, len(data))
+	for _, nal := range bytes.Split(data, longStartCode) {
+		if len(nal) == 0 {
+			continue
+		}
+		unitType := h264reader.NalUnitType(nal[0] & 0x1f)
+		first := false
+		if isSlice(unitType) {
+			// A picture starts the access unit, unless non-VCL NAL units like an SEI came before it
+			first = len(nal) > 1 && nal[1]&0x80 != 0 && !r.accessUnitStarted
+			r.accessUnitStarted = false
+		} else {
+			// Non-VCL NAL units after a picture start the access unit of the next one
+			first = !r.accessUnitStarted || unitType == h264reader.NalUnitTypeSPS || unitType == h264reader.NalUnitTypePPS
+			r.accessUnitStarted = true
+		}
+		if first {
+			shortened = append(shortened, longStartCode...)
+		} else {
+			shortened = append(shortened, shortStartCode...)
+		}
+		shortened = append(shortened, nal...)
+	}
+	return shortened
+}
+
+func (r *recording) close() {
+	if r == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		r.logger.Printf("cannot close recording: %v\n", err)
+	}
+}
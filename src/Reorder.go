@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+var (
+	reorderDepth = flag.Int("reorder-depth", 0, "hold up to this many H264 pictures to send pictures the source delivered out of order in the order of the frame_num in their slice headers, at the cost of as many frames of latency. 0 sends the pictures in the order they arrive")
+)
+
+func validateReorderDepth() error {
+	if *reorderDepth < 0 {
+		return errors.New("the depth cannot be negative")
+	}
+	return nil
+}
+
+// pictureReorderer puts the pictures of a stream back in decoding order when they arrive out of order.
+//
+// The frame_num of a slice header counts the reference pictures in decoding order, modulo 2^log2_max_frame_num of the SPS.
+// Non-reference pictures share it with the reference picture that follows them, those keep their order of arrival.
+// An IDR picture starts counting over at 0, the pictures before it are sent first.
+type pictureReorderer struct {
+	logger connectionLogger
+	depth  int
+	// sps is the parameter set the slice headers are parsed with, the reorderer passes pictures through until there is one
+	sps     spsInfo
+	haveSps bool
+	pending []reorderedPicture
+	// last is the frame_num of the picture sent last
+	last     uint
+	haveLast bool
+	// warned is set once a picture was sent before one that arrived earlier
+	warned bool
+}
+
+type reorderedPicture struct {
+	data     []byte
+	frameNum uint
+	// parsed is false when the frame_num could not be read, the picture is then sent as soon as possible
+	parsed bool
+	idr    bool
+}
+
+// setSps sets the parameter set of the pictures that follow
+func (r *pictureReorderer) setSps(sps spsInfo) {
+	r.sps = sps
+	r.haveSps = true
+}
+
+// add adds complete pictures and returns those that can be sent, in decoding order
+func (r *pictureReorderer) add(pictures [][]byte) [][]byte {
+	if r.depth <= 0 || !r.haveSps {
+		return pictures
+	}
+	ready := [][]byte{}
+	for _, data := range pictures {
+		picture := r.parse(data)
+		if picture.idr {
+			// The pictures before a keyframe cannot be sent after it
+			ready = append(ready, r.flush()...)
+		}
+		r.pending = append(r.pending, picture)
+		if len(r.pending) > r.depth {
+			ready = append(ready, r.next())
+		}
+	}
+	return ready
+}
+
+// flush returns the pictures being held, for the end of the stream
+func (r *pictureReorderer) flush() [][]byte {
+	ready := [][]byte{}
+	for len(r.pending) > 0 {
+		ready = append(ready, r.next())
+	}
+	return ready
+}
+
+// reset forgets the pictures being held, for a new stream
+func (r *pictureReorderer) reset() {
+	r.pending = nil
+	r.haveLast = false
+}
+
+// next removes the picture that comes first in decoding order from the held pictures.
+// That is the one whose frame_num is the closest after the last one sent, or before it when it arrived too late.
+func (r *pictureReorderer) next() []byte {
+	best := 0
+	if r.haveLast {
+		bestDistance := r.distance(r.pending[0])
+		for i, picture := range r.pending[1:] {
+			if distance := r.distance(picture); distance < bestDistance {
+				best, bestDistance = i+1, distance
+			}
+		}
+	}
+	picture := r.pending[best]
+	r.pending = append(r.pending[:best], r.pending[best+1:]...)
+	if best > 0 && !r.warned {
+		r.logger.Printf("The source delivers pictures out of order, reordering them by frame_num\n")
+		r.warned = true
+	}
+	if picture.parsed {
+		r.last = picture.frameNum
+		r.haveLast = true
+	}
+	return picture.data
+}
+
+// distance returns how far the frame_num of the picture is from the last one sent, negative when it is before it
+func (r *pictureReorderer) distance(picture reorderedPicture) int {
+	if !picture.parsed {
+		return -1 << 31
+	}
+	maxFrameNum := 1 << r.sps.log2MaxFrameNum
+	distance := (int(picture.frameNum) - int(r.last) + maxFrameNum) % maxFrameNum
+	if distance > maxFrameNum/2 {
+		distance -= maxFrameNum
+	}
+	return distance
+}
+
+// parse reads the frame_num of the first slice of the annex B picture
+func (r *pictureReorderer) parse(data []byte) reorderedPicture {
+	picture := reorderedPicture{data: data}
+	slice := firstSlice(data)
+	if slice == nil {
+		return picture
+	}
+	picture.idr = slice[0]&0x1f == 5
+	// The fields read are in the first bytes of the slice header
+	header := slice[1:]
+	if len(header) > 32 {
+		header = header[:32]
+	}
+	reader := &bitReader{data: unescapeRbsp(header)}
+	// first_mb_in_slice, slice_type, pic_parameter_set_id
+	for i := 0; i < 3; i++ {
+		if _, err := reader.ue(); err != nil {
+			return picture
+		}
+	}
+	if r.sps.separateColourPlane {
+		// colour_plane_id
+		if _, err := reader.bits(2); err != nil {
+			return picture
+		}
+	}
+	frameNum, err := reader.bits(int(r.sps.log2MaxFrameNum))
+	if err != nil {
+		return picture
+	}
+	picture.frameNum = frameNum
+	picture.parsed = true
+	return picture
+}
+
+// firstSlice returns the first coded slice NAL unit of the annex B data, without its start code
+func firstSlice(data []byte) []byte {
+	zeros := 0
+	for i, b := range data {
+		if zeros >= 2 && b == 1 && i+1 < len(data) {
+			if unitType := data[i+1] & 0x1f; unitType == 1 || unitType == 5 {
+				return data[i+1:]
+			}
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return nil
+}
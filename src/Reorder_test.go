@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// frameNumOf returns the frame_num of a picture crafted by craftSlice
+func frameNumOf(t *testing.T, reorderer *pictureReorderer, picture []byte) uint {
+	t.Helper()
+	parsed := reorderer.parse(picture)
+	if !parsed.parsed {
+		t.Fatalf("cannot parse the frame_num of %x", picture)
+	}
+	return parsed.frameNum
+}
+
+func TestPictureReordererShuffled(t *testing.T) {
+	// The pictures held must span less than half of the frame_num range
+	const log2MaxFrameNum = 5
+	for _, depth := range []int{1, 2, 3, 5} {
+		random := rand.New(rand.NewSource(int64(depth)))
+		// Enough pictures for frame_num to wrap around a few times
+		count := 150
+		pictures := [][]byte{craftSlice(true, 0, 0, log2MaxFrameNum)}
+		for i := 1; i < count; i++ {
+			pictures = append(pictures, craftSlice(false, 0, uint(i)%(1<<log2MaxFrameNum), log2MaxFrameNum))
+		}
+		// Shuffle the pictures after the keyframe in blocks, so none arrives more than depth pictures late
+		arrival := append([][]byte{}, pictures[0])
+		for start := 1; start < count; start += depth + 1 {
+			end := start + depth + 1
+			if end > count {
+				end = count
+			}
+			block := append([][]byte{}, pictures[start:end]...)
+			random.Shuffle(len(block), func(i, j int) { block[i], block[j] = block[j], block[i] })
+			arrival = append(arrival, block...)
+		}
+
+		reorderer := &pictureReorderer{depth: depth}
+		reorderer.setSps(spsInfo{log2MaxFrameNum: log2MaxFrameNum})
+		sent := [][]byte{}
+		for _, picture := range arrival {
+			sent = append(sent, reorderer.add([][]byte{picture})...)
+		}
+		sent = append(sent, reorderer.flush()...)
+
+		if len(sent) != count {
+			t.Fatalf("depth %d: sent %d pictures, want %d", depth, len(sent), count)
+		}
+		for i, picture := range sent {
+			if want := uint(i) % (1 << log2MaxFrameNum); frameNumOf(t, reorderer, picture) != want {
+				t.Fatalf("depth %d: picture %d has frame_num %d, want %d", depth, i, frameNumOf(t, reorderer, picture), want)
+			}
+		}
+	}
+}
+
+func TestPictureReordererKeyframeFlushes(t *testing.T) {
+	const log2MaxFrameNum = 4
+	reorderer := &pictureReorderer{depth: 3}
+	reorderer.setSps(spsInfo{log2MaxFrameNum: log2MaxFrameNum})
+	sent := reorderer.add([][]byte{
+		craftSlice(true, 0, 0, log2MaxFrameNum),
+		craftSlice(false, 0, 2, log2MaxFrameNum),
+		craftSlice(false, 0, 1, log2MaxFrameNum),
+	})
+	if len(sent) != 0 {
+		t.Fatalf("sent %d pictures before the depth was reached", len(sent))
+	}
+	// The pictures before a keyframe are sent, in order, when it arrives
+	sent = reorderer.add([][]byte{craftSlice(true, 0, 0, log2MaxFrameNum)})
+	want := []uint{0, 1, 2}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %d pictures, want %d", len(sent), len(want))
+	}
+	for i, picture := range sent {
+		if frameNum := frameNumOf(t, reorderer, picture); frameNum != want[i] {
+			t.Errorf("picture %d has frame_num %d, want %d", i, frameNum, want[i])
+		}
+	}
+	if flushed := reorderer.flush(); len(flushed) != 1 || !reorderer.parse(flushed[0]).idr {
+		t.Errorf("flush returned %d pictures, want the keyframe", len(flushed))
+	}
+}
+
+func TestPictureReordererPassesThrough(t *testing.T) {
+	pictures := [][]byte{craftSlice(false, 0, 3, 4), craftSlice(false, 0, 1, 4)}
+	// Without an SPS, and without a depth, the pictures are sent as they arrive
+	for _, reorderer := range []*pictureReorderer{{depth: 2}, {}} {
+		if reorderer.depth == 0 {
+			reorderer.setSps(spsInfo{log2MaxFrameNum: 4})
+		}
+		if sent := reorderer.add(pictures); len(sent) != len(pictures) {
+			t.Errorf("depth %d: sent %d pictures, want %d", reorderer.depth, len(sent), len(pictures))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+var (
+	rtpListen      = flag.Int("rtp-listen", 0, "receive H264 over RTP on this UDP port instead of starting ffmpeg, 0 to use ffmpeg")
+	rtpPayloadType = flag.Int("rtp-payload-type", 96, "payload type of the H264 packets received on -rtp-listen, other packets are ignored")
+)
+
+// rtpIngest depacketizes the H264 received on -rtp-listen and broadcasts the NAL units to every connection,
+// so a single RTP producer feeds all of them without a transcode.
+type rtpIngest struct {
+	nalBroadcaster
+}
+
+// ingest is the RTP input of the process, nil when ffmpeg is used
+var ingest *rtpIngest
+
+func validateRtpIngest() error {
+	if *rtpListen == 0 {
+		return nil
+	}
+	if *rtpListen < 0 || *rtpListen > 65535 {
+		return fmt.Errorf("%d is not a port", *rtpListen)
+	}
+	if *rtpPayloadType < 0 || *rtpPayloadType > 127 {
+		return fmt.Errorf("payload type %d is not between 0 and 127", *rtpPayloadType)
+	}
+	return nil
+}
+
+// startRtpIngest listens on the -rtp-listen port and starts receiving
+func startRtpIngest() error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: *rtpListen})
+	if err != nil {
+		return err
+	}
+	ingest = &rtpIngest{}
+	fmt.Printf("Receiving H264 over RTP on UDP port %d, payload type %d\n", *rtpListen, *rtpPayloadType)
+	go ingest.receive(conn)
+	return nil
+}
+
+func (i *rtpIngest) receive(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	depacketizer := &codecs.H264Packet{}
+	lastSequenceNumber := uint16(0)
+	received := false
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("Cannot receive RTP: %v\n", err)
+			return
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(buf[:n]); err != nil || int(packet.PayloadType) != *rtpPayloadType {
+			continue
+		}
+		if received && packet.SequenceNumber != lastSequenceNumber+1 {
+			// A fragmented NAL unit missing a part cannot be decoded, neither can the frames referencing it
+			depacketizer = &codecs.H264Packet{}
+			i.resync()
+		}
+		received = true
+		lastSequenceNumber = packet.SequenceNumber
+
+		annexB, err := depacketizer.Unmarshal(packet.Payload)
+		if err != nil || len(annexB) == 0 {
+			continue
+		}
+		i.broadcast(annexB)
+	}
+}
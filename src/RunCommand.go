@@ -6,7 +6,13 @@ import (
 )
 
 func RunCommand(name string, arg ...string) (io.ReadCloser, error) {
+	return RunCommandWithStderr(name, nil, arg...)
+}
+
+// RunCommandWithStderr is RunCommand, but the stderr of the command is written to stderr instead of discarded
+func RunCommandWithStderr(name string, stderr io.Writer, arg ...string) (io.ReadCloser, error) {
 	cmd := exec.Command(name, arg...)
+	cmd.Stderr = stderr
 
 	dataPipe, err := cmd.StdoutPipe()
 	if err != nil {
@@ -16,6 +22,21 @@ func RunCommand(name string, arg ...string) (io.ReadCloser, error) {
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
+	applyProcessPriority(cmd.Process.Pid)
+
+	return &commandReadCloser{ReadCloser: dataPipe, cmd: cmd}, nil
+}
+
+// commandReadCloser is the stdout of a command, closing it also stops the command
+type commandReadCloser struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
 
-	return dataPipe, nil
+func (c *commandReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	// The command may already have exited on its own, in that case Kill fails and Wait only collects its exit status
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return err
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+var errNoVideoInOffer = errors.New("the offer contains no video, the client must offer to receive a video track")
+var errVideoNotReceived = errors.New("the client only offers to send video, it must offer to receive a video track with a=recvonly or a=sendrecv")
+
+// checkSdpBody checks that a request body looks like SDP, so a misdirected client gets a clear error
+// instead of the error Pion returns for binary or other text
+func checkSdpBody(body string) error {
+	if !utf8.ValidString(body) {
+		return errors.New("the body is not valid UTF-8, it must be an SDP offer")
+	}
+	if !strings.HasPrefix(strings.TrimLeft(body, " \t\r\n"), "v=") {
+		return errors.New("the body does not start with v=, it must be an SDP offer")
+	}
+	return nil
+}
+
+// mediaCodecNames returns the names of the codecs of all enabled media sections of the given kind
+func mediaCodecNames(description *sdp.SessionDescription, kind string) []string {
+	names := []string{}
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != kind || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.Atoi(format)
+			if err != nil {
+				continue
+			}
+			codec, err := description.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil || codec.Name == "" {
+				continue
+			}
+			names = append(names, codec.Name)
+		}
+	}
+	return names
+}
+
+// validateAnswer checks that the answer we generated actually sends video using mimeType.
+// Otherwise the client would get a connection without any media.
+func validateAnswer(answer string, offer string, mimeType string) error {
+	codecName := strings.TrimPrefix(mimeType, "video/")
+
+	parsedAnswer := &sdp.SessionDescription{}
+	if err := parsedAnswer.Unmarshal([]byte(answer)); err != nil {
+		return err
+	}
+	for _, name := range mediaCodecNames(parsedAnswer, "video") {
+		if strings.EqualFold(name, codecName) {
+			if !sendsVideo(parsedAnswer) {
+				return errVideoNotReceived
+			}
+			return nil
+		}
+	}
+
+	parsedOffer := &sdp.SessionDescription{}
+	if err := parsedOffer.Unmarshal([]byte(offer)); err != nil {
+		return err
+	}
+	offered := offeredVideoCodecs(parsedOffer)
+	if len(offered) == 0 {
+		return errNoVideoInOffer
+	}
+	return noCommonCodecError{supported: supportedCodecs(), offered: offered}
+}
+
+// sendsVideo reports whether an enabled video section of the description sends
+func sendsVideo(description *sdp.SessionDescription) bool {
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != "video" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := media.Attribute(webrtc.RTPTransceiverDirectionSendrecv.String()); ok {
+			return true
+		}
+		if _, ok := media.Attribute(webrtc.RTPTransceiverDirectionSendonly.String()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sendOnly marks the media sections of a description we generated that send one of our tracks and receive as sendonly,
+// we never receive media. Pion makes the transceiver of our track sendrecv when a sendrecv offer matched it, and rejects
+// local descriptions it did not generate, so this is applied to the SDP sent to the browser only: the transceiver
+// stays sendrecv in Pion. The sections we send in are those with an a=msid, the others are left as Pion negotiated them.
+func sendOnly(description string) string {
+	lines := strings.Split(description, "\r\n")
+	// start is the first line of the current section
+	start := 0
+	for end := 1; end <= len(lines); end++ {
+		if end < len(lines) && !strings.HasPrefix(lines[end], "m=") {
+			continue
+		}
+		section := lines[start:end]
+		if strings.HasPrefix(section[0], "m=") && hasAttribute(section, "a=msid:") {
+			for i, line := range section {
+				if line == "a=sendrecv" {
+					section[i] = "a=sendonly"
+				}
+			}
+		}
+		start = end
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// hasAttribute tells whether one of the lines starts with prefix
+func hasAttribute(lines []string, prefix string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// offeredCodecPreferences returns the codecs of the first enabled video section of the offer that send mimeType,
+// in the order the client prefers them, together with their retransmission codecs.
+// H264 without packetization-mode=1 is left out, our packetizer fragments large NAL units.
+func offeredCodecPreferences(offer string, mimeType string) ([]webrtc.RTPCodecParameters, error) {
+	parsedOffer := &sdp.SessionDescription{}
+	if err := parsedOffer.Unmarshal([]byte(offer)); err != nil {
+		return nil, err
+	}
+	codecName := strings.TrimPrefix(mimeType, "video/")
+
+	for _, media := range parsedOffer.MediaDescriptions {
+		if media.MediaName.Media != "video" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+
+		preferred := []webrtc.RTPCodecParameters{}
+		retransmissions := []webrtc.RTPCodecParameters{}
+		accepted := map[string]bool{}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.Atoi(format)
+			if err != nil {
+				continue
+			}
+			codec, err := parsedOffer.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil {
+				continue
+			}
+			parameters := webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/" + codec.Name, ClockRate: codec.ClockRate, SDPFmtpLine: codec.Fmtp},
+				PayloadType:        webrtc.PayloadType(payloadType),
+			}
+			switch {
+			case strings.EqualFold(codec.Name, "rtx"):
+				retransmissions = append(retransmissions, parameters)
+			case !strings.EqualFold(codec.Name, codecName):
+			case strings.EqualFold(codecName, "H264") && !strings.Contains(codec.Fmtp, "packetization-mode=1"):
+			default:
+				preferred = append(preferred, parameters)
+				accepted[format] = true
+			}
+		}
+		for _, rtx := range retransmissions {
+			if accepted[strings.TrimPrefix(rtx.SDPFmtpLine, "apt=")] {
+				preferred = append(preferred, rtx)
+			}
+		}
+		return preferred, nil
+	}
+	return nil, errNoVideoInOffer
+}
+
+// applyOfferedCodecPreferences makes the answer of the transceiver follow the codec order of the offer
+func applyOfferedCodecPreferences(logger connectionLogger, transceiver *webrtc.RTPTransceiver, offer string, mimeType string) {
+	preferences, err := offeredCodecPreferences(offer, mimeType)
+	if err != nil || len(preferences) == 0 {
+		// validateAnswer reports offers without a usable codec
+		return
+	}
+	if err := transceiver.SetCodecPreferences(preferences); err != nil {
+		logger.Printf("Cannot apply the codec preferences of the offer: %v\n", err)
+	}
+}
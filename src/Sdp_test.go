@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSendOnly(t *testing.T) {
+	description := strings.Join([]string{
+		"v=0",
+		"a=group:BUNDLE 0 1",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+		"a=mid:0",
+		"a=rtpmap:96 H264/90000",
+		"a=ssrc:1 cname:pion",
+		"a=msid:pion video",
+		"a=sendrecv",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+		"a=mid:1",
+		"a=rtpmap:96 H264/90000",
+		"a=sendrecv",
+		"",
+	}, "\r\n")
+
+	sections := strings.Split(sendOnly(description), "\r\nm=")
+	if !hasAttribute(strings.Split(sections[1], "\r\n"), "a=sendonly") {
+		t.Errorf("the section of our track is not sendonly:\n%s", sections[1])
+	}
+	if !hasAttribute(strings.Split(sections[2], "\r\n"), "a=sendrecv") {
+		t.Errorf("the section without a track of ours was changed:\n%s", sections[2])
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	seiMode = flag.String("sei", "none", "insert a SEI with the send time before: none, keyframe or frame")
+	seiText = flag.String("sei-text", "", "extra bytes appended to the inserted SEI payload")
+)
+
+// seiUUID identifies our user data unregistered SEI messages, so clients can find them between SEIs from the encoder
+var seiUUID = [16]byte{0x6f, 0x6d, 0x3c, 0x2a, 0x0e, 0x7b, 0x4d, 0x41, 0x9b, 0x2c, 0x19, 0x5e, 0x47, 0x30, 0x8a, 0xd4}
+
+const seiPayloadTypeUserDataUnregistered = 5
+
+func validateSeiMode(mode string) error {
+	switch mode {
+	case "none", "keyframe", "frame":
+		return nil
+	}
+	return fmt.Errorf("unknown SEI mode %q, expected none, keyframe or frame", mode)
+}
+
+// newTimestampSei builds a user data unregistered SEI NAL unit (without start code) containing
+// seiUUID, the send time as big endian microseconds since the unix epoch, and -sei-text.
+func newTimestampSei(sendTime time.Time) []byte {
+	payload := make([]byte, 0, len(seiUUID)+8+len(*seiText))
+	payload = append(payload, seiUUID[:]...)
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, uint64(sendTime.UnixNano()/int64(time.Microsecond)))
+	payload = append(payload, timestamp...)
+	payload = append(payload, *seiText...)
+
+	rbsp := []byte{seiPayloadTypeUserDataUnregistered}
+	size := len(payload)
+	for ; size >= 255; size -= 255 {
+		rbsp = append(rbsp, 0xff)
+	}
+	rbsp = append(rbsp, byte(size))
+	rbsp = append(rbsp, payload...)
+	// rbsp_trailing_bits
+	rbsp = append(rbsp, 0x80)
+
+	// nal_ref_idc is always 0 for SEI
+	return append([]byte{byte(h264reader.NalUnitTypeSEI)}, escapeRbsp(rbsp)...)
+}
+
+// escapeRbsp inserts the emulation prevention bytes, the reverse of unescapeRbsp
+func escapeRbsp(rbsp []byte) []byte {
+	escaped := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 0x03 {
+			escaped = append(escaped, 0x03)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		escaped = append(escaped, b)
+	}
+	return escaped
+}
@@ -0,0 +1,294 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	selfTest         = flag.Bool("selftest", false, "connect an in-process receiver through the HTTP signaling on a random local port, validate the stream it receives, then exit")
+	selfTestDuration = flag.Duration("selftest-duration", 5*time.Second, "how long -selftest receives the stream")
+)
+
+// selfTestResult collects what the in-process receiver got
+type selfTestResult struct {
+	lock      sync.Mutex
+	mimeType  string
+	packets   int
+	lost      int
+	nalUnits  map[h264reader.NalUnitType]int
+	frames    int
+	keyframes int
+	sps       *spsInfo
+	err       error
+	// duration is how long the stream was received
+	duration time.Duration
+}
+
+func (r *selfTestResult) fail(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// runSelfTest streams to a receiver in this process over the real ICE, DTLS and RTP path,
+// depacketizes what it receives and validates its structure. It returns the exit code for the process.
+func runSelfTest() int {
+	result, err := receiveSelfTest(*selfTestDuration)
+	if err != nil {
+		fmt.Printf("FAIL %v\n", err)
+		return 1
+	}
+	result.lock.Lock()
+	defer result.lock.Unlock()
+	return result.report()
+}
+
+// receiveSelfTest connects a receiver in this process through the HTTP signaling, receives the stream for the duration
+// and closes both ends of the connection again. The go tests run the self test through it as well.
+func receiveSelfTest(duration time.Duration) (*selfTestResult, error) {
+	result := &selfTestResult{nalUnits: map[h264reader.NalUnitType]int{}, duration: duration}
+
+	receiver, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the receiver: %v", err)
+	}
+	defer receiver.Close()
+	if _, err = receiver.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return nil, fmt.Errorf("cannot create the receiver: %v", err)
+	}
+
+	connected := make(chan struct{})
+	var connectedOnce sync.Once
+	receiver.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateConnected {
+			connectedOnce.Do(func() { close(connected) })
+		}
+	})
+	receiver.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		result.lock.Lock()
+		result.mimeType = track.Codec().MimeType
+		result.lock.Unlock()
+		receiveSelfTestTrack(track, result)
+	})
+
+	offer, err := receiver.CreateOffer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the offer: %v", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(receiver)
+	if err = receiver.SetLocalDescription(offer); err != nil {
+		return nil, fmt.Errorf("cannot create the offer: %v", err)
+	}
+	<-gatherComplete
+
+	answer, connectionId, err := selfTestSignaling(receiver.LocalDescription().SDP)
+	if err != nil {
+		return nil, fmt.Errorf("negotiation: %v", err)
+	}
+	defer func() {
+		if s := sessions.Get(connectionId); s != nil {
+			s.peerConnection.Close()
+		}
+	}()
+	if err = receiver.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		return nil, fmt.Errorf("cannot apply the answer: %v", err)
+	}
+	fmt.Printf("OK   negotiation\n")
+
+	select {
+	case <-connected:
+		fmt.Printf("OK   connected\n")
+	case <-time.After(duration):
+		return nil, fmt.Errorf("not connected within %v", duration)
+	}
+	time.Sleep(duration)
+	return result, nil
+}
+
+// selfTestSignaling serves the HTTP endpoints on a random local port and POSTs the offer to it like a client,
+// so the self test covers the content type handling and the SDP round trip of the handler as well.
+// It returns the answer and the id of the connection from its Location.
+func selfTestSignaling(offer string) (string, int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", 0, err
+	}
+	server := &http.Server{Handler: withRequestTimeout(newRouter())}
+	go server.Serve(listener)
+	// The connection outlives the signaling
+	defer server.Close()
+
+	request, err := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+"/", strings.NewReader(offer))
+	if err != nil {
+		return "", 0, err
+	}
+	request.Header.Set("Content-Type", "application/sdp")
+	request.Header.Set("X-Request-ID", "selftest")
+	if *authToken != "" {
+		request.Header.Set("Authorization", "Bearer "+*authToken)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if response.StatusCode != http.StatusCreated {
+		return "", 0, fmt.Errorf("POST / answered %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/sdp" {
+		return "", 0, fmt.Errorf("the answer has Content-Type %q instead of application/sdp", contentType)
+	}
+	var connectionId int
+	location, err := response.Location()
+	if err == nil {
+		_, err = fmt.Sscanf(location.Path, "/session/%d", &connectionId)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("the answer has no Location of its session: %q", response.Header.Get("Location"))
+	}
+	fmt.Printf("OK   POST / answered %s with the session %s\n", response.Status, location)
+	return string(body), connectionId, nil
+}
+
+// receiveSelfTestTrack depacketizes the track until it ends
+func receiveSelfTestTrack(track *webrtc.TrackRemote, result *selfTestResult) {
+	isH264 := strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeH264)
+	isVp9 := strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeVP9)
+	h264Packet := &codecs.H264Packet{}
+	vp8Packet := &codecs.VP8Packet{}
+	vp9Packet := &codecs.VP9Packet{}
+	lastSequenceNumber := uint16(0)
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		result.lock.Lock()
+		if result.packets > 0 && packet.SequenceNumber != lastSequenceNumber+1 {
+			result.lost += int(packet.SequenceNumber - lastSequenceNumber - 1)
+		}
+		lastSequenceNumber = packet.SequenceNumber
+		result.packets++
+		if packet.Marker {
+			result.frames++
+		}
+		result.lock.Unlock()
+
+		if isVp9 {
+			if _, err := vp9Packet.Unmarshal(packet.Payload); err != nil {
+				result.fail(fmt.Errorf("cannot depacketize VP9: %v", err))
+			} else if vp9Packet.B && ivfKeyframe("vp9", vp9Packet.Payload) {
+				result.lock.Lock()
+				result.keyframes++
+				result.lock.Unlock()
+			}
+			continue
+		}
+		if !isH264 {
+			if _, err := vp8Packet.Unmarshal(packet.Payload); err != nil {
+				result.fail(fmt.Errorf("cannot depacketize VP8: %v", err))
+			} else if vp8Packet.S == 1 && len(vp8Packet.Payload) > 0 && vp8Packet.Payload[0]&0x01 == 0 {
+				result.lock.Lock()
+				result.keyframes++
+				result.lock.Unlock()
+			}
+			continue
+		}
+
+		annexB, err := h264Packet.Unmarshal(packet.Payload)
+		if err != nil {
+			result.fail(fmt.Errorf("cannot depacketize H264: %v", err))
+			continue
+		}
+		for _, nal := range bytes.Split(annexB, []byte{0x00, 0x00, 0x00, 0x01}) {
+			if len(nal) == 0 {
+				continue
+			}
+			validateSelfTestNal(nal, result)
+		}
+	}
+}
+
+// validateSelfTestNal checks the header of a received NAL unit and parses its SPS
+func validateSelfTestNal(nal []byte, result *selfTestResult) {
+	if nal[0]&0x80 != 0 {
+		result.fail(fmt.Errorf("NAL unit with the forbidden zero bit set"))
+		return
+	}
+	unitType := h264reader.NalUnitType(nal[0] & 0x1f)
+	if unitType == 0 || unitType > 23 {
+		result.fail(fmt.Errorf("NAL unit with type %d, which cannot be in a depacketized stream", unitType))
+		return
+	}
+
+	result.lock.Lock()
+	defer result.lock.Unlock()
+	result.nalUnits[unitType]++
+	if unitType == h264reader.NalUnitTypeCodedSliceIdr {
+		result.keyframes++
+	}
+	if unitType == h264reader.NalUnitTypeSPS && result.sps == nil {
+		info, err := parseSps(nal)
+		if err != nil {
+			if result.err == nil {
+				result.err = fmt.Errorf("cannot parse the received SPS: %v", err)
+			}
+			return
+		}
+		result.sps = &info
+	}
+}
+
+// report prints the result and returns the exit code, result.lock must be held
+func (r *selfTestResult) report() int {
+	exitCode := 0
+	if r.packets == 0 {
+		fmt.Printf("FAIL no RTP packets received within %v\n", r.duration)
+		return 1
+	}
+	fmt.Printf("OK   received %d RTP packets (%d lost) with %d frames of %s\n", r.packets, r.lost, r.frames, r.mimeType)
+
+	if r.err != nil {
+		fmt.Printf("FAIL %v\n", r.err)
+		exitCode = 1
+	}
+	if r.keyframes == 0 {
+		fmt.Printf("FAIL no keyframe received\n")
+		exitCode = 1
+	}
+	if strings.EqualFold(r.mimeType, webrtc.MimeTypeH264) {
+		if r.nalUnits[h264reader.NalUnitTypeSPS] == 0 || r.nalUnits[h264reader.NalUnitTypePPS] == 0 {
+			fmt.Printf("FAIL no SPS and PPS received, the receiver cannot decode the stream\n")
+			exitCode = 1
+		}
+		if r.sps != nil {
+			fmt.Printf("OK   stream %s\n", r.sps)
+		}
+	}
+	if exitCode == 0 {
+		fmt.Printf("OK   %d keyframes depacketized and validated\n", r.keyframes)
+	}
+	return exitCode
+}
@@ -0,0 +1,50 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"flag"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testSourceOnce sync.Once
+	testSourceErr  error
+)
+
+// useTestSource configures the defaults with the file source of the H264 fixture, as -source=file:testdata/stream.h264 would
+func useTestSource(t *testing.T) {
+	t.Helper()
+	testSourceOnce.Do(func() {
+		if testSourceErr = flag.Set("source", "file:"+testStream); testSourceErr == nil {
+			testSourceErr = validateConfig()
+		}
+	})
+	if testSourceErr != nil {
+		t.Fatalf("cannot configure the test source: %v", testSourceErr)
+	}
+}
+
+// TestSelfTest runs -selftest against the fixture, through the router, the offer/answer exchange and the media path
+func TestSelfTest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams for a second")
+	}
+	useTestSource(t)
+
+	result, err := receiveSelfTest(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.lock.Lock()
+	defer result.lock.Unlock()
+	if result.report() != 0 {
+		t.Fatal("the received stream is invalid")
+	}
+	if result.sps == nil || result.sps.width != 1920 || result.sps.height != 1080 {
+		t.Errorf("received the SPS %v, want the 1920x1080 one of the fixture", result.sps)
+	}
+}
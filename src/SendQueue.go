@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	sendQueueDepth = flag.Int("send-queue", 0, "read the H264 source and write to the connection in separate goroutines, with a queue of this many samples in between, so a slow write does not stall reading the source and a stalled source does not stall the writes of what was read. When the queue is full the oldest non-reference picture in it is dropped. 0 reads and writes in the same loop")
+)
+
+func validateSendQueue() error {
+	if *sendQueueDepth < 0 {
+		return errors.New("-send-queue cannot be negative")
+	}
+	if *sendQueueDepth == 1 {
+		return errors.New("-send-queue needs room for at least 2 samples, use 0 to disable it")
+	}
+	return nil
+}
+
+// dropReasonSendQueue is the reason reported for the pictures dropped from a full send queue
+const dropReasonSendQueue = "send-queue"
+
+// queuedSample is a sample to write to the video track
+type queuedSample struct {
+	// data is nil for a sample that only waits for the tick of a picture that was not sent, like when held
+	data     []byte
+	duration time.Duration
+	// tick is the frame duration the send loop waits for after a picture, 0 for the NAL units sent with the next picture
+	tick time.Duration
+}
+
+// droppable tells whether the sample can be dropped from a full queue: a non-reference picture, that no other
+// picture is decoded from, or the tick of a picture that was not sent anyway
+func (s queuedSample) droppable() bool {
+	if s.tick == 0 {
+		return false
+	}
+	if s.data == nil {
+		return true
+	}
+	slice := firstSlice(s.data)
+	return slice != nil && slice[0]&0x60 == 0
+}
+
+// sendQueue holds the samples read from the source until the goroutine writing them to the track gets to them.
+//
+// It is no channel, as the samples dropped when it is full are not the oldest but the oldest that can be dropped.
+// The duration of a dropped picture is added to the next picture, so the RTP timestamps keep following the clock,
+// and the writer skips its tick, so it catches up.
+type sendQueue struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	samples []queuedSample
+	depth   int
+	// carry is the duration of the dropped pictures not added to a queued picture yet
+	carry    time.Duration
+	closed   bool
+	dropped  int
+	logger   connectionLogger
+	reporter *dropReporter
+}
+
+func newSendQueue(logger connectionLogger, depth int, reporter *dropReporter) *sendQueue {
+	q := &sendQueue{depth: depth, logger: logger, reporter: reporter}
+	q.changed = sync.NewCond(&q.lock)
+	return q
+}
+
+// push queues the sample, it blocks while the queue is full of samples that cannot be dropped.
+// It reports false when the queue is closed, as the writer stopped.
+func (q *sendQueue) push(sample queuedSample) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for !q.closed && len(q.samples) >= q.depth && !q.dropOldest() {
+		q.changed.Wait()
+	}
+	if q.closed {
+		return false
+	}
+	if sample.data != nil && sample.tick > 0 {
+		sample.duration += q.carry
+		q.carry = 0
+	}
+	q.samples = append(q.samples, sample)
+	q.changed.Broadcast()
+	return true
+}
+
+// dropOldest removes the oldest sample that can be dropped, it reports false when there is none
+func (q *sendQueue) dropOldest() bool {
+	for i, sample := range q.samples {
+		if !sample.droppable() {
+			continue
+		}
+		q.samples = append(q.samples[:i], q.samples[i+1:]...)
+		if sample.data == nil {
+			return true
+		}
+		q.dropped++
+		q.reporter.frame(dropReasonSendQueue)
+		if q.dropped == 1 || q.dropped%100 == 0 {
+			q.logger.Printf("The send queue is full, dropped %d non-reference pictures so far\n", q.dropped)
+		}
+		for j := i; j < len(q.samples); j++ {
+			if q.samples[j].data != nil && q.samples[j].tick > 0 {
+				q.samples[j].duration += sample.duration
+				return true
+			}
+		}
+		q.carry += sample.duration
+		return true
+	}
+	return false
+}
+
+// pop returns the oldest sample, it blocks while the queue is empty. It reports false once the queue is closed.
+func (q *sendQueue) pop() (queuedSample, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for !q.closed && len(q.samples) == 0 {
+		q.changed.Wait()
+	}
+	if q.closed {
+		return queuedSample{}, false
+	}
+	sample := q.samples[0]
+	q.samples = q.samples[1:]
+	q.changed.Broadcast()
+	return sample, true
+}
+
+// drain blocks until the writer took all samples, at the end of the stream. It reports false when the queue was closed first.
+func (q *sendQueue) drain() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for !q.closed && len(q.samples) > 0 {
+		q.changed.Wait()
+	}
+	return !q.closed
+}
+
+// close stops the queue, the samples still in it are not written
+func (q *sendQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.changed.Broadcast()
+}
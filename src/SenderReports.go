@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+var (
+	senderReportInterval = flag.Duration("sr-interval", time.Second, "how often to send an RTCP sender report for every track, which maps its RTP timestamps to the wall clock for the lip-sync of audio and video and lets the client measure the round trip time. 0 sends none")
+)
+
+func validateSenderReportInterval() error {
+	if *senderReportInterval < 0 {
+		return errors.New("the interval cannot be negative")
+	}
+	if *senderReportInterval > 0 && *senderReportInterval < 10*time.Millisecond {
+		return errors.New("use an interval of at least 10ms")
+	}
+	return nil
+}
+
+// ntpEpochOffset is the number of seconds from the NTP epoch, 1 January 1900, to the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// ntpTime converts t to the 64 bit NTP timestamp of a sender report, 32 bits of seconds and 32 bits of fraction.
+// The integer math keeps the full resolution, unlike a float64 holding the seconds since 1900.
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// senderReports sends the RTCP sender reports of a connection. It replaces the sender interceptor of pion, which
+// reports before the first packet was sent, extrapolating the RTP time from the zero time, and maps the wall clock
+// to the RTP time of the last packet written instead of the first packet of a frame, the moment the frame was due.
+type senderReports struct {
+	interceptor.NoOp
+	logger   connectionLogger
+	interval time.Duration
+
+	mutex   sync.Mutex
+	streams map[uint32]*senderStream
+	closed  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// senderStream is the state of a track needed for its sender reports
+type senderStream struct {
+	mimeType  string
+	clockRate uint64
+
+	// firstTime and elapsed measure how far the RTP clock is off the wall clock since the first packet
+	firstTime time.Time
+	elapsed   uint64
+	// rtpTime was the timestamp of the packets at time, when the first packet with that timestamp was sent
+	rtpTime uint32
+	time    time.Time
+
+	packets uint32
+	octets  uint32
+	reports int
+	// maxDrift is the largest difference between the RTP clock and the wall clock seen by a report
+	maxDrift time.Duration
+}
+
+func newSenderReports(logger connectionLogger, interval time.Duration) *senderReports {
+	return &senderReports{
+		logger:   logger,
+		interval: interval,
+		streams:  map[uint32]*senderStream{},
+		closed:   make(chan struct{}),
+	}
+}
+
+func (s *senderReports) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	stream := &senderStream{mimeType: info.MimeType, clockRate: uint64(info.ClockRate)}
+	if strings.HasPrefix(info.MimeType, "video/") {
+		// The video timestamps run at -video-clock-rate, whatever was negotiated
+		stream.clockRate = uint64(*timestampClockRate)
+	}
+	s.mutex.Lock()
+	s.streams[info.SSRC] = stream
+	s.mutex.Unlock()
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		now := time.Now()
+		s.mutex.Lock()
+		switch {
+		case stream.packets == 0:
+			stream.firstTime = now
+			stream.rtpTime = header.Timestamp
+			stream.time = now
+		case header.Timestamp != stream.rtpTime:
+			// Only a timestamp later than the last one is a new frame, retransmitted packets keep the mapping
+			if delta := header.Timestamp - stream.rtpTime; delta < 1<<31 {
+				stream.elapsed += uint64(delta)
+				stream.rtpTime = header.Timestamp
+				stream.time = now
+			}
+		}
+		stream.packets++
+		stream.octets += uint32(len(payload))
+		s.mutex.Unlock()
+		return writer.Write(header, payload, a)
+	})
+}
+
+func (s *senderReports) UnbindLocalStream(info *interceptor.StreamInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if stream, ok := s.streams[info.SSRC]; ok {
+		delete(s.streams, info.SSRC)
+		s.logStream(stream)
+	}
+}
+
+func (s *senderReports) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	s.wg.Add(1)
+	go s.loop(writer)
+	return writer
+}
+
+func (s *senderReports) loop(writer interceptor.RTCPWriter) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			var reports []rtcp.Packet
+			for ssrc, stream := range s.streams {
+				if report := stream.report(ssrc, now); report != nil {
+					if stream.reports == 1 {
+						s.logger.Printf("First RTCP sender report of the %s track maps RTP time %d to NTP time %#016x\n", stream.mimeType, report.RTPTime, report.NTPTime)
+					}
+					reports = append(reports, report)
+				}
+			}
+			s.mutex.Unlock()
+			if len(reports) == 0 {
+				continue
+			}
+			if _, err := writer.Write(reports, interceptor.Attributes{}); err != nil {
+				s.logger.Printf("Cannot send the RTCP sender reports: %v\n", err)
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// report returns the sender report of the stream at now, nil when it sent nothing yet
+func (stream *senderStream) report(ssrc uint32, now time.Time) *rtcp.SenderReport {
+	if stream.packets == 0 {
+		return nil
+	}
+	// The RTP clock keeps running between frames, at the rate of the wall clock
+	since := now.Sub(stream.time)
+	ticks := uint64(since/time.Second)*stream.clockRate + uint64(since%time.Second)*stream.clockRate/uint64(time.Second)
+
+	rtpElapsed := time.Duration(stream.elapsed/stream.clockRate)*time.Second + time.Duration(stream.elapsed%stream.clockRate*uint64(time.Second)/stream.clockRate)
+	drift := rtpElapsed - stream.time.Sub(stream.firstTime)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > stream.maxDrift {
+		stream.maxDrift = drift
+	}
+	stream.reports++
+
+	return &rtcp.SenderReport{
+		SSRC:        ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     stream.rtpTime + uint32(ticks),
+		PacketCount: stream.packets,
+		OctetCount:  stream.octets,
+	}
+}
+
+// logStream logs the sender reports of a stream that stopped sending
+func (s *senderReports) logStream(stream *senderStream) {
+	if stream.reports == 0 {
+		return
+	}
+	s.logger.Printf("Sent %d RTCP sender reports for the %s track, its RTP clock was at most %v off the wall clock\n", stream.reports, stream.mimeType, stream.maxDrift.Round(time.Millisecond))
+}
+
+func (s *senderReports) Close() error {
+	s.mutex.Lock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+		for ssrc, stream := range s.streams {
+			delete(s.streams, ssrc)
+			s.logStream(stream)
+		}
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return nil
+}
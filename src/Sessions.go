@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+// session is a PeerConnection that can be addressed through its /session/{id} resource
+type session struct {
+	// rampUpLimit is the bitrate in kbps ffmpeg is started with while ramping up, 0 when not ramping up.
+	// It is accessed atomically, and first in the struct to be 64 bit aligned on 32 bit platforms.
+	rampUpLimit uint64
+
+	id             int
+	logger         connectionLogger
+	peerConnection *webrtc.PeerConnection
+	videoSender    *webrtc.RTPSender
+	// mimeType is the codec of the video track, chosen when the session was created
+	mimeType string
+	// codec is the name of that codec in -codecs, used to start ffmpeg when switching the source
+	codec string
+	// bitrateLimit is the bandwidth in kbps the offer allowed, 0 when unlimited
+	bitrateLimit uint64
+	source       *videoSource
+	// frameLimits are the frame rate and size the offer allowed, which ffmpeg is told to stay within
+	frameLimits frameLimits
+	// playing is the ffmpeg source the connection was switched to last, only access it using playingSource
+	playing     ffmpegSource
+	playingLock sync.Mutex
+	// closed is closed once the PeerConnection is closed
+	closed <-chan struct{}
+	// gathered is closed once all our ICE candidates were gathered
+	gathered <-chan struct{}
+	// hold tells whether the connection is put on hold
+	hold *holdState
+	// keyframes honors the keyframe requests of the client
+	keyframes *keyframeRequests
+	// negotiationLock prevents concurrent offers for the same session
+	negotiationLock sync.Mutex
+	// descriptionLock serializes reading the local description, only access it using localDescription
+	descriptionLock sync.Mutex
+	// sendOffer delivers an offer of ours to the client and returns its answer, for signaling that can reach the client
+	// after the connection was set up. It is nil for the one-shot HTTP signaling, where only the client can send offers.
+	sendOffer func(offer string) (string, error)
+}
+
+// renegotiate applies a new offer from the client to the existing PeerConnection,
+// keeping the tracks and the ffmpeg that feeds them.
+func (s *session) renegotiate(browserOffer string) (string, error) {
+	s.negotiationLock.Lock()
+	defer s.negotiationLock.Unlock()
+
+	s.logger.Printf("Reading renegotiation offer...\n%s\n", browserOffer)
+	if err := s.peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: browserOffer}); err != nil {
+		return "", err
+	}
+	if transceiver := senderTransceiver(s.peerConnection, s.videoSender); transceiver != nil {
+		applyOfferedCodecPreferences(s.logger, transceiver, browserOffer, s.mimeType)
+	}
+	inactivateUnusedTransceivers(s.logger, s.peerConnection)
+
+	answer, err := s.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	if err = validateAnswer(answer.SDP, browserOffer, s.mimeType); err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(s.peerConnection)
+	if err = s.peerConnection.SetLocalDescription(answer); err != nil {
+		return "", explainTrackError(err, s.mimeType)
+	}
+	<-gatherComplete
+
+	description := s.localDescription()
+	if description == nil {
+		return "", errConnectionClosed
+	}
+	s.logger.Printf("Sending renegotiated local description...\n")
+	return rewriteAnswer(pruneRelayCandidates(s.logger, description.SDP)), nil
+}
+
+// errConnectionClosed is returned when the PeerConnection was closed before its local description was sent
+var errConnectionClosed = errors.New("the connection was closed")
+
+// localDescription returns the local description of the PeerConnection, nil before it was set or once it is closed.
+// Pion adds the gathered candidates to it while it is read, so it cannot be read concurrently.
+// Reading them panics once the ICE gatherer is closed, Pion marks the PeerConnection closed before closing it.
+func (s *session) localDescription() *webrtc.SessionDescription {
+	s.descriptionLock.Lock()
+	defer s.descriptionLock.Unlock()
+	if s.peerConnection.SignalingState() == webrtc.SignalingStateClosed {
+		return nil
+	}
+	return s.peerConnection.LocalDescription()
+}
+
+// negotiationNeeded handles OnNegotiationNeeded, fired when a change to the tracks has to be negotiated
+func (s *session) negotiationNeeded() {
+	if s.sendOffer == nil {
+		s.logger.Printf("Renegotiation was requested, but the signaling cannot send an offer to the client, it has to PATCH a new offer to /session/%d\n", s.id)
+		return
+	}
+	// The handler runs on the operations queue of the PeerConnection, which the negotiation itself needs
+	go func() {
+		if err := s.offer(); err != nil {
+			s.logger.Printf("Cannot renegotiate: %v\n", err)
+		}
+	}()
+}
+
+// offer starts a new offer/answer exchange from our side through sendOffer
+func (s *session) offer() error {
+	s.negotiationLock.Lock()
+	defer s.negotiationLock.Unlock()
+
+	s.logger.Printf("Creating renegotiation offer...\n")
+	offer, err := s.peerConnection.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(s.peerConnection)
+	if err = s.peerConnection.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gatherComplete
+
+	description := s.localDescription()
+	if description == nil {
+		return errConnectionClosed
+	}
+	answer, err := s.sendOffer(sendOnly(pruneRelayCandidates(s.logger, description.SDP)))
+	if err != nil {
+		return err
+	}
+	s.logger.Printf("Reading renegotiation answer...\n%s\n", answer)
+	return s.peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer})
+}
+
+// sessionRegistry holds the sessions of all open connections, keyed by connection id.
+// It is accessed from the HTTP handlers and the PeerConnection callbacks, so every access takes the lock.
+type sessionRegistry struct {
+	lock     sync.Mutex
+	sessions map[int]*session
+}
+
+// sessions is the registry of the whole process, a session is added before its offer is handled
+// and removed once its PeerConnection is closed
+var sessions = &sessionRegistry{sessions: map[int]*session{}}
+
+// nextConnectionId is the id of the last connection, only access it using newConnectionId
+var nextConnectionId int64
+
+func newConnectionId() int {
+	return int(atomic.AddInt64(&nextConnectionId, 1))
+}
+
+func (r *sessionRegistry) Add(s *session) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sessions[s.id] = s
+}
+
+// Get returns the session with the given id, or nil when there is none
+func (r *sessionRegistry) Get(id int) *session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sessions[id]
+}
+
+func (r *sessionRegistry) Remove(id int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.sessions, id)
+}
+
+// List returns a snapshot of the sessions, ordered by id
+func (r *sessionRegistry) List() []*session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// handleDeleteSession ends the connection when the client leaves, as WHEP clients do by deleting the resource of the
+// session. The PeerConnection and the ffmpeg feeding it are closed right away, instead of once ICE times out.
+func handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	s := sessions.Get(id)
+	if s == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	s.logger.Printf("The client ended the connection\n")
+	if err := s.peerConnection.Close(); err != nil {
+		s.logger.Printf("cannot close peerConnection: %v\n", err)
+	}
+	// The send loop only notices the closed connection at its next write, ffmpeg is stopped before that
+	if err := s.source.Close(); err != nil {
+		s.logger.Printf("cannot close dataPipe: %v\n", err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
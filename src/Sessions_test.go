@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestSessionRegistryConcurrent uses the registry from concurrent goroutines, run it with -race
+func TestSessionRegistryConcurrent(t *testing.T) {
+	registry := &sessionRegistry{sessions: map[int]*session{}}
+	const workers, perWorker = 8, 100
+
+	var wait sync.WaitGroup
+	ids := make(chan int, workers*perWorker)
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < perWorker; j++ {
+				s := &session{id: newConnectionId()}
+				registry.Add(s)
+				if got := registry.Get(s.id); got != s {
+					t.Errorf("Get(%d) = %v right after adding it", s.id, got)
+				}
+				list := registry.List()
+				for k := 1; k < len(list); k++ {
+					if list[k-1].id >= list[k].id {
+						t.Errorf("List() is not ordered by id: %d before %d", list[k-1].id, list[k].id)
+					}
+				}
+				// Every other session is closed again
+				if j%2 == 0 {
+					registry.Remove(s.id)
+					if got := registry.Get(s.id); got != nil {
+						t.Errorf("Get(%d) = %v after removing it", s.id, got)
+					}
+				} else {
+					ids <- s.id
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	close(ids)
+
+	open := map[int]bool{}
+	for id := range ids {
+		if open[id] {
+			t.Fatalf("the id %d was handed out twice", id)
+		}
+		open[id] = true
+	}
+	list := registry.List()
+	if len(list) != len(open) {
+		t.Fatalf("List() has %d sessions, want %d", len(list), len(open))
+	}
+	for _, s := range list {
+		if !open[s.id] {
+			t.Errorf("List() has the removed session %d", s.id)
+		}
+	}
+}
+
+func TestNewConnectionIdUnique(t *testing.T) {
+	const workers, perWorker = 8, 1000
+	var lock sync.Mutex
+	seen := map[int]bool{}
+	var wait sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			ids := make([]int, perWorker)
+			for j := range ids {
+				ids[j] = newConnectionId()
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, id := range ids {
+				if seen[id] {
+					t.Errorf("the id %d was handed out twice", id)
+				}
+				seen[id] = true
+			}
+		}()
+	}
+	wait.Wait()
+	if len(seen) != workers*perWorker {
+		t.Errorf("handed out %d ids, want %d", len(seen), workers*perWorker)
+	}
+}
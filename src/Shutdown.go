@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight HTTP requests, like an SDP negotiation, to finish after SIGINT or SIGTERM")
+)
+
+// serve runs the HTTP server until SIGINT or SIGTERM is received. It then stops accepting new
+// requests, waits up to -shutdown-timeout for the in-flight ones and closes all sessions.
+func serve(handler http.Handler) error {
+	srv := &http.Server{Addr: *listenAddress, Handler: handler, ReadHeaderTimeout: *readHeaderTimeout, ReadTimeout: *readTimeout}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listenAndServe(srv)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		fmt.Printf("Received %v, draining HTTP requests for up to %v...\n", sig, *shutdownTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Printf("Cannot drain HTTP requests: %v\n", err)
+	}
+
+	for _, s := range sessions.List() {
+		if err := s.peerConnection.Close(); err != nil {
+			s.logger.Printf("cannot close peerConnection: %v\n", err)
+		}
+	}
+	warmPool.close()
+	fmt.Printf("Shut down\n")
+	return nil
+}
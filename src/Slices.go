@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+// startsPicture reports whether the slice nal is the first slice of a picture.
+// Its slice header starts with first_mb_in_slice, an exp-Golomb number that is 0 when its first bit is set.
+func startsPicture(nal *h264reader.NAL) bool {
+	return len(nal.Data) > 1 && nal.Data[1]&0x80 != 0
+}
+
+// continuesPicture reports whether nal is a slice of the picture before it, which follows the decisions made for its first slice
+func continuesPicture(nal *h264reader.NAL) bool {
+	return isSlice(nal.UnitType) && !startsPicture(nal)
+}
+
+// pictureGrouper groups the slices of a picture, so an encoder splitting pictures into multiple slices
+// has every picture sent as a single sample, with one timestamp and the marker bit after its last slice.
+//
+// The end of a picture is only known when the next NAL unit is read, which is a frame later.
+// So the first picture is held to find out whether the stream has multiple slices per picture, after
+// that the pictures of a stream with a single slice per picture are sent right away.
+type pictureGrouper struct {
+	logger connectionLogger
+	// known is set once the first picture ended
+	known      bool
+	multiSlice bool
+	// pending are the slices of the picture being read
+	pending []byte
+}
+
+// slice adds the annex B slice to its picture, first tells whether it starts a new picture.
+// It returns the pictures that are complete.
+func (g *pictureGrouper) slice(annexB []byte, first bool) [][]byte {
+	if !first {
+		if !g.multiSlice {
+			g.logger.Printf("The stream has multiple slices per frame, sending every frame after its last slice\n")
+			g.known, g.multiSlice = true, true
+		}
+		g.pending = append(g.pending, annexB...)
+		return nil
+	}
+	complete := g.end()
+	g.pending = annexB
+	if g.known && !g.multiSlice {
+		complete = append(complete, g.pending)
+		g.pending = nil
+	}
+	return complete
+}
+
+// end returns the picture being read, when the stream continues with something other than one of its slices
+func (g *pictureGrouper) end() [][]byte {
+	if g.pending == nil {
+		return nil
+	}
+	g.known = true
+	picture := g.pending
+	g.pending = nil
+	return [][]byte{picture}
+}
+
+// reset forgets the picture being read, for a new stream that may be encoded differently
+func (g *pictureGrouper) reset() {
+	g.known = false
+	g.multiSlice = false
+	g.pending = nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+// testPicture is a picture of a crafted stream
+type testPicture struct {
+	idr, ref bool
+}
+
+// craftSlice returns an annex B slice NAL unit whose header has the first macroblock and frame_num,
+// the frame_num is written with the log2_max_frame_num bits of the SPS
+func craftSlice(idr bool, firstMb, frameNum uint, log2MaxFrameNum int) []byte {
+	w := &bitWriter{}
+	w.ue(firstMb)
+	// slice_type P or I, pic_parameter_set_id
+	if idr {
+		w.ue(7)
+	} else {
+		w.ue(5)
+	}
+	w.ue(0)
+	w.write(frameNum, log2MaxFrameNum)
+	header := byte(0x41)
+	if idr {
+		header = 0x65
+	}
+	return append([]byte{0, 0, 0, 1, header}, w.rbsp()...)
+}
+
+// sliceNals returns the slice NAL units of the pictures, split into the given number of slices of 10 macroblocks
+func sliceNals(pictures []testPicture, slices int) []*h264reader.NAL {
+	nals := []*h264reader.NAL{}
+	for _, picture := range pictures {
+		for i := 0; i < slices; i++ {
+			data := craftSlice(picture.idr, uint(i*10), 0, 4)[4:]
+			if !picture.ref {
+				data[0] &^= 0x60
+			}
+			nals = append(nals, &h264reader.NAL{Data: data, UnitType: h264reader.NalUnitType(data[0] & 0x1f), RefIdc: data[0] >> 5 & 3})
+		}
+	}
+	return nals
+}
+
+// groupPictures runs the slices through a pictureGrouper like the send loop does, skipping the pictures drop returns
+// true for. drop is only asked for the first slice of every picture, the other slices follow its decision.
+func groupPictures(nals []*h264reader.NAL, drop func(nal *h264reader.NAL) bool) [][]byte {
+	grouper := &pictureGrouper{}
+	sent := [][]byte{}
+	dropped := false
+	for _, nal := range nals {
+		continuation := continuesPicture(nal)
+		if !continuation {
+			dropped = drop(nal)
+		}
+		if dropped {
+			continue
+		}
+		sent = append(sent, grouper.slice(append([]byte{0, 0, 0, 1}, nal.Data...), !continuation)...)
+	}
+	return append(sent, grouper.end()...)
+}
+
+func TestPictureGrouper(t *testing.T) {
+	pictures := []testPicture{{idr: true, ref: true}, {ref: true}, {}, {ref: true}, {}, {ref: true}}
+	for _, slices := range []int{1, 2, 3} {
+		sent := groupPictures(sliceNals(pictures, slices), func(*h264reader.NAL) bool { return false })
+		if len(sent) != len(pictures) {
+			t.Errorf("%d slices per picture: sent %d pictures, want %d", slices, len(sent), len(pictures))
+			continue
+		}
+		for i, picture := range sent {
+			if count := bytes.Count(picture, []byte{0, 0, 0, 1}); count != slices {
+				t.Errorf("%d slices per picture: picture %d has %d slices", slices, i, count)
+			}
+		}
+	}
+}
+
+func TestPictureGrouperFollowsFirstSlice(t *testing.T) {
+	pictures := []testPicture{{idr: true, ref: true}, {}, {ref: true}, {}, {}, {}, {ref: true}}
+	tests := []struct {
+		name string
+		drop func() func(nal *h264reader.NAL) bool
+		// sent are the indexes of the pictures that are sent
+		sent []int
+	}{
+		{
+			name: "frame skipper sending every second frame",
+			drop: func() func(nal *h264reader.NAL) bool {
+				skipper := &frameSkipper{n: 2}
+				return func(nal *h264reader.NAL) bool { return skipper.shouldSkip(nal, time.Second/30) }
+			},
+			// Frame 4 is sent as it is the second after frame 2, though it is not a reference picture
+			sent: []int{0, 2, 4, 6},
+		},
+		{
+			name: "frame dropper falling behind",
+			drop: func() func(nal *h264reader.NAL) bool {
+				dropper := &frameDropper{behind: true, reporter: &dropReporter{}}
+				return dropper.shouldDrop
+			},
+			sent: []int{0, 2, 6},
+		},
+	}
+	for _, test := range tests {
+		for _, slices := range []int{1, 2} {
+			sent := groupPictures(sliceNals(pictures, slices), test.drop())
+			if len(sent) != len(test.sent) {
+				t.Errorf("%s, %d slices per picture: sent %d pictures, want %d", test.name, slices, len(sent), len(test.sent))
+				continue
+			}
+			for i, picture := range sent {
+				if count := bytes.Count(picture, []byte{0, 0, 0, 1}); count != slices {
+					t.Errorf("%s, %d slices per picture: picture %d has %d slices, not all slices followed the first", test.name, slices, test.sent[i], count)
+				}
+				// Only the pictures 0, 2 and 6 are reference pictures
+				if ref := picture[4]&0x60 != 0; ref != (test.sent[i] == 0 || test.sent[i] == 2 || test.sent[i] == 6) {
+					t.Errorf("%s, %d slices per picture: sent picture %d is not picture %d", test.name, slices, i, test.sent[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows && !js
+// +build !windows,!js
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketBufferSizes returns the receive and send buffer sizes the kernel actually uses.
+// Linux reports double the requested value, as it includes its bookkeeping overhead.
+func socketBufferSizes(conn *net.UDPConn) (int, int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var readBuffer, writeBuffer int
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		if readBuffer, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		writeBuffer, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	}); err != nil {
+		return 0, 0, err
+	}
+	return readBuffer, writeBuffer, sockErr
+}
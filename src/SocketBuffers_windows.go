@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func socketBufferSizes(conn *net.UDPConn) (int, int, error) {
+	return 0, 0, errors.New("not supported on windows")
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	sourceSwitchTimeout = flag.Duration("source-switch-timeout", 10*time.Second, "how long the new ffmpeg may take to produce its first keyframe when switching the source, the old one keeps sending meanwhile")
+)
+
+// ffmpegSource are the ffmpeg arguments producing the video of a connection
+type ffmpegSource struct {
+	H264 []string `json:"ffmpeg"`
+	// Vp8 are used for connections sending VP8, when empty they are derived from H264
+	Vp8 []string `json:"vp8"`
+	// Vp9 are used for connections sending VP9, when empty they are derived from H264
+	Vp9 []string `json:"vp9"`
+}
+
+// switchedSource is the source set through POST /source for all connections, nil until then.
+// Only access it using defaultSource and setDefaultSource.
+var (
+	switchedSource     *ffmpegSource
+	switchedSourceLock sync.Mutex
+)
+
+// defaultSource returns the source new connections start with
+func defaultSource() ffmpegSource {
+	switchedSourceLock.Lock()
+	defer switchedSourceLock.Unlock()
+	if switchedSource != nil {
+		return *switchedSource
+	}
+	return ffmpegSource{H264: ffmpegArgs, Vp8: strings.Fields(*vp8Args), Vp9: strings.Fields(*vp9Args)}
+}
+
+func setDefaultSource(source ffmpegSource) {
+	switchedSourceLock.Lock()
+	switchedSource = &source
+	switchedSourceLock.Unlock()
+	// The warm processes still run the previous source
+	warmPool.refill()
+}
+
+// sourceFfmpegArgs returns the arguments for ffmpeg producing the source in the given codec, with the keyframes
+// of -keyframe-interval, limited to the bitrate the client offered when it is not 0.
+func sourceFfmpegArgs(codec string, source ffmpegSource, bitrateLimit uint64) []string {
+	args := keyframeIntervalArgs(codecFfmpegArgs(codec, source))
+	if bitrateLimit > 0 {
+		args = limitBitrate(args, bitrateLimit)
+	}
+	return args
+}
+
+// startSource opens the stream of the media source for a connection sending the codec, with the video of a container demuxed
+func startSource(logger connectionLogger, codec string, args []string) (io.ReadCloser, error) {
+	pipe, err := mediaSource.Open(logger, args)
+	if err != nil {
+		return nil, err
+	}
+	return withPrebuffer(logger, demuxSource(logger, codec, args, pipe)), nil
+}
+
+var errSourceClosed = errors.New("the connection is closed")
+
+// videoSource holds the output of the ffmpeg feeding a track, which can be switched to another ffmpeg while sending.
+//
+// The send loop reads from the pipe returned by current. When the source is switched the old pipe is closed,
+// so a blocked read returns, and the send loop notices current changed and starts parsing the new pipe from its start.
+type videoSource struct {
+	lock   sync.Mutex
+	pipe   io.ReadCloser
+	closed bool
+	// lastActive is when the send loop last read from the source, zero until it started reading
+	lastActive time.Time
+	// lost receives when the send loop reached the end of the source and waits for it to be restarted
+	lost chan struct{}
+}
+
+// active records that the send loop read from the source
+func (s *videoSource) active(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastActive = now
+}
+
+// idle returns how long the send loop did not read from the source, 0 before it started reading
+func (s *videoSource) idle(now time.Time) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.lastActive.IsZero() {
+		return 0
+	}
+	return now.Sub(s.lastActive)
+}
+
+func (s *videoSource) current() io.ReadCloser {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pipe
+}
+
+// start sets the first pipe of the source. It reports false and closes the pipe
+// when the source was already switched or closed before it started.
+func (s *videoSource) start(pipe io.ReadCloser) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || s.pipe != nil {
+		pipe.Close()
+		return false
+	}
+	s.pipe = pipe
+	return true
+}
+
+// switchTo replaces the pipe of the source and closes the old one
+func (s *videoSource) switchTo(pipe io.ReadCloser) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		pipe.Close()
+		return errSourceClosed
+	}
+	old := s.pipe
+	s.pipe = pipe
+	s.lock.Unlock()
+
+	if old == nil {
+		return nil
+	}
+	return old.Close()
+}
+
+// Close closes the current pipe, later switches fail. Closing it again does nothing.
+func (s *videoSource) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || s.pipe == nil {
+		s.closed = true
+		return nil
+	}
+	s.closed = true
+	return s.pipe.Close()
+}
+
+// switchSource switches the connection over to the new source, make-before-break: the new ffmpeg is started
+// while the old one keeps sending, and the track is fed from the new one once it produced its first keyframe.
+// Then the old ffmpeg is stopped, the viewer sees no gap in between.
+func (s *session) switchSource(source ffmpegSource) error {
+	args := s.rampUpArgs(s.frameLimits.ffmpegArgs(sourceFfmpegArgs(s.codec, source, s.bitrateLimit)))
+	s.logger.Printf("Switching the video source to ffmpeg %s\n", strings.Join(args, " "))
+	pipe, err := startSource(s.logger, s.codec, args)
+	if err != nil {
+		return err
+	}
+	if pipe, err = waitForKeyframe(s.codec, pipe, *sourceSwitchTimeout); err != nil {
+		return fmt.Errorf("the new source did not produce a keyframe: %v", err)
+	}
+	err = s.source.switchTo(pipe)
+	if err == errSourceClosed {
+		return err
+	}
+	if err != nil {
+		s.logger.Printf("cannot close dataPipe: %v\n", err)
+	}
+	s.playingLock.Lock()
+	s.playing = source
+	s.playingLock.Unlock()
+	return nil
+}
+
+// playingSource returns the ffmpeg source the connection sends
+func (s *session) playingSource() ffmpegSource {
+	s.playingLock.Lock()
+	defer s.playingLock.Unlock()
+	return s.playing
+}
+
+// sourceRequest is the body of POST /source
+type sourceRequest struct {
+	ffmpegSource
+	// Connection is the id of the connection to switch, when 0 all connections and new connections are switched
+	Connection int `json:"connection"`
+}
+
+// handleSource switches the ffmpeg feeding one or all connections to other arguments,
+// the new ffmpeg starts with a keyframe so the client can decode it right away.
+func handleSource(w http.ResponseWriter, r *http.Request) {
+	if !usesFfmpeg() {
+		http.Error(w, "Switching the source needs -source ffmpeg", http.StatusConflict)
+		return
+	}
+	var request sourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid source: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.H264) == 0 {
+		http.Error(w, "Invalid source: the ffmpeg arguments are required", http.StatusBadRequest)
+		return
+	}
+	for _, codec := range preferredCodecs() {
+		if err := validateSourceArgs(codec, codecFfmpegArgs(codec, request.ffmpegSource)); err != nil {
+			http.Error(w, "Invalid source: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	targets := sessions.List()
+	if request.Connection != 0 {
+		s := sessions.Get(request.Connection)
+		if s == nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		targets = []*session{s}
+	} else {
+		setDefaultSource(request.ffmpegSource)
+		fmt.Printf("Video source changed to ffmpeg %s\n", strings.Join(request.H264, " "))
+	}
+
+	if failed := switchSources(targets, request.ffmpegSource); len(failed) > 0 {
+		http.Error(w, "Cannot switch the video source: "+strings.Join(failed, ", "), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// switchSources switches the sessions to the source in parallel, so they all wait for the keyframe of their new ffmpeg at once.
+// It returns the errors of the sessions that kept their old source.
+func switchSources(targets []*session, source ffmpegSource) []string {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	failed := []string{}
+	for _, s := range targets {
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			if err := s.switchSource(source); err != nil {
+				s.logger.Printf("Cannot switch the video source: %v\n", err)
+				lock.Lock()
+				failed = append(failed, fmt.Sprintf("connection %d: %v", s.id, err))
+				lock.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	return failed
+}
+
+// waitForKeyframe reads the new stream until its first keyframe, the returned reader starts at that keyframe.
+// For H264 that is the first SPS or IDR, which starts the access unit of the keyframe.
+// The pipe is closed when there is no keyframe within the timeout.
+func waitForKeyframe(codec string, pipe io.ReadCloser, timeout time.Duration) (io.ReadCloser, error) {
+	type result struct {
+		reader io.Reader
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reader, err := skipToKeyframe(codec, bufio.NewReader(pipe))
+		done <- result{reader, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			pipe.Close()
+			return nil, r.err
+		}
+		return &bufferedReadCloser{Reader: r.reader, Closer: pipe}, nil
+	case <-time.After(timeout):
+		pipe.Close()
+		<-done
+		return nil, fmt.Errorf("timeout after %v", timeout)
+	}
+}
+
+func skipToKeyframe(codec string, buffered *bufio.Reader) (io.Reader, error) {
+	if isIvfCodec(codec) {
+		// The 32 byte IVF header, the 12 byte header of the first frame and its first byte, which tells whether it is a keyframe
+		head, err := buffered.Peek(45)
+		if err != nil {
+			return nil, err
+		}
+		if !ivfKeyframe(codec, head[44:]) {
+			return nil, fmt.Errorf("the first %s frame is not a keyframe", strings.ToUpper(codec))
+		}
+		return buffered, nil
+	}
+
+	zeros := 0
+	for {
+		b, err := buffered.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if zeros >= 2 && b == 1 {
+			header, err := buffered.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if unitType := header[0] & 0x1f; unitType == 7 || unitType == 5 {
+				return io.MultiReader(bytes.NewReader([]byte{0x00, 0x00, 0x00, 0x01}), buffered), nil
+			}
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+}
+
+// switchSourceOnHangup re-reads the ffmpeg arguments from the -config file on SIGHUP,
+// and switches all connections to them when they changed.
+func switchSourceOnHangup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if !usesFfmpeg() {
+			fmt.Printf("Received SIGHUP, but the source is not ffmpeg\n")
+			continue
+		}
+		if *configFile == "" {
+			fmt.Printf("Received SIGHUP, but there is no -config file to read the ffmpeg arguments from\n")
+			continue
+		}
+		source, err := readConfigSource(*configFile)
+		if err != nil {
+			fmt.Printf("Received SIGHUP, cannot read %s: %v\n", *configFile, err)
+			continue
+		}
+		current := defaultSource()
+		if strings.Join(source.H264, " ") == strings.Join(current.H264, " ") && strings.Join(source.Vp8, " ") == strings.Join(current.Vp8, " ") && strings.Join(source.Vp9, " ") == strings.Join(current.Vp9, " ") {
+			fmt.Printf("Received SIGHUP, the ffmpeg arguments did not change\n")
+			continue
+		}
+		setDefaultSource(source)
+		fmt.Printf("Received SIGHUP, video source changed to ffmpeg %s\n", strings.Join(source.H264, " "))
+		for _, failure := range switchSources(sessions.List(), source) {
+			fmt.Printf("Cannot switch the video source of %s\n", failure)
+		}
+	}
+}
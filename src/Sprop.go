@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+var (
+	spropParameterSets = flag.Bool("sprop-parameter-sets", false, "read the SPS and PPS of the video source once at startup and announce them in the sprop-parameter-sets of the H264 answer, instead of sending them before every keyframe. Keyframes with other parameter sets, like those of a switched source, still get them in-band")
+)
+
+// spropProbeTimeout is how long the source may take to produce the parameter sets of its first keyframe at startup
+const spropProbeTimeout = 10 * time.Second
+
+// spropLogger prefixes the logs of the source started to read the parameter sets
+var spropLogger = connectionLogger{requestId: "sprop"}
+
+// announcedParameterSets are the parameter sets in the answer in annex B format, as returned by
+// parameterSetCache.keyframe, and spropValue is the value of its sprop-parameter-sets. Both are empty without -sprop-parameter-sets.
+var (
+	announcedParameterSets []byte
+	spropValue             string
+)
+
+// loadSpropParameterSets starts the source like a connection would and reads the parameter sets before its first keyframe
+func loadSpropParameterSets() error {
+	args := sourceFfmpegArgs("h264", defaultSource(), 0)
+	pipe, err := mediaSource.Open(spropLogger, args)
+	if err != nil {
+		return err
+	}
+	pipe = demuxSource(spropLogger, "h264", args, pipe)
+	defer pipe.Close()
+	// Closing the pipe stops a source that produces no keyframe, so the read below returns
+	timer := time.AfterFunc(spropProbeTimeout, func() { pipe.Close() })
+	defer timer.Stop()
+
+	h264, err := h264reader.NewReader(pipe)
+	if err != nil {
+		return err
+	}
+	cache := &parameterSetCache{persistent: true}
+	values := []string{}
+	for {
+		nal, err := h264.NextNAL()
+		if err == io.EOF {
+			return errors.New("the source ended before its first keyframe")
+		}
+		if err != nil {
+			return fmt.Errorf("no keyframe within %v: %v", spropProbeTimeout, err)
+		}
+		switch nal.UnitType {
+		case h264reader.NalUnitTypeSPS, h264reader.NalUnitTypePPS:
+			cache.add(nal.UnitType, append([]byte{0x00, 0x00, 0x00, 0x01}, nal.Data...))
+		case h264reader.NalUnitTypeCodedSliceIdr:
+			if len(cache.sps) == 0 || len(cache.pps) == 0 {
+				return errors.New("the first keyframe of the source has no SPS and PPS")
+			}
+			for _, set := range append(cache.sps, cache.pps...) {
+				values = append(values, base64.StdEncoding.EncodeToString(set.data[4:]))
+			}
+			announcedParameterSets = cache.keyframe()
+			spropValue = strings.Join(values, ",")
+			return nil
+		}
+	}
+}
+
+// addSpropParameterSets announces the parameter sets of the source in the fmtp of the H264 payload types of the answer
+func addSpropParameterSets(answer string) string {
+	if spropValue == "" {
+		return answer
+	}
+	lines := strings.Split(answer, "\r\n")
+	h264 := map[string]bool{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "a=rtpmap:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+		if len(fields) == 2 && strings.EqualFold(strings.Split(fields[1], "/")[0], "H264") {
+			h264[fields[0]] = true
+		}
+	}
+	for i, line := range lines {
+		if payloadType, ok := attributePayloadType(line); ok && h264[payloadType] && strings.HasPrefix(line, "a=fmtp:") {
+			lines[i] = line + ";sprop-parameter-sets=" + spropValue
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
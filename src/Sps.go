@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// spsInfo contains the fields of a H264 sequence parameter set we are interested in
+type spsInfo struct {
+	profileIdc       uint8
+	constraintFlags  uint8
+	levelIdc         uint8
+	chromaFormatIdc  uint
+	log2MaxFrameNum  uint
+	frameMbsOnlyFlag bool
+	width            uint
+	height           uint
+	// frameRate is 0 when the SPS has no VUI timing information
+	frameRate float64
+	// separateColourPlane is set when the colour planes of 4:4:4 video are coded separately, their slices then name their plane
+	separateColourPlane bool
+}
+
+func (s spsInfo) String() string {
+	frameRate := "unknown frame rate"
+	if s.frameRate > 0 {
+		frameRate = fmt.Sprintf("%.3g fps", s.frameRate)
+	}
+	return fmt.Sprintf("%dx%d, %s (profile %d, level %d.%d)", s.width, s.height, frameRate, s.profileIdc, s.levelIdc/10, s.levelIdc%10)
+}
+
+var errSpsTruncated = errors.New("sps is truncated")
+
+// unescapeRbsp removes the emulation prevention bytes (00 00 03) from a NAL unit
+func unescapeRbsp(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// bitReader reads the bit oriented fields of a H264 RBSP
+type bitReader struct {
+	data []byte
+	pos  uint
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= uint(len(r.data))*8 {
+		return 0, errSpsTruncated
+	}
+	b := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+	r.pos++
+	return uint(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	v := uint(0)
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) flag() (bool, error) {
+	b, err := r.bit()
+	return b == 1, err
+}
+
+// ue reads an unsigned Exp-Golomb coded value
+func (r *bitReader) ue() (uint, error) {
+	leadingZeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		leadingZeros++
+		if leadingZeros > 31 {
+			return 0, errors.New("invalid exp-golomb code")
+		}
+	}
+	v, err := r.bits(leadingZeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1 << leadingZeros) - 1 + v, nil
+}
+
+// se reads a signed Exp-Golomb coded value
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int(v+1) / 2, nil
+	}
+	return -int(v / 2), nil
+}
+
+func (r *bitReader) skipScalingList(size int) error {
+	lastScale, nextScale := 8, 8
+	for i := 0; i < size; i++ {
+		if nextScale != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			nextScale = (lastScale + delta + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+	return nil
+}
+
+// parseSps parses a SPS NAL unit (including its header byte, without start code),
+// following section 7.3.2.1.1 of the H264 specification.
+func parseSps(nal []byte) (spsInfo, error) {
+	info := spsInfo{chromaFormatIdc: 1}
+	if len(nal) < 4 {
+		return info, errSpsTruncated
+	}
+	// Removing the emulation prevention bytes can leave less than the profile and level
+	rbsp := unescapeRbsp(nal[1:])
+	if len(rbsp) < 3 {
+		return info, errSpsTruncated
+	}
+	info.profileIdc = rbsp[0]
+	info.constraintFlags = rbsp[1]
+	info.levelIdc = rbsp[2]
+	r := &bitReader{data: rbsp[3:]}
+
+	// seq_parameter_set_id
+	if _, err := r.ue(); err != nil {
+		return info, err
+	}
+
+	switch info.profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc, err := r.ue()
+		if err != nil {
+			return info, err
+		}
+		info.chromaFormatIdc = chromaFormatIdc
+		if chromaFormatIdc == 3 {
+			if info.separateColourPlane, err = r.flag(); err != nil {
+				return info, err
+			}
+		}
+		// bit_depth_luma_minus8, bit_depth_chroma_minus8
+		for i := 0; i < 2; i++ {
+			if _, err := r.ue(); err != nil {
+				return info, err
+			}
+		}
+		// qpprime_y_zero_transform_bypass_flag
+		if _, err := r.bit(); err != nil {
+			return info, err
+		}
+		scalingMatrixPresent, err := r.flag()
+		if err != nil {
+			return info, err
+		}
+		if scalingMatrixPresent {
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.flag()
+				if err != nil {
+					return info, err
+				}
+				if !present {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := r.skipScalingList(size); err != nil {
+					return info, err
+				}
+			}
+		}
+	}
+
+	log2MaxFrameNumMinus4, err := r.ue()
+	if err != nil {
+		return info, err
+	}
+	// frame_num is read with this many bits, the specification allows 4 to 16
+	if log2MaxFrameNumMinus4 > 12 {
+		return info, fmt.Errorf("sps has log2_max_frame_num_minus4 %d, above 12", log2MaxFrameNumMinus4)
+	}
+	info.log2MaxFrameNum = log2MaxFrameNumMinus4 + 4
+
+	picOrderCntType, err := r.ue()
+	if err != nil {
+		return info, err
+	}
+	switch picOrderCntType {
+	case 0:
+		log2MaxPicOrderCntLsbMinus4, err := r.ue()
+		if err != nil {
+			return info, err
+		}
+		if log2MaxPicOrderCntLsbMinus4 > 12 {
+			return info, fmt.Errorf("sps has log2_max_pic_order_cnt_lsb_minus4 %d, above 12", log2MaxPicOrderCntLsbMinus4)
+		}
+	case 1:
+		// delta_pic_order_always_zero_flag
+		if _, err := r.bit(); err != nil {
+			return info, err
+		}
+		// offset_for_non_ref_pic, offset_for_top_to_bottom_field
+		for i := 0; i < 2; i++ {
+			if _, err := r.se(); err != nil {
+				return info, err
+			}
+		}
+		cycle, err := r.ue()
+		if err != nil {
+			return info, err
+		}
+		if cycle > 255 {
+			return info, fmt.Errorf("sps has num_ref_frames_in_pic_order_cnt_cycle %d, above 255", cycle)
+		}
+		for i := uint(0); i < cycle; i++ {
+			if _, err := r.se(); err != nil {
+				return info, err
+			}
+		}
+	}
+
+	// max_num_ref_frames
+	if _, err := r.ue(); err != nil {
+		return info, err
+	}
+	// gaps_in_frame_num_value_allowed_flag
+	if _, err := r.bit(); err != nil {
+		return info, err
+	}
+
+	widthInMbsMinus1, err := r.ue()
+	if err != nil {
+		return info, err
+	}
+	heightInMapUnitsMinus1, err := r.ue()
+	if err != nil {
+		return info, err
+	}
+	if info.frameMbsOnlyFlag, err = r.flag(); err != nil {
+		return info, err
+	}
+	if !info.frameMbsOnlyFlag {
+		// mb_adaptive_frame_field_flag
+		if _, err := r.bit(); err != nil {
+			return info, err
+		}
+	}
+	// direct_8x8_inference_flag
+	if _, err := r.bit(); err != nil {
+		return info, err
+	}
+
+	frameHeightFactor := uint(2)
+	if info.frameMbsOnlyFlag {
+		frameHeightFactor = 1
+	}
+	info.width = (widthInMbsMinus1 + 1) * 16
+	info.height = frameHeightFactor * (heightInMapUnitsMinus1 + 1) * 16
+
+	cropping, err := r.flag()
+	if err != nil {
+		return info, err
+	}
+	if cropping {
+		crop := [4]uint{}
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return info, err
+			}
+		}
+		cropUnitX, cropUnitY := uint(1), frameHeightFactor
+		if !info.separateColourPlane {
+			switch info.chromaFormatIdc {
+			case 1:
+				cropUnitX, cropUnitY = 2, 2*frameHeightFactor
+			case 2:
+				cropUnitX = 2
+			}
+		}
+		// The offsets are not limited by their coding, an SPS cropping more than the frame is invalid
+		if cropUnitX*(crop[0]+crop[1]) >= info.width || cropUnitY*(crop[2]+crop[3]) >= info.height {
+			return info, fmt.Errorf("sps crops %d+%d by %d+%d of the %dx%d frame", crop[0], crop[1], crop[2], crop[3], info.width, info.height)
+		}
+		info.width -= cropUnitX * (crop[0] + crop[1])
+		info.height -= cropUnitY * (crop[2] + crop[3])
+	}
+
+	vuiPresent, err := r.flag()
+	if err != nil || !vuiPresent {
+		return info, err
+	}
+	info.frameRate, err = parseVuiFrameRate(r)
+	return info, err
+}
+
+// parseVuiFrameRate reads the start of the VUI parameters up to the timing information
+func parseVuiFrameRate(r *bitReader) (float64, error) {
+	if present, err := r.flag(); err != nil {
+		return 0, err
+	} else if present {
+		aspectRatioIdc, err := r.bits(8)
+		if err != nil {
+			return 0, err
+		}
+		if aspectRatioIdc == 255 {
+			// sar_width, sar_height
+			if _, err := r.bits(32); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if present, err := r.flag(); err != nil {
+		return 0, err
+	} else if present {
+		// overscan_appropriate_flag
+		if _, err := r.bit(); err != nil {
+			return 0, err
+		}
+	}
+	if present, err := r.flag(); err != nil {
+		return 0, err
+	} else if present {
+		// video_format, video_full_range_flag
+		if _, err := r.bits(4); err != nil {
+			return 0, err
+		}
+		colourDescription, err := r.flag()
+		if err != nil {
+			return 0, err
+		}
+		if colourDescription {
+			// colour_primaries, transfer_characteristics, matrix_coefficients
+			if _, err := r.bits(24); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if present, err := r.flag(); err != nil {
+		return 0, err
+	} else if present {
+		// chroma_sample_loc_type_top_field, chroma_sample_loc_type_bottom_field
+		for i := 0; i < 2; i++ {
+			if _, err := r.ue(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	timingInfo, err := r.flag()
+	if err != nil || !timingInfo {
+		return 0, err
+	}
+	numUnitsInTick, err := r.bits(32)
+	if err != nil {
+		return 0, err
+	}
+	timeScale, err := r.bits(32)
+	if err != nil {
+		return 0, err
+	}
+	if numUnitsInTick == 0 {
+		return 0, nil
+	}
+	return float64(timeScale) / float64(2*numUnitsInTick), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// bitWriter writes the bit oriented fields of a H264 RBSP, to craft the NAL units the parsers are tested with
+type bitWriter struct {
+	data []byte
+	bits uint
+}
+
+func (w *bitWriter) bit(b uint) {
+	if w.bits%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	if b != 0 {
+		w.data[len(w.data)-1] |= 0x80 >> (w.bits % 8)
+	}
+	w.bits++
+}
+
+func (w *bitWriter) write(value uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit(value >> uint(i) & 1)
+	}
+}
+
+func (w *bitWriter) ue(value uint) {
+	length := 0
+	for v := value + 1; v > 1; v >>= 1 {
+		length++
+	}
+	w.write(0, length)
+	w.write(value+1, length+1)
+}
+
+// rbsp returns what was written with the stop bit
+func (w *bitWriter) rbsp() []byte {
+	w.bit(1)
+	return w.data
+}
+
+// testSps is the fields of a baseline SPS that craftSps writes
+type testSps struct {
+	log2MaxFrameNumMinus4, log2MaxPocLsbMinus4 uint
+	widthInMbs, heightInMbs                    uint
+	crop                                       []uint
+}
+
+// craftSps returns a baseline profile SPS NAL unit, without a start code
+func craftSps(sps testSps) []byte {
+	w := &bitWriter{}
+	// seq_parameter_set_id
+	w.ue(0)
+	w.ue(sps.log2MaxFrameNumMinus4)
+	// pic_order_cnt_type 0
+	w.ue(0)
+	w.ue(sps.log2MaxPocLsbMinus4)
+	// max_num_ref_frames, gaps_in_frame_num_value_allowed_flag
+	w.ue(1)
+	w.bit(0)
+	w.ue(sps.widthInMbs - 1)
+	w.ue(sps.heightInMbs - 1)
+	// frame_mbs_only_flag, direct_8x8_inference_flag
+	w.bit(1)
+	w.bit(1)
+	if sps.crop != nil {
+		w.bit(1)
+		for _, offset := range sps.crop {
+			w.ue(offset)
+		}
+	} else {
+		w.bit(0)
+	}
+	// vui_parameters_present_flag
+	w.bit(0)
+	return append([]byte{0x67, 66, 0xc0, 31}, w.rbsp()...)
+}
+
+func mustHex(t *testing.T, value string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseSps(t *testing.T) {
+	tests := []struct {
+		name            string
+		nal             []byte
+		width, height   uint
+		frameRate       float64
+		profile, level  uint8
+		log2MaxFrameNum uint
+	}{
+		{
+			name:            "x264 high profile 1080p with timing",
+			nal:             mustHex(t, "67640028acd940780227e5c044000003000400000300f03c60c658"),
+			width:           1920,
+			height:          1080,
+			frameRate:       30,
+			profile:         100,
+			level:           40,
+			log2MaxFrameNum: 4,
+		},
+		{
+			name:            "baseline 640x480",
+			nal:             craftSps(testSps{widthInMbs: 40, heightInMbs: 30, log2MaxFrameNumMinus4: 12, log2MaxPocLsbMinus4: 12}),
+			width:           640,
+			height:          480,
+			profile:         66,
+			level:           31,
+			log2MaxFrameNum: 16,
+		},
+		{
+			name:            "cropped to 1080 lines",
+			nal:             craftSps(testSps{widthInMbs: 120, heightInMbs: 68, crop: []uint{0, 0, 0, 4}}),
+			width:           1920,
+			height:          1080,
+			profile:         66,
+			level:           31,
+			log2MaxFrameNum: 4,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := parseSps(test.nal)
+			if err != nil {
+				t.Fatalf("parseSps: %v", err)
+			}
+			if info.width != test.width || info.height != test.height {
+				t.Errorf("got %dx%d, want %dx%d", info.width, info.height, test.width, test.height)
+			}
+			if info.frameRate != test.frameRate {
+				t.Errorf("got %v fps, want %v", info.frameRate, test.frameRate)
+			}
+			if info.profileIdc != test.profile || info.levelIdc != test.level {
+				t.Errorf("got profile %d level %d, want %d and %d", info.profileIdc, info.levelIdc, test.profile, test.level)
+			}
+			if info.log2MaxFrameNum != test.log2MaxFrameNum {
+				t.Errorf("got log2_max_frame_num %d, want %d", info.log2MaxFrameNum, test.log2MaxFrameNum)
+			}
+		})
+	}
+}
+
+func TestParseSpsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		nal  []byte
+	}{
+		{"empty", []byte{}},
+		{"header only", []byte{0x67}},
+		{"emulation prevention leaves 2 bytes", []byte{0x67, 0, 0, 3}},
+		{"cut off after the level", []byte{0x67, 66, 0xc0, 31}},
+		{"crop wider than the frame", craftSps(testSps{widthInMbs: 1, heightInMbs: 1, crop: []uint{8, 1, 0, 0}})},
+		{"crop taller than the frame", craftSps(testSps{widthInMbs: 1, heightInMbs: 1, crop: []uint{0, 0, 100, 0}})},
+		{"log2_max_frame_num above 16", craftSps(testSps{widthInMbs: 1, heightInMbs: 1, log2MaxFrameNumMinus4: 60})},
+		{"log2_max_pic_order_cnt_lsb above 16", craftSps(testSps{widthInMbs: 1, heightInMbs: 1, log2MaxPocLsbMinus4: 13})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if info, err := parseSps(test.nal); err == nil {
+				t.Errorf("parseSps(%x) = %v, want an error", test.nal, info)
+			}
+		})
+	}
+}
+
+// TestParseSpsPrefixes parses every prefix of a valid SPS, none may panic
+func TestParseSpsPrefixes(t *testing.T) {
+	nal := mustHex(t, "67640028acd940780227e5c044000003000400000300f03c60c658")
+	for i := range nal {
+		parseSps(nal[:i])
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+// iceTransportStatsId is the id Pion gives the stats of the ICE transport, the only one of a connection
+const iceTransportStatsId = "iceTransport"
+
+// statsDictionary is a stats object of Pion as the W3C RTCStats dictionary of its type, the members named as in the spec
+type statsDictionary map[string]interface{}
+
+func newStatsDictionary(stats webrtc.Stats) (statsDictionary, error) {
+	encoded, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+	dictionary := statsDictionary{}
+	if err := json.Unmarshal(encoded, &dictionary); err != nil {
+		return nil, err
+	}
+	return dictionary, nil
+}
+
+// w3cStatsReport converts the report of GetStats to the JSON of an RTCStatsReport, an object of the stats keyed by
+// their id like JSON.stringify(Object.fromEntries(await pc.getStats())) gives. Pion encodes its enums as numbers,
+// those are replaced by the strings of the spec, and the members it leaves empty but we know are filled in.
+func w3cStatsReport(s *session) (map[string]statsDictionary, error) {
+	report := map[string]statsDictionary{}
+	transports := []statsDictionary{}
+	selectedPairId := ""
+	dtlsTransport := s.videoSender.Transport()
+	for id, stats := range s.peerConnection.GetStats() {
+		dictionary, err := newStatsDictionary(stats)
+		if err != nil {
+			return nil, err
+		}
+		// Pion leaves out the transport of the stats, all media and data of the connection is bundled on the one ICE transport
+		if transportId, ok := dictionary["transportId"]; ok && transportId == "" {
+			dictionary["transportId"] = iceTransportStatsId
+		}
+		switch stats := stats.(type) {
+		case webrtc.ICECandidateStats:
+			// networkType is the kind of network interface in the spec, like "wifi", Pion has its protocol in it
+			delete(dictionary, "networkType")
+			dictionary["address"] = stats.IP
+			dictionary["candidateType"] = stats.CandidateType.String()
+			dictionary["transportId"] = iceTransportStatsId
+		case webrtc.ICECandidatePairStats:
+			dictionary["transportId"] = iceTransportStatsId
+			if stats.Nominated && stats.State == webrtc.StatsICECandidatePairStateSucceeded {
+				selectedPairId = id
+			}
+		case webrtc.CertificateStats:
+			// Pion sets the name of the issuer, it is the id of the stats of the issuer certificate in the spec.
+			// Our certificate is self-signed, it has none.
+			delete(dictionary, "issuerCertificateId")
+		case webrtc.TransportStats:
+			// Of the ICE and the SCTP transport, both run over the DTLS transport of the connection
+			dictionary["dtlsState"] = dtlsTransport.State().String()
+			transports = append(transports, dictionary)
+		}
+		// Pion sets the strings it does not know to "" and the times that did not happen yet to before 1970,
+		// which the spec leaves out, like the codecType of a codec and the lastPacketSentTimestamp of an unused candidate pair
+		for member, value := range dictionary {
+			if timestamp, ok := value.(float64); value == "" || (ok && timestamp < 0 && strings.HasSuffix(member, "Timestamp")) {
+				delete(dictionary, member)
+			}
+		}
+		report[id] = dictionary
+	}
+	for _, transport := range transports {
+		// The role, "controlling" or "controlled", is "unknown" until ICE started, which the spec has no value for
+		if role := dtlsTransport.ICETransport().Role(); role == webrtc.ICERoleControlling || role == webrtc.ICERoleControlled {
+			transport["iceRole"] = role.String()
+		} else {
+			delete(transport, "iceRole")
+		}
+		if selectedPairId != "" {
+			transport["selectedCandidatePairId"] = selectedPairId
+		}
+	}
+	return report, nil
+}
+
+// handleStats answers the stats of the connection in the W3C WebRTC stats format, for tools that read getStats()
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	s := sessions.Get(id)
+	if s == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	report, err := w3cStatsReport(s)
+	if err != nil {
+		http.Error(w, "Error1: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		s.logger.Printf("cannot write the stats: %v\n", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	tcpPort = flag.Int("tcp-port", 0, "also gather ICE-TCP candidates on this TCP port, for clients on networks that block UDP. 0 disables ICE-TCP")
+)
+
+// iceTCPMux is shared by all PeerConnections when ICE-TCP is enabled
+var iceTCPMux ice.TCPMux
+
+// setupTCPMux listens on -tcp-port for ICE-TCP, when it is set
+func setupTCPMux() error {
+	if *tcpPort == 0 {
+		return nil
+	}
+	if *tcpPort < 0 || *tcpPort > 65535 {
+		return fmt.Errorf("invalid -tcp-port")
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: *tcpPort})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Serving ICE-TCP on TCP port %d\n", listener.Addr().(*net.TCPAddr).Port)
+	iceTCPMux = webrtc.NewICETCPMux(logging.NewDefaultLoggerFactory().NewLogger("ice"), listener, 8)
+	return nil
+}
+
+// iceNetworkTypes returns the network types to gather candidates for, nil for Pion's default of UDP only
+func iceNetworkTypes() []webrtc.NetworkType {
+	if iceTCPMux == nil {
+		return nil
+	}
+	return []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	thumbnailInterval = flag.Duration("thumbnail-interval", 5*time.Second, "how long GET /thumbnail serves the same JPEG before decoding the latest keyframe sent again")
+)
+
+// thumbnailTimeout is how long the ffmpeg decoding a keyframe into a JPEG may take
+const thumbnailTimeout = 5 * time.Second
+
+// thumbnails keeps the last H264 keyframe sent to any connection and the JPEG decoded from it for GET /thumbnail
+type thumbnails struct {
+	lock     sync.Mutex
+	keyframe []byte
+	sentAt   time.Time
+
+	// decodeLock makes concurrent requests wait for a single ffmpeg
+	decodeLock sync.Mutex
+	jpeg       []byte
+	decodedAt  time.Time
+}
+
+var thumbnail = &thumbnails{}
+
+// sent records the annex B picture sent to a connection when it is a keyframe.
+// The parameter sets announced in the answer are added, the decoder needs them.
+func (t *thumbnails) sent(picture []byte) {
+	if slice := firstSlice(picture); slice == nil || slice[0]&0x1f != 5 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.keyframe = append(append([]byte{}, announcedParameterSets...), picture...)
+	t.sentAt = time.Now()
+}
+
+// latest returns the last keyframe and when it was sent, nil when none was sent yet
+func (t *thumbnails) latest() ([]byte, time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.keyframe, t.sentAt
+}
+
+// decode returns the JPEG of the last keyframe, decoded again when the one decoded before is older than -thumbnail-interval
+func (t *thumbnails) decode() ([]byte, time.Time, error) {
+	t.decodeLock.Lock()
+	defer t.decodeLock.Unlock()
+	if t.jpeg != nil && time.Since(t.decodedAt) < *thumbnailInterval {
+		return t.jpeg, t.decodedAt, nil
+	}
+	keyframe, _ := t.latest()
+	if keyframe == nil {
+		return nil, time.Time{}, errNoKeyframe
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), thumbnailTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffmpeg", withLogLevel([]string{"-f", "h264", "-i", "pipe:0", "-frames:v", "1", "-c:v", "mjpeg", "-f", "image2", "pipe:1"})...)
+	cmd.Stdin = bytes.NewReader(keyframe)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	jpeg, err := cmd.Output()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if len(jpeg) == 0 {
+		return nil, time.Time{}, fmt.Errorf("ffmpeg decoded no picture: %s", strings.TrimSpace(stderr.String()))
+	}
+	t.jpeg = jpeg
+	t.decodedAt = time.Now()
+	return t.jpeg, t.decodedAt, nil
+}
+
+// errNoKeyframe is returned by decode before a keyframe was sent to any connection
+var errNoKeyframe = errors.New("no keyframe was sent yet")
+
+// handleThumbnail answers a JPEG of the last keyframe sent, for a preview of the stream without a WebRTC connection.
+// Only the H264 sent to connections is decoded, so there is no thumbnail before the first client received a keyframe.
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	jpeg, decodedAt, err := thumbnail.decode()
+	if err == errNoKeyframe {
+		http.Error(w, "No thumbnail, no H264 keyframe was sent to a client yet", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Cannot decode the thumbnail: %v\n", err)
+		http.Error(w, "Cannot decode the thumbnail", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Last-Modified", decodedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(*thumbnailInterval/time.Second)))
+	w.Write(jpeg)
+}
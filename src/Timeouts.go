@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	readHeaderTimeout = flag.Duration("read-header-timeout", 5*time.Second, "how long a client may take to send the headers of a request, 0 for no limit")
+	readTimeout       = flag.Duration("read-timeout", 10*time.Second, "how long a client may take to send a whole request including its body, like an offer, 0 for no limit")
+	requestTimeout    = flag.Duration("request-timeout", 30*time.Second, "how long handling a request may take, including gathering the ICE candidates of the answer, before it fails with 408 Request Timeout. 0 for no limit")
+)
+
+// errRequestCancelled is returned by setupConnection when the request was cancelled before the answer was ready
+var errRequestCancelled = errors.New("the request was cancelled")
+
+// withRequestTimeout cancels the context of requests taking longer than -request-timeout,
+// so slow clients cannot tie up a handler and the PeerConnection it is setting up
+func withRequestTimeout(handler http.Handler) http.Handler {
+	if *requestTimeout <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), *requestTimeout)
+		defer cancel()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// isTimeout reports whether err is caused by the client sending the request too slowly
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// bodyReadFailed answers a request whose body could not be read, with 408 Request Timeout when the client was too slow sending it
+func bodyReadFailed(w http.ResponseWriter, err error) {
+	if isTimeout(err) {
+		http.Error(w, "Request timeout", http.StatusRequestTimeout)
+		return
+	}
+	http.Error(w, "Error1: "+err.Error(), http.StatusInternalServerError)
+}
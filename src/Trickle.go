@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+// sdpFrag is a parsed application/trickle-ice-sdpfrag body (RFC 8840)
+type sdpFrag struct {
+	iceUfrag   string
+	candidates []webrtc.ICECandidateInit
+}
+
+// parseSdpFrag extracts the ICE credentials and candidates from a trickle-ice-sdpfrag body.
+// Candidates are associated with the mid and index of the media section they appear in.
+func parseSdpFrag(body string) (sdpFrag, error) {
+	frag := sdpFrag{}
+	mLineIndex := -1
+	mid := ""
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.iceUfrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "m="):
+			mLineIndex++
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			if mLineIndex < 0 {
+				return frag, errors.New("candidate outside of a media section")
+			}
+			candidateMid := mid
+			candidateMLineIndex := uint16(mLineIndex)
+			frag.candidates = append(frag.candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        &candidateMid,
+				SDPMLineIndex: &candidateMLineIndex,
+			})
+		}
+	}
+	return frag, nil
+}
+
+// sdpIceUfrag returns the first ice-ufrag attribute in a session description
+func sdpIceUfrag(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			return strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+	}
+	return ""
+}
+
+// offerTrickles reports whether the client trickles its ICE candidates: it supports trickle ICE (RFC 8838) and sent
+// its offer before gathering any. Such a client accepts an answer before our candidates were gathered as well, while a
+// client that waited for its own candidates may not look for ours after the answer, even when its offer has the option.
+func offerTrickles(offer string) bool {
+	trickle := false
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "a=candidate:") {
+			return false
+		}
+		if strings.HasPrefix(line, "a=ice-options:") {
+			for _, option := range strings.Fields(strings.TrimPrefix(line, "a=ice-options:")) {
+				if option == "trickle" {
+					trickle = true
+				}
+			}
+		}
+	}
+	return trickle
+}
+
+// withTrickleOption adds the session level a=ice-options:trickle to a description of ours, which pion leaves out.
+// This is applied to the SDP sent to the browser only, pion rejects a local description it did not generate.
+func withTrickleOption(description string) string {
+	lines := strings.Split(description, "\r\n")
+	for i, line := range lines {
+		// The attributes of the session follow its t= line
+		if strings.HasPrefix(line, "t=") {
+			lines = append(lines[:i+1], append([]string{"a=ice-options:trickle"}, lines[i+1:]...)...)
+			break
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// localCandidatesFrag returns the ICE credentials and the candidates of a description of ours as an
+// application/trickle-ice-sdpfrag body, ending every media section with a=end-of-candidates once gathering is complete
+func localCandidatesFrag(description string, complete bool) string {
+	credentials := []string{}
+	sections := []string{}
+	for _, line := range strings.Split(description, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:") || strings.HasPrefix(line, "a=ice-pwd:"):
+			if len(credentials) < 2 {
+				credentials = append(credentials, line)
+			}
+		case strings.HasPrefix(line, "m="):
+			if complete && len(sections) > 0 {
+				sections = append(sections, "a=end-of-candidates")
+			}
+			sections = append(sections, line)
+		case strings.HasPrefix(line, "a=mid:") || strings.HasPrefix(line, "a=candidate:"):
+			sections = append(sections, line)
+		}
+	}
+	if complete && len(sections) > 0 {
+		sections = append(sections, "a=end-of-candidates")
+	}
+	return strings.Join(append(credentials, sections...), "\r\n") + "\r\n"
+}
+
+// handleLocalCandidates answers GET /session/<id> with our ICE candidates, for clients that got a trickled answer.
+// It waits until all are gathered, so a single request gets them all, unless the request is cancelled or times out first.
+func handleLocalCandidates(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	s := sessions.Get(id)
+	if s == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	complete := false
+	select {
+	case <-s.gathered:
+		complete = true
+	case <-r.Context().Done():
+	}
+	description := s.localDescription()
+	if description == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	pruned := pruneRelayCandidates(s.logger, description.SDP)
+	if complete && !hasCandidates(pruned) {
+		s.logger.Printf("Gathered no ICE candidates, the host has no usable network interface\n")
+		http.Error(w, errNoIceCandidates.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
+	w.Write([]byte(localCandidatesFrag(pruned, complete)))
+}
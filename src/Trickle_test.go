@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSdpFrag(t *testing.T) {
+	type candidate struct {
+		candidate  string
+		mid        string
+		mLineIndex uint16
+	}
+	tests := []struct {
+		name       string
+		body       string
+		iceUfrag   string
+		candidates []candidate
+	}{
+		{
+			name: "RFC 8840 example",
+			body: "a=ice-ufrag:EsAw\r\na=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+				"m=audio 9 RTP/AVP 0\r\na=mid:1\r\n" +
+				"a=candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host\r\n" +
+				"a=end-of-candidates\r\n",
+			iceUfrag:   "EsAw",
+			candidates: []candidate{{"candidate:1 1 UDP 2130706431 198.51.100.1 39132 typ host", "1", 0}},
+		},
+		{
+			name: "candidates of two media sections with bare newlines",
+			body: "a=ice-ufrag:abcd\n" +
+				"m=video 9 UDP/TLS/RTP/SAVPF 96\na=mid:0\n" +
+				"a=candidate:2 1 udp 2130706431 192.0.2.1 5000 typ host\n" +
+				"a=candidate:3 1 udp 1694498815 203.0.113.1 6000 typ srflx raddr 192.0.2.1 rport 5000\n" +
+				"m=audio 9 UDP/TLS/RTP/SAVPF 111\n" +
+				"a=candidate:4 1 udp 2130706431 192.0.2.1 5001 typ host\n",
+			iceUfrag: "abcd",
+			candidates: []candidate{
+				{"candidate:2 1 udp 2130706431 192.0.2.1 5000 typ host", "0", 0},
+				{"candidate:3 1 udp 1694498815 203.0.113.1 6000 typ srflx raddr 192.0.2.1 rport 5000", "0", 0},
+				// The mid of the first section does not carry over to the second
+				{"candidate:4 1 udp 2130706431 192.0.2.1 5001 typ host", "", 1},
+			},
+		},
+		{
+			name:     "end of candidates only",
+			body:     "a=ice-ufrag:abcd\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:0\r\na=end-of-candidates\r\n",
+			iceUfrag: "abcd",
+		},
+		{
+			name:     "ICE restart without candidates",
+			body:     "a=ice-ufrag:new\r\na=ice-pwd:newpassword0123456789012\r\n",
+			iceUfrag: "new",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frag, err := parseSdpFrag(test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frag.iceUfrag != test.iceUfrag {
+				t.Errorf("got ice-ufrag %q, want %q", frag.iceUfrag, test.iceUfrag)
+			}
+			if len(frag.candidates) != len(test.candidates) {
+				t.Fatalf("got %d candidates, want %d", len(frag.candidates), len(test.candidates))
+			}
+			for i, want := range test.candidates {
+				got := frag.candidates[i]
+				if got.Candidate != want.candidate || *got.SDPMid != want.mid || *got.SDPMLineIndex != want.mLineIndex {
+					t.Errorf("candidate %d is %q of mid %q index %d, want %q of mid %q index %d", i, got.Candidate, *got.SDPMid, *got.SDPMLineIndex, want.candidate, want.mid, want.mLineIndex)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSdpFragCandidateOutsideMediaSection(t *testing.T) {
+	if _, err := parseSdpFrag("a=ice-ufrag:abcd\r\na=candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host\r\n"); err == nil {
+		t.Error("a candidate before the first m= line was accepted")
+	}
+}
+
+func TestSdpIceUfrag(t *testing.T) {
+	offer := "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=ice-ufrag:first\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=ice-ufrag:second\r\n"
+	if got := sdpIceUfrag(offer); got != "first" {
+		t.Errorf("sdpIceUfrag = %q, want first", got)
+	}
+	if got := sdpIceUfrag("v=0\r\n"); got != "" {
+		t.Errorf("sdpIceUfrag of a description without credentials = %q", got)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	turnCheck = flag.Bool("turn-check", false, "at startup, connect to every TURN server of -ice-server, complete the TLS handshake of turns: servers and allocate a relay with the credentials, logging clearly which are unreachable. The server starts either way")
+)
+
+// turnCheckTimeout is how long checking a single TURN server may take
+const turnCheckTimeout = 10 * time.Second
+
+// validateTurnServers checks what Pion would only fail on when gathering, without telling: TURN needs credentials.
+// A turns: server on an IP address must have a certificate for that IP.
+func validateTurnServers() error {
+	for _, server := range iceServers.servers {
+		for _, rawURL := range server.URLs {
+			url, err := ice.ParseURL(rawURL)
+			if err != nil || (url.Scheme != ice.SchemeTypeTURN && url.Scheme != ice.SchemeTypeTURNS) {
+				continue
+			}
+			if credential, _ := server.Credential.(string); server.Username == "" || credential == "" {
+				return fmt.Errorf("-ice-server %s: a TURN server needs a username and credential", rawURL)
+			}
+			if url.Scheme == ice.SchemeTypeTURNS && net.ParseIP(url.Host) != nil {
+				fmt.Printf("Warning: -ice-server %s is TURN over TLS on an IP address, its certificate must be valid for that address\n", rawURL)
+			}
+		}
+	}
+	return nil
+}
+
+// turnTransport describes how the relay of a TURN URL is reached, like "TLS over TCP"
+func turnTransport(url *ice.URL) string {
+	switch {
+	case url.Scheme == ice.SchemeTypeTURNS && url.Proto == ice.ProtoTypeTCP:
+		return "TLS over TCP"
+	case url.Scheme == ice.SchemeTypeTURNS:
+		return "DTLS over UDP"
+	case url.Proto == ice.ProtoTypeTCP:
+		return "TCP"
+	}
+	return "UDP"
+}
+
+// packetConn lets the TURN client use a DTLS connection, which is connected to the TURN server
+type packetConn struct {
+	net.Conn
+}
+
+func (c packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.RemoteAddr(), err
+}
+
+func (c packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+// dialTurnServer connects to the TURN server the way Pion does when gathering, with the TLS or DTLS handshake of turns: done
+func dialTurnServer(ctx context.Context, url *ice.URL) (net.PacketConn, error) {
+	address := net.JoinHostPort(url.Host, strconv.Itoa(url.Port))
+	dialer := &net.Dialer{}
+	switch {
+	case url.Scheme == ice.SchemeTypeTURNS && url.Proto == ice.ProtoTypeTCP:
+		conn, err := dialer.DialContext(ctx, "tcp4", address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: url.Host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake: %v", err)
+		}
+		return turn.NewSTUNConn(tlsConn), nil
+	case url.Scheme == ice.SchemeTypeTURNS:
+		udpAddr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			return nil, err
+		}
+		dtlsConn, err := dtls.DialWithContext(ctx, "udp4", udpAddr, &dtls.Config{ServerName: url.Host})
+		if err != nil {
+			return nil, fmt.Errorf("DTLS handshake: %v", err)
+		}
+		return packetConn{dtlsConn}, nil
+	case url.Proto == ice.ProtoTypeTCP:
+		conn, err := dialer.DialContext(ctx, "tcp4", address)
+		if err != nil {
+			return nil, err
+		}
+		return turn.NewSTUNConn(conn), nil
+	}
+	return net.ListenPacket("udp4", "0.0.0.0:0")
+}
+
+// checkTurnServer connects to the TURN server and allocates a relay on it, to find out whether clients can be relayed through it
+func checkTurnServer(server webrtc.ICEServer, url *ice.URL) error {
+	ctx, cancel := context.WithTimeout(context.Background(), turnCheckTimeout)
+	defer cancel()
+	conn, err := dialTurnServer(ctx, url)
+	if err != nil {
+		return err
+	}
+	// Closing the connection ends an allocation the server does not answer
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer conn.Close()
+
+	credential, _ := server.Credential.(string)
+	client, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: net.JoinHostPort(url.Host, strconv.Itoa(url.Port)),
+		Conn:           conn,
+		Username:       server.Username,
+		Password:       credential,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		return err
+	}
+	relay, err := client.Allocate()
+	if ctx.Err() != nil {
+		return fmt.Errorf("no allocation within %v", turnCheckTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("allocation: %v", err)
+	}
+	relay.Close()
+	return nil
+}
+
+// checkTurnServers checks every TURN server in the background, so a slow one does not hold up the startup
+func checkTurnServers() {
+	for _, server := range iceServers.servers {
+		for _, rawURL := range server.URLs {
+			url, err := ice.ParseURL(rawURL)
+			if err != nil || (url.Scheme != ice.SchemeTypeTURN && url.Scheme != ice.SchemeTypeTURNS) {
+				continue
+			}
+			go func(server webrtc.ICEServer, rawURL string, url *ice.URL) {
+				if err := checkTurnServer(server, url); err != nil {
+					fmt.Printf("Warning: TURN server %s is unreachable over %s: %v. Clients that can only be reached through it cannot connect\n", rawURL, turnTransport(url), err)
+					return
+				}
+				fmt.Printf("TURN server %s allocated a relay over %s\n", rawURL, turnTransport(url))
+			}(server, rawURL, url)
+		}
+	}
+}
+
+// logMissingRelayCandidates logs the TURN servers none of the gathered candidates of the description is relayed on,
+// Pion does not tell which ones it could not allocate a relay on. Like turnServersByIP, it assumes the relay is on the address of the server.
+func logMissingRelayCandidates(logger connectionLogger, description string) {
+	relayed := map[string]bool{}
+	for _, line := range strings.Split(description, "\r\n") {
+		if address, ok := relayCandidateAddress(line); ok {
+			relayed[address] = true
+		}
+	}
+	for _, server := range gatheringIceServers() {
+		for _, rawURL := range server.URLs {
+			url, err := ice.ParseURL(rawURL)
+			if err != nil || (url.Scheme != ice.SchemeTypeTURN && url.Scheme != ice.SchemeTypeTURNS) {
+				continue
+			}
+			ips, err := net.LookupIP(url.Host)
+			if err != nil {
+				logger.Printf("Warning: gathered no relayed candidate on TURN server %s, its host cannot be resolved: %v\n", rawURL, err)
+				continue
+			}
+			found := false
+			for _, ip := range ips {
+				found = found || relayed[ip.String()]
+			}
+			if !found {
+				logger.Printf("Warning: gathered no relayed candidate on TURN server %s over %s, it is unreachable or refused the credentials\n", rawURL, turnTransport(url))
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	udpPort        = flag.Int("udp-port", 0, "serve all connections from this single UDP port, 0 uses a new port per connection")
+	udpReadBuffer  = flag.Int("udp-read-buffer", 0, "kernel receive buffer size in bytes for the UDP socket, implies a single UDP port")
+	udpWriteBuffer = flag.Int("udp-write-buffer", 0, "kernel send buffer size in bytes for the UDP socket, implies a single UDP port")
+)
+
+// iceUDPMux is shared by all PeerConnections when a single UDP port is used
+var iceUDPMux ice.UDPMux
+
+// setupUDPMux opens the shared UDP socket when -udp-port or any of the buffer sizes is set
+func setupUDPMux() error {
+	if *udpPort == 0 && *udpReadBuffer == 0 && *udpWriteBuffer == 0 {
+		return nil
+	}
+	if *udpPort < 0 || *udpPort > 65535 || *udpReadBuffer < 0 || *udpWriteBuffer < 0 {
+		return fmt.Errorf("invalid -udp-port or UDP buffer size")
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: *udpPort})
+	if err != nil {
+		return err
+	}
+	if *udpReadBuffer > 0 {
+		if err := udpConn.SetReadBuffer(*udpReadBuffer); err != nil {
+			return err
+		}
+	}
+	if *udpWriteBuffer > 0 {
+		if err := udpConn.SetWriteBuffer(*udpWriteBuffer); err != nil {
+			return err
+		}
+	}
+
+	readBuffer, writeBuffer, err := socketBufferSizes(udpConn)
+	if err != nil {
+		fmt.Printf("Cannot read back the UDP buffer sizes: %v\n", err)
+	} else {
+		if readBuffer < *udpReadBuffer {
+			fmt.Printf("Warning: the OS limited the UDP receive buffer to %d bytes instead of %d (see net.core.rmem_max on Linux)\n", readBuffer, *udpReadBuffer)
+		}
+		if writeBuffer < *udpWriteBuffer {
+			fmt.Printf("Warning: the OS limited the UDP send buffer to %d bytes instead of %d (see net.core.wmem_max on Linux)\n", writeBuffer, *udpWriteBuffer)
+		}
+	}
+
+	fmt.Printf("Serving ICE on UDP port %d\n", udpConn.LocalAddr().(*net.UDPAddr).Port)
+	iceUDPMux = webrtc.NewICEUDPMux(logging.NewDefaultLoggerFactory().NewLogger("ice"), udpConn)
+	return nil
+}
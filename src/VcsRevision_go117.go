@@ -0,0 +1,11 @@
+//go:build !go1.18
+// +build !go1.18
+
+package main
+
+import "runtime/debug"
+
+// vcsRevision returns "", go versions before 1.18 don't record the commit in the binary
+func vcsRevision(buildInfo *debug.BuildInfo) string {
+	return ""
+}
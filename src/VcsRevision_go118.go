@@ -0,0 +1,16 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import "runtime/debug"
+
+// vcsRevision returns the commit the binary was built from, as recorded by the go command
+func vcsRevision(buildInfo *debug.BuildInfo) string {
+	for _, setting := range buildInfo.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
+}
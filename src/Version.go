@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// version and gitCommit can be set at build time, for example
+// go build -ldflags "-X main.version=1.2.0 -X main.gitCommit=$(git rev-parse HEAD)"
+var (
+	version   = ""
+	gitCommit = ""
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	Go        string `json:"go"`
+	Pion      string `json:"pion"`
+	Ffmpeg    string `json:"ffmpeg"`
+}
+
+var (
+	ffmpegVersionOnce sync.Once
+	ffmpegVersionLine string
+)
+
+// ffmpegVersion returns the first line of ffmpeg -version, it is only looked up once
+func ffmpegVersion() string {
+	ffmpegVersionOnce.Do(func() {
+		output, err := exec.Command("ffmpeg", "-version").Output()
+		if err != nil {
+			ffmpegVersionLine = "unavailable: " + err.Error()
+			return
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		if scanner.Scan() {
+			ffmpegVersionLine = scanner.Text()
+		}
+	})
+	return ffmpegVersionLine
+}
+
+func buildVersionInfo() versionInfo {
+	info := versionInfo{Version: version, GitCommit: gitCommit, Go: runtime.Version(), Ffmpeg: ffmpegVersion()}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = buildInfo.Main.Version
+		}
+		if info.GitCommit == "" {
+			info.GitCommit = vcsRevision(buildInfo)
+		}
+		for _, dep := range buildInfo.Deps {
+			if dep.Path == "github.com/pion/webrtc/v3" {
+				info.Pion = dep.Version
+			}
+		}
+	}
+	return info
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(buildVersionInfo()); err != nil {
+		http.Error(w, "Error1: "+err.Error(), http.StatusInternalServerError)
+	}
+}
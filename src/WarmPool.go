@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+var (
+	warmPoolSize = flag.Int("warm-pool", 0, "keep this many ffmpeg processes started for every codec of -codecs, so a new connection does not wait for ffmpeg to start. 0 starts ffmpeg when a connection is made")
+)
+
+func validateWarmPool(size int) error {
+	if size < 0 {
+		return errors.New("must not be negative")
+	}
+	if size > 0 && !usesFfmpeg() {
+		return errors.New("only the ffmpeg source starts ffmpeg")
+	}
+	if size > 0 && *playlistFile != "" {
+		return errors.New("cannot be used with -playlist")
+	}
+	return nil
+}
+
+// ffmpegPool holds ffmpeg processes that were started ahead of the connections using them.
+//
+// A waiting process has produced its first output, so its encoder is initialized, and is then
+// paused by the pipe nobody reads from. The connection taking it reads from the first keyframe on.
+// Only the default source without a bitrate limit is kept warm, other arguments start a new ffmpeg.
+type ffmpegPool struct {
+	lock sync.Mutex
+	// ready are the waiting processes by the key of their arguments
+	ready map[string][]io.ReadCloser
+	// starting is the number of processes being started by key
+	starting map[string]int
+	closed   bool
+}
+
+var warmPool = &ffmpegPool{ready: map[string][]io.ReadCloser{}, starting: map[string]int{}}
+
+// warmPoolLogger prefixes the logs of processes that are not used by a connection yet
+var warmPoolLogger = connectionLogger{requestId: "warm-pool"}
+
+func warmPoolKey(args []string) string {
+	return strings.Join(args, "\x00")
+}
+
+// take returns a waiting process started with args and replaces it, or nil when there is none
+func (p *ffmpegPool) take(args []string) io.ReadCloser {
+	if *warmPoolSize == 0 {
+		return nil
+	}
+	key := warmPoolKey(args)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ready := p.ready[key]
+	if len(ready) == 0 {
+		return nil
+	}
+	pipe := ready[0]
+	p.ready[key] = ready[1:]
+	go p.refill()
+	return pipe
+}
+
+// refill starts processes until there are -warm-pool for every codec of the default source,
+// and stops the processes of a previous default source.
+func (p *ffmpegPool) refill() {
+	if *warmPoolSize == 0 {
+		return
+	}
+	wanted := map[string][]string{}
+	for _, codec := range preferredCodecs() {
+		args := sourceFfmpegArgs(codec, defaultSource(), 0)
+		wanted[warmPoolKey(args)] = args
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return
+	}
+	for key, ready := range p.ready {
+		if _, ok := wanted[key]; !ok {
+			for _, pipe := range ready {
+				pipe.Close()
+			}
+			delete(p.ready, key)
+		}
+	}
+	for key, args := range wanted {
+		for missing := *warmPoolSize - len(p.ready[key]) - p.starting[key]; missing > 0; missing-- {
+			p.starting[key]++
+			go p.start(key, args)
+		}
+	}
+}
+
+func (p *ffmpegPool) start(key string, args []string) {
+	pipe, err := startWarmFfmpeg(args)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.starting[key]--
+	if err != nil {
+		fmt.Printf("Cannot start a warm ffmpeg: %v\n", err)
+		return
+	}
+	if p.closed {
+		pipe.Close()
+		return
+	}
+	p.ready[key] = append(p.ready[key], pipe)
+}
+
+// startWarmFfmpeg starts ffmpeg and waits for its first output
+func startWarmFfmpeg(args []string) (io.ReadCloser, error) {
+	pipe, err := StartFfmpeg(warmPoolLogger, args...)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(pipe)
+	if _, err := buffered.Peek(1); err != nil {
+		pipe.Close()
+		return nil, fmt.Errorf("ffmpeg exited without output: %v", err)
+	}
+	return &bufferedReadCloser{Reader: buffered, Closer: pipe}, nil
+}
+
+// close stops all waiting processes, processes still starting are stopped once they started
+func (p *ffmpegPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	for key, ready := range p.ready {
+		for _, pipe := range ready {
+			pipe.Close()
+		}
+		delete(p.ready, key)
+	}
+}
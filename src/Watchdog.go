@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
+var (
+	sourceStallTimeout = flag.Duration("source-stall-timeout", 0, "when the video source of a connection produces no output for this long while sending, like an ffmpeg stuck on a dead RTSP input, handle it as dead. 0 waits forever")
+	sourceStallAction  = flag.String("source-stall-action", "close", "what to do when the source stalled: close the connection, or restart ffmpeg with the same arguments")
+)
+
+func validateSourceStall() error {
+	switch *sourceStallAction {
+	case "close":
+	case "restart":
+		if !usesFfmpeg() {
+			return errors.New("only the ffmpeg source can be restarted")
+		}
+	default:
+		return errors.New("unknown action, use close or restart")
+	}
+	return nil
+}
+
+// watchSource handles the source of the session as dead when the send loop read nothing from it for -source-stall-timeout.
+// A hanging ffmpeg neither writes nor exits, so the send loop would block on it forever and the client sees a frozen picture.
+func watchSource(s *session) {
+	interval := *sourceStallTimeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		idle := s.source.idle(now)
+		if idle < *sourceStallTimeout {
+			continue
+		}
+		s.logger.Printf("The video source produced nothing for %v\n", idle.Round(time.Millisecond))
+
+		if *sourceStallAction == "restart" {
+			// The restart gets a new window, the new ffmpeg may take a while to produce its first keyframe
+			s.source.active(now)
+			err := s.switchSource(s.playingSource())
+			if err == nil || err == errSourceClosed {
+				continue
+			}
+			s.logger.Printf("Cannot restart the stalled source: %v\n", err)
+		}
+
+		s.logger.Printf("Closing the connection, its video source stalled\n")
+		if err := s.peerConnection.Close(); err != nil {
+			s.logger.Printf("cannot close peerConnection: %v\n", err)
+		}
+		// Closing the pipe stops ffmpeg, so the blocked send loop returns
+		if err := s.source.Close(); err != nil {
+			s.logger.Printf("cannot close dataPipe: %v\n", err)
+		}
+		return
+	}
+}
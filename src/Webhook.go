@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	webhookURL     = flag.String("webhook-url", "", "URL to POST a JSON event to when a viewer connects, disconnects or its connection failed")
+	webhookRetries = flag.Int("webhook-retries", 3, "number of times a failed webhook is retried")
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookEvent is the JSON body posted to -webhook-url
+type webhookEvent struct {
+	Event        string    `json:"event"`
+	ConnectionId int       `json:"connectionId"`
+	RequestId    string    `json:"requestId"`
+	RemoteAddr   string    `json:"remoteAddr"`
+	Timestamp    time.Time `json:"timestamp"`
+	// ClientIp is the address of the client, which differs from RemoteAddr behind -trusted-proxies
+	ClientIp  string `json:"clientIp"`
+	UserAgent string `json:"userAgent,omitempty"`
+	// Reason tells why the connection failed, only set for "failed", or why the process died for "server_shutdown"
+	Reason string `json:"reason,omitempty"`
+	// ConnectionIds are the connections that were open when the process died, only set for "server_shutdown"
+	ConnectionIds []int `json:"connectionIds,omitempty"`
+	// BytesSent and DurationSeconds are the data usage of the connection, only set for "disconnected"
+	BytesSent       uint64  `json:"bytesSent,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	// TimeToFirstFrameSeconds is the time from receiving the offer to sending the first frame, only set for "disconnected"
+	TimeToFirstFrameSeconds float64 `json:"timeToFirstFrameSeconds,omitempty"`
+	// RelayServer is the TURN server the media was relayed through, only set for "disconnected" and when it was relayed
+	RelayServer string `json:"relayServer,omitempty"`
+}
+
+// sendWebhook posts the event in the background, retrying with an increasing delay
+func sendWebhook(logger connectionLogger, event webhookEvent) {
+	if *webhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Printf("cannot encode webhook: %v\n", err)
+		return
+	}
+	go func() {
+		delay := time.Second
+		for attempt := 0; ; attempt++ {
+			err := postWebhook(body)
+			if err == nil {
+				return
+			}
+			if attempt >= *webhookRetries {
+				logger.Printf("webhook %s failed, giving up: %v\n", event.Event, err)
+				return
+			}
+			logger.Printf("webhook %s failed, retrying in %v: %v\n", event.Event, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}()
+}
+
+func postWebhook(body []byte) error {
+	response, err := webhookClient.Post(*webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
@@ -2,32 +2,31 @@ module ashellunts/main
 
 go 1.17
 
-require (
-	github.com/pion/webrtc/v3 v3.1.0-beta.3
-)
+require github.com/pion/webrtc/v3 v3.1.0-beta.3
 
 require (
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
 	github.com/pion/datachannel v1.4.21 // indirect
-	github.com/pion/dtls/v2 v2.0.9 // indirect
-	github.com/pion/ice/v2 v2.1.12 // indirect
-	github.com/pion/interceptor v0.0.15 // indirect
-	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/dtls/v2 v2.0.9
+	github.com/pion/ice/v2 v2.1.12
+	github.com/pion/interceptor v0.0.15
+	github.com/pion/logging v0.2.2
 	github.com/pion/mdns v0.0.5 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.6 // indirect
-	github.com/pion/rtp v1.7.1 // indirect
+	github.com/pion/rtcp v1.2.6
+	github.com/pion/rtp v1.7.1
 	github.com/pion/sctp v1.7.12 // indirect
-	github.com/pion/sdp/v3 v3.0.4 // indirect
+	github.com/pion/sdp/v3 v3.0.4
 	github.com/pion/srtp/v2 v2.0.5 // indirect
 	github.com/pion/stun v0.3.5 // indirect
 	github.com/pion/transport v0.12.3 // indirect
-	github.com/pion/turn/v2 v2.0.5 // indirect
+	github.com/pion/turn/v2 v2.0.5
 	github.com/pion/udp v0.1.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/crypto v0.0.0-20210812204632-0ba0e8f03122 // indirect
-	golang.org/x/net v0.0.0-20210805182204-aaa1db679c0d // indirect
+	golang.org/x/net v0.0.0-20210805182204-aaa1db679c0d
 	golang.org/x/sys v0.0.0-20210809222454-d867a43fc93e // indirect
+	golang.org/x/text v0.3.6 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 )
@@ -4,97 +4,267 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/pion/webrtc/v3/pkg/media/h264reader"
 )
 
-const (
-	h264FrameDuration = time.Millisecond * 33
+// h264FrameDuration is the time between two frames in nanoseconds.
+// It can be changed at runtime through /config/fps, so always access it using frameDuration and setFrameDuration.
+var h264FrameDuration = int64(time.Millisecond * 33)
+
+func frameDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h264FrameDuration))
+}
+
+func setFrameDuration(duration time.Duration) {
+	atomic.StoreInt64(&h264FrameDuration, int64(duration))
+}
+
+var (
+	playlistFile = flag.String("playlist", "", "file listing inputs to play back-to-back, substituted for {input} in the ffmpeg arguments")
 )
 
-var globalConnectionId = 0
+// playlistItems are the inputs read from -playlist, if any
+var playlistItems []string
+
+// requestContentType returns the media type of the request body, without parameters like charset
+func requestContentType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// validRequestId reports whether a client supplied X-Request-ID is safe to put in our logs
+func validRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > 128 {
+		return false
+	}
+	for _, c := range requestId {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// signalingRequest describes the HTTP request that asks for a new connection
+type signalingRequest struct {
+	offer      string
+	requestId  string
+	remoteAddr string
+	// clientIp is the address of the client, taken from X-Forwarded-For behind -trusted-proxies
+	clientIp  string
+	userAgent string
+	// receivedAt is when the offer was received, the start of the time to first frame
+	receivedAt time.Time
+	// audioArgs are the ffmpeg arguments of the audio track the client selected, empty to send video only
+	audioArgs string
+	// debug logs the debugging details of this connection, as asked with X-Debug
+	debug bool
+	// cancelled is closed when the answer is no longer needed, like when the request timed out. nil when it is always needed.
+	cancelled <-chan struct{}
+}
 
-func setupConnection(browserOffer string) (string, error) {
-	globalConnectionId++
-	connectionId := globalConnectionId
-	fmt.Printf("[%d] Starting new session...\n", connectionId)
+func setupConnection(request signalingRequest) (string, int, error) {
+	connectionId := newConnectionId()
+	logger := connectionLogger{connectionId: connectionId, requestId: request.requestId, debug: request.debug}
+	logger.Printf("Starting new session for %s, User-Agent: %s\n", request.clientIp, request.userAgent)
+	if request.debug {
+		logger.Printf("Debug logging is enabled for this connection by X-Debug\n")
+	}
+	// congestion drops pictures as the feedback of the client tells it receives less than we send, nil with -congestion-control off
+	congestion := newCongestionController(logger)
 	// Create a new RTCPeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
+	peerConnection, err := NewPeerConnection(logger, webrtc.Configuration{
+		ICEServers:   gatheringIceServers(),
+		Certificates: dtlsCertificates,
+	}, congestion)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	iceConnectedCtx, iceConnectedCtxCancel := context.WithCancel(context.Background())
+	// closedCtx is cancelled once the PeerConnection is closed, writing samples to its track no longer fails
+	// after that, so the send loop has to check it to stop ffmpeg
+	closedCtx, closedCtxCancel := context.WithCancel(context.Background())
+	usage := newConnectionUsage(request.receivedAt)
+	// reporter tells a client that opened the quality data channel about the frames that were dropped
+	reporter := newDropReporter(logger)
+	peerConnection.OnDataChannel(reporter.handleDataChannel)
 
-	// Create a video track
-	videoTrack, videoTrackErr := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+	// Create a video track in the codec we prefer most of those the client offered
+	codec := chooseCodec(request.offer)
+	logger.Printf("Sending %s\n", codec)
+	capability := webrtc.RTPCodecCapability{MimeType: codecMimeTypes[codec]}
+	if codec == "h264" {
+		capability.SDPFmtpLine = h264FmtpLine()
+	}
+	videoTrack, videoTrackErr := webrtc.NewTrackLocalStaticSample(capability, "video", "pion")
 	if videoTrackErr != nil {
 		if cErr := peerConnection.Close(); cErr != nil {
-			fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+			logger.Printf("cannot close peerConnection: %v\n", cErr)
 		}
 		iceConnectedCtxCancel()
-		return "", videoTrackErr
+		closedCtxCancel()
+		return "", 0, videoTrackErr
 	}
 
 	rtpSender, videoTrackErr := peerConnection.AddTrack(videoTrack)
 	if videoTrackErr != nil {
+		videoTrackErr = explainTrackError(videoTrackErr, capability.MimeType)
+		logger.Printf("Cannot add the video track: %v\n", videoTrackErr)
 		if cErr := peerConnection.Close(); cErr != nil {
-			fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+			logger.Printf("cannot close peerConnection: %v\n", cErr)
 		}
 		iceConnectedCtxCancel()
-		return "", videoTrackErr
+		closedCtxCancel()
+		return "", 0, videoTrackErr
+	}
+
+	logSelectedCandidatePair(logger, rtpSender.Transport().ICETransport(), usage)
+
+	// hold puts the connection on hold through POST /pause/{id}
+	hold := &holdState{}
+
+	if request.audioArgs != "" && offersOpus(request.offer) {
+		audioTrack, audioTrackErr := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+		if audioTrackErr == nil {
+			var audioSender *webrtc.RTPSender
+			audioSender, audioTrackErr = peerConnection.AddTrack(audioTrack)
+			if audioTrackErr == nil {
+				// Read incoming RTCP packets, for the interceptors
+				go func() {
+					for {
+						if _, _, rtcpErr := audioSender.ReadRTCP(); rtcpErr != nil {
+							return
+						}
+					}
+				}()
+				go sendAudio(logger, peerConnection, request.offer, request.audioArgs, audioTrack, hold, iceConnectedCtx.Done(), closedCtx.Done())
+			}
+		}
+		if audioTrackErr != nil {
+			logger.Printf("Cannot add the audio track, sending video only: %v\n", audioTrackErr)
+		}
 	}
 
 	// Read incoming RTCP packets
 	// Before these packets are returned they are processed by interceptors. For things
 	// like NACK this needs to be called.
+	keyframes := &keyframeRequests{logger: logger}
 	go func() {
-		rtcpBuf := make([]byte, 1500)
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			packets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
 				return
 			}
+			keyframes.handleRTCP(packets)
 		}
 	}()
 
-	go func() {
-		dataPipe, err := RunCommand("ffmpeg", os.Args[1:]...)
+	// Honor the bandwidth limit of the offer by telling ffmpeg to stay under it
+	bitrateLimit := offeredBitrate(request.offer)
+	if bitrateLimit > 0 {
+		logger.Printf("The offer limits the bandwidth to %d kbps\n", bitrateLimit)
+	}
+	playing := defaultSource()
+	args := sourceFfmpegArgs(codec, playing, bitrateLimit)
+	// Stay within the frame rate and size the client can decode, ffmpeg can only be told to for ffmpeg sources
+	limits := offeredFrameLimits(request.offer, codec)
+	if limits != (frameLimits{}) {
+		logger.Printf("The offer limits the video to %s\n", limits)
+		if usesFfmpeg() {
+			args = limits.ffmpegArgs(args)
+		} else {
+			if limits.exceedsFrameRate() {
+				logger.Printf("Warning: the source is sent at %.3g fps, above the max-fr of the offer\n", float64(time.Second)/float64(frameDuration()))
+			}
+			// The frames of the source keep their rate, only their size is checked
+			limits.maxFrameRate = 0
+		}
+	}
+	var rampUpBitrates []uint64
+	if *rampUpDuration > 0 && usesFfmpeg() {
+		if rampUpBitrates = rampUpSteps(videoBitrate(args)); rampUpBitrates == nil {
+			logger.Printf("Not ramping up the video bitrate, the ffmpeg arguments set no -b:v to ramp up to\n")
+		} else {
+			logger.Printf("Ramping up the video bitrate from %d kbps to %d kbps in %v\n", rampUpBitrates[0], videoBitrate(args), *rampUpDuration)
+			args = limitBitrate(args, rampUpBitrates[0])
+		}
+	}
+	// source can be switched to another ffmpeg through POST /source while sending
+	source := &videoSource{lost: make(chan struct{}, 1)}
 
+	go func() {
+		defer lastWill()
+		dataPipe, err := startSource(logger, codec, args)
 		if err != nil {
-			fmt.Printf("[%d] datapipe err: %v\n", connectionId, err)
+			logger.Printf("datapipe err: %v\n", err)
 			if cErr := peerConnection.Close(); cErr != nil {
-				fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+				logger.Printf("cannot close peerConnection: %v\n", cErr)
+			}
+			return
+		}
+		if !source.start(dataPipe) {
+			// The source was switched while this ffmpeg was starting, or the connection closed
+			dataPipe = source.current()
+			if dataPipe == nil {
+				return
+			}
+		}
+
+		if isIvfCodec(codec) {
+			if *recordDir != "" {
+				logger.Printf("Recording is only supported for H264, not recording this connection\n")
+			}
+			if *frameSkip > 1 {
+				logger.Printf("Skipping frames is only supported for H264, sending every frame\n")
 			}
+			if fallbackFrame != nil {
+				logger.Printf("The fallback frame is only supported for H264, closing the connection when the source ends\n")
+			}
+			sendIvf(logger, peerConnection, codec, source, hold, videoTrack, usage, reporter, limits, iceConnectedCtx.Done(), closedCtx.Done())
 			return
 		}
 
 		h264, h264Err := h264reader.NewReader(dataPipe)
 		if h264Err != nil {
-			fmt.Printf("[%d] h264Err: %v\n", connectionId, h264Err)
+			logger.Printf("h264Err: %v\n", h264Err)
 			if cErr := peerConnection.Close(); cErr != nil {
-				fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+				logger.Printf("cannot close peerConnection: %v\n", cErr)
+			}
+			if cErr := source.Close(); cErr != nil {
+				logger.Printf("cannot close dataPipe: %v\n", cErr)
 			}
 			return
 		}
 
 		// Wait for connection established
-		<-iceConnectedCtx.Done()
+		select {
+		case <-iceConnectedCtx.Done():
+		case <-closedCtx.Done():
+		}
+		waitForPrebuffer(logger, closedCtx.Done())
+		source.active(time.Now())
 
 		// Send our video file frame at a time. Pace our sending so we send it at the same speed it should be played back as.
 		// This isn't required since the video is timestamped, but we will such much higher loss if we send all at once.
@@ -102,49 +272,327 @@ func setupConnection(browserOffer string) (string, error) {
 		// It is important to use a time.Ticker instead of time.Sleep because
 		// * avoids accumulating skew, just calling time.Sleep didn't compensate for the time spent parsing the data
 		// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
-		spsAndPpsCache := []byte{}
-		ticker := time.NewTicker(h264FrameDuration)
-		for ; true; <-ticker.C {
+		// With -shared-pacer the ticks come from a single ticker shared by all connections.
+		//
+		// Only pictures wait for the ticker, other NAL units like SEI are sent right away with the next picture,
+		// using the same RTP timestamp.
+		parameterSets := &parameterSetCache{persistent: *repeatParameterSets, announced: announcedParameterSets}
+		lastSps := []byte{}
+		record := startRecording(logger, connectionId)
+		defer record.close()
+		dropper := &frameDropper{logger: logger, threshold: *backpressureThreshold, pauseThreshold: *pauseThreshold, reporter: reporter, congestion: congestion}
+		skipper := &frameSkipper{logger: logger, n: *frameSkip}
+		grouper := &pictureGrouper{logger: logger}
+		reorderer := &pictureReorderer{logger: logger, depth: *reorderDepth}
+		sizes := &frameSizeChecker{logger: logger}
+		// pictureDropped tells whether the picture of the slices being read is dropped or skipped
+		pictureDropped := false
+		// held tells whether the connection was on hold at the last picture
+		held := false
+		// skipped is the duration of the frames skipped since the last slice sent, which that slice lasts longer
+		skipped := time.Duration(0)
+		clock := newRTPClock(uint32(*timestampClockRate), trackClockRate(peerConnection, videoTrack))
+		// negotiatedFmtp is compared with the SPS by -h264-level-check
+		negotiatedFmtp := trackFmtpLine(peerConnection, videoTrack)
+		tickerDuration := limits.frameDuration()
+		ticker := newFrameTicker(tickerDuration)
+		defer ticker.Stop()
+		waitForTick := func(interval time.Duration) {
+			select {
+			case <-ticker.ticks():
+				if dropper.ticked(time.Now(), interval) {
+					// Forget the tick that was queued during the pause
+					ticker.Reset(interval)
+				}
+			case <-closedCtx.Done():
+			}
+		}
+		// write sends a sample, it closes the connection and returns false when that fails
+		write := func(data []byte, duration time.Duration) bool {
+			writeStart := time.Now()
+			err := videoTrack.WriteSample(media.Sample{Data: data, Duration: duration})
+			dropper.wrote(time.Since(writeStart))
+			record.write(data)
+			if err != nil && connectionClosing(peerConnection) {
+				logger.Debugf("Stopped sending video, the connection is closing: %v\n", err)
+				if cErr := source.Close(); cErr != nil {
+					logger.Printf("cannot close dataPipe: %v\n", cErr)
+				}
+				return false
+			}
+			if err != nil {
+				logger.Printf("h264Err: %v\n", err)
+				if cErr := peerConnection.Close(); cErr != nil {
+					logger.Printf("cannot close peerConnection: %v\n", cErr)
+				}
+				if cErr := source.Close(); cErr != nil {
+					logger.Printf("cannot close dataPipe: %v\n", cErr)
+				}
+				return false
+			}
+			usage.sent(len(data))
+			logger.Debugf("Sent a picture of %d bytes lasting %v, writing took %v\n", len(data), duration, time.Since(writeStart))
+			return true
+		}
+		// sendSample writes the sample and waits for the tick following a picture
+		sendSample := func(sample queuedSample) bool {
+			if sample.data != nil {
+				if !write(sample.data, sample.duration) {
+					return false
+				}
+				if sample.tick > 0 {
+					thumbnail.sent(sample.data)
+				}
+			}
+			if sample.tick > 0 {
+				waitForTick(sample.tick)
+			}
+			return true
+		}
+		// send writes the sample right away, or with -send-queue queues it for the goroutine writing them
+		send := sendSample
+		// endQueue waits until the queued samples were written at the end of the stream, it reports false when writing failed
+		endQueue := func() bool { return true }
+		if *sendQueueDepth > 0 {
+			queue := newSendQueue(logger, *sendQueueDepth, reporter)
+			written := make(chan struct{})
+			go func() {
+				defer lastWill()
+				defer close(written)
+				for {
+					sample, ok := queue.pop()
+					if !ok {
+						return
+					}
+					if !sendSample(sample) {
+						queue.close()
+						return
+					}
+				}
+			}()
+			// The recording and the connection are closed once the writer stopped
+			defer func() {
+				queue.close()
+				<-written
+			}()
+			send = queue.push
+			endQueue = func() bool {
+				drained := queue.drain()
+				queue.close()
+				<-written
+				return drained
+			}
+		}
+		// sendOrdered sends the complete pictures in decoding order, each lasting a frame and the frames skipped or dropped before it
+		sendOrdered := func(pictures [][]byte) bool {
+			for _, picture := range pictures {
+				if !sizes.allowed(len(picture)) {
+					// The frames depending on it cannot be decoded either
+					skipped += tickerDuration
+					dropper.skipToKeyframe(dropReasonOversize)
+					reporter.frame(dropReasonOversize)
+					if !send(queuedSample{tick: tickerDuration}) {
+						return false
+					}
+					continue
+				}
+				ok := send(queuedSample{data: picture, duration: clock.sampleDuration(dropper.sampleDuration(tickerDuration) + skipped), tick: tickerDuration})
+				skipped = 0
+				if !ok {
+					return false
+				}
+			}
+			return true
+		}
+		// sendPictures sends the complete pictures, after the reorderer put them in decoding order
+		sendPictures := func(pictures [][]byte) bool {
+			return sendOrdered(reorderer.add(pictures))
+		}
+		// endPictures sends the pictures still held, at the end of the stream
+		endPictures := func() bool {
+			return sendPictures(grouper.end()) && sendOrdered(reorderer.flush())
+		}
+		// sendFallback sends the fallback frame every -fallback-interval while the source is restarted,
+		// until it was switched to the restarted ffmpeg or the connection closed
+		sendFallback := func() bool {
+			source.lose()
+			sinceSent := *fallbackInterval
+			for source.current() == dataPipe && closedCtx.Err() == nil {
+				// The source is not stalled, it is being restarted
+				source.active(time.Now())
+				if sinceSent >= *fallbackInterval && !hold.isHeld() {
+					if !send(queuedSample{data: fallbackFrame, duration: clock.sampleDuration(dropper.sampleDuration(tickerDuration) + skipped)}) {
+						return false
+					}
+					skipped = 0
+					sinceSent = 0
+				} else {
+					skipped += tickerDuration
+				}
+				if !send(queuedSample{tick: tickerDuration}) {
+					return false
+				}
+				sinceSent += tickerDuration
+			}
+			return true
+		}
+		for {
+			if closedCtx.Err() != nil {
+				if cErr := source.Close(); cErr != nil {
+					logger.Printf("cannot close dataPipe: %v\n", cErr)
+				}
+				return
+			}
+			if duration := limits.frameDuration(); duration != tickerDuration {
+				ticker.Reset(duration)
+				tickerDuration = duration
+			}
+
 			nal, h264Err := h264.NextNAL()
+			if h264Err == nil {
+				source.active(time.Now())
+			}
+			if next := source.current(); next != dataPipe {
+				// What is left of the old source may be cut off, continue at the start of the new one.
+				// Its parameter sets are cached again before its first keyframe.
+				logger.Printf("Switched the video source\n")
+				dataPipe = next
+				parameterSets.reset()
+				dropper.skipToKeyframe(dropReasonSourceSwitch)
+				grouper.reset()
+				reorderer.reset()
+				if h264, h264Err = h264reader.NewReader(dataPipe); h264Err == nil {
+					continue
+				}
+			}
+			if h264Err != nil && fallbackFrame != nil {
+				if !endPictures() {
+					return
+				}
+				logger.Printf("The video source ended (%v), sending the fallback frame until it is restarted\n", h264Err)
+				if !sendFallback() {
+					return
+				}
+				continue
+			}
 			if h264Err == io.EOF {
-				fmt.Printf("[%d] All video frames parsed and sent\n", connectionId)
+				if !endPictures() || !endQueue() {
+					return
+				}
+				logger.Printf("All video frames parsed and sent\n")
 				if cErr := peerConnection.Close(); cErr != nil {
-					fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+					logger.Printf("cannot close peerConnection: %v\n", cErr)
 				}
-				if cErr := dataPipe.Close(); cErr != nil {
-					fmt.Printf("[%d] cannot close dataPipe: %v\n", connectionId, cErr)
+				if cErr := source.Close(); cErr != nil {
+					logger.Printf("cannot close dataPipe: %v\n", cErr)
 				}
 				return
 			}
 			if h264Err != nil {
-				fmt.Printf("[%d] h264Err: %v\n", connectionId, h264Err)
+				logger.Printf("h264Err: %v\n", h264Err)
 				if cErr := peerConnection.Close(); cErr != nil {
-					fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+					logger.Printf("cannot close peerConnection: %v\n", cErr)
 				}
-				if cErr := dataPipe.Close(); cErr != nil {
-					fmt.Printf("[%d] cannot close dataPipe: %v\n", connectionId, cErr)
+				if cErr := source.Close(); cErr != nil {
+					logger.Printf("cannot close dataPipe: %v\n", cErr)
 				}
 				return
 			}
 
+			if nal.UnitType == h264reader.NalUnitTypeSPS && !bytes.Equal(nal.Data, lastSps) {
+				lastSps = nal.Data
+				if info, err := parseSps(nal.Data); err != nil {
+					logger.Printf("Cannot parse SPS: %v\n", err)
+				} else {
+					logger.Printf("Stream resolution: %s\n", info)
+					reorderer.setSps(info)
+					if exceeded := limits.exceededBy(info); exceeded != "" {
+						logger.Printf("Warning: the client may not decode this stream, %s\n", exceeded)
+					}
+					if problems := checkH264Level(info, negotiatedFmtp); *h264LevelCheck != "off" && problems != nil {
+						logger.Printf("Warning: the client negotiated H264 %s, it may not decode this stream: %s\n", negotiatedFmtp, strings.Join(problems, ", "))
+						if *h264LevelCheck == "refuse" {
+							logger.Printf("Closing the connection, it is refused by -h264-level-check\n")
+							if cErr := peerConnection.Close(); cErr != nil {
+								logger.Printf("cannot close peerConnection: %v\n", cErr)
+							}
+							if cErr := source.Close(); cErr != nil {
+								logger.Printf("cannot close dataPipe: %v\n", cErr)
+							}
+							return
+						}
+					}
+				}
+			}
+
+			// The other slices of a picture follow the decision made for its first slice
+			continuation := continuesPicture(nal)
+			if continuation {
+				dropper.continued(nal)
+			}
+			if continuation && pictureDropped {
+				continue
+			}
+			if !continuation && isSlice(nal.UnitType) {
+				if nowHeld := hold.isHeld(); nowHeld != held {
+					held = nowHeld
+					if !held {
+						dropper.skipToKeyframe(dropReasonHold)
+					}
+				}
+				if held {
+					// Held pictures are paced like skipped ones, the timestamps keep following the clock
+					skipped += tickerDuration
+					pictureDropped = true
+					reporter.frame(dropReasonHold)
+					if !send(queuedSample{tick: tickerDuration}) {
+						return
+					}
+					continue
+				}
+			}
+			if !continuation && dropper.shouldDrop(nal) {
+				if nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr {
+					parameterSets.droppedKeyframe()
+				}
+				pictureDropped = true
+				continue
+			}
+			if !continuation && skipper.shouldSkip(nal, tickerDuration) {
+				// Skipped frames are still paced, so the source plays at its own speed
+				skipped += tickerDuration
+				pictureDropped = true
+				reporter.frame(dropReasonFrameSkip)
+				if !send(queuedSample{tick: tickerDuration}) {
+					return
+				}
+				continue
+			}
+			if isSlice(nal.UnitType) {
+				pictureDropped = false
+			}
+
 			nal.Data = append([]byte{0x00, 0x00, 0x00, 0x01}, nal.Data...)
 
 			if nal.UnitType == h264reader.NalUnitTypeSPS || nal.UnitType == h264reader.NalUnitTypePPS {
-				spsAndPpsCache = append(spsAndPpsCache, nal.Data...)
+				parameterSets.add(nal.UnitType, nal.Data)
 				continue
-			} else if nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr {
-				nal.Data = append(spsAndPpsCache, nal.Data...)
-				spsAndPpsCache = []byte{}
 			}
 
-			if h264Err = videoTrack.WriteSample(media.Sample{Data: nal.Data, Duration: time.Second}); h264Err != nil {
-				fmt.Printf("[%d] h264Err: %v\n", connectionId, h264Err)
-				if cErr := peerConnection.Close(); cErr != nil {
-					fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
-				}
-				if cErr := dataPipe.Close(); cErr != nil {
-					fmt.Printf("[%d] cannot close dataPipe: %v\n", connectionId, cErr)
+			if !continuation && (*seiMode == "frame" && isSlice(nal.UnitType) || *seiMode == "keyframe" && nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr) {
+				nal.Data = append(append([]byte{0x00, 0x00, 0x00, 0x01}, newTimestampSei(time.Now())...), nal.Data...)
+			}
+			if !continuation && nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr {
+				nal.Data = append(parameterSets.keyframe(), nal.Data...)
+			}
+
+			if isSlice(nal.UnitType) {
+				if !sendPictures(grouper.slice(nal.Data, !continuation)) {
+					return
 				}
+				continue
+			}
+			if !sendPictures(grouper.end()) || !send(queuedSample{data: nal.Data}) {
 				return
 			}
 		}
@@ -152,97 +600,471 @@ func setupConnection(browserOffer string) (string, error) {
 
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
+	// dtlsConnected is closed once the PeerConnection connected, after the DTLS handshake completed
+	dtlsConnected := make(chan struct{})
+	var dtlsConnectedOnce, dtlsWatchOnce sync.Once
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("[%d] Connection State has changed %s\n", connectionId, connectionState.String())
+		logger.Printf("Connection State has changed %s\n", connectionState.String())
 		if connectionState == webrtc.ICEConnectionStateConnected {
 			iceConnectedCtxCancel()
+			if *dtlsTimeout > 0 {
+				dtlsWatchOnce.Do(func() {
+					go func() {
+						if !dtlsHandshakeTimedOut(dtlsConnected, closedCtx.Done()) {
+							return
+						}
+						logger.Printf("DTLS timeout: the handshake did not complete within %v after ICE connected, a firewall may drop its packets. Closing the connection\n", *dtlsTimeout)
+						sendWebhook(logger, webhookEvent{Event: "failed", Reason: "dtls-timeout", ConnectionId: connectionId, RequestId: request.requestId, RemoteAddr: request.remoteAddr, ClientIp: request.clientIp, UserAgent: request.userAgent, Timestamp: time.Now()})
+						if cErr := peerConnection.Close(); cErr != nil {
+							logger.Printf("cannot close peerConnection: %v\n", cErr)
+						}
+					}()
+				})
+			}
 		}
 	})
 
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		fmt.Printf("[%d] Peer Connection State has changed: %s\n", connectionId, s.String())
+		logger.Printf("Peer Connection State has changed: %s\n", s.String())
+
+		if s == webrtc.PeerConnectionStateConnected {
+			dtlsConnectedOnce.Do(func() { close(dtlsConnected) })
+			usage.connected(time.Now())
+			sendWebhook(logger, webhookEvent{Event: "connected", ConnectionId: connectionId, RequestId: request.requestId, RemoteAddr: request.remoteAddr, ClientIp: request.clientIp, UserAgent: request.userAgent, Timestamp: time.Now()})
+		}
+
+		if s == webrtc.PeerConnectionStateClosed {
+			closedCtxCancel()
+			sessions.Remove(connectionId)
+			bytesSent, duration := usage.report(time.Now())
+			timeToFirstFrame := usage.timeToFirstFrame()
+			relayServer := usage.relayedThrough()
+			if relayServer != "" {
+				logger.Printf("The media was relayed via %s\n", relayServer)
+			}
+			if timeToFirstFrame > 0 {
+				logger.Printf("Sent %d bytes of media to %s in %v, the first frame was sent %v after the offer\n", bytesSent, request.clientIp, duration.Round(time.Millisecond), timeToFirstFrame.Round(time.Millisecond))
+			} else {
+				logger.Printf("Sent %d bytes of media to %s in %v, no frame was sent\n", bytesSent, request.clientIp, duration.Round(time.Millisecond))
+			}
+			sendWebhook(logger, webhookEvent{Event: "disconnected", ConnectionId: connectionId, RequestId: request.requestId, RemoteAddr: request.remoteAddr, ClientIp: request.clientIp, UserAgent: request.userAgent, Timestamp: time.Now(), BytesSent: bytesSent, DurationSeconds: duration.Seconds(), TimeToFirstFrameSeconds: timeToFirstFrame.Seconds(), RelayServer: relayServer})
+		}
 
 		if s == webrtc.PeerConnectionStateFailed {
 			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
 			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
 			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-			fmt.Printf("[%d] Exiting...", connectionId)
+			logger.Printf("Exiting...\n")
 
 			if cErr := peerConnection.Close(); cErr != nil {
-				fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+				logger.Printf("cannot close peerConnection: %v\n", cErr)
 			}
 		}
 	})
 
+	gathered := make(chan struct{})
+	s := &session{id: connectionId, logger: logger, peerConnection: peerConnection, videoSender: rtpSender, mimeType: videoTrack.Codec().MimeType, codec: codec, bitrateLimit: bitrateLimit, frameLimits: limits, source: source, playing: playing, closed: closedCtx.Done(), gathered: gathered, hold: hold, keyframes: keyframes}
+	sessions.Add(s)
+	keyframes.attach(s)
+	if rampUpBitrates != nil {
+		s.rampUpLimit = rampUpBitrates[0]
+		go rampUp(s, rampUpBitrates, iceConnectedCtx.Done())
+	}
+	if *sourceStallTimeout > 0 {
+		go watchSource(s)
+	}
+	if fallbackFrame != nil && !isIvfCodec(codec) {
+		go superviseSource(s)
+	}
+
 	offer := webrtc.SessionDescription{}
 	offer.Type = webrtc.SDPTypeOffer
-	offer.SDP = browserOffer
+	offer.SDP = request.offer
 
-	fmt.Printf("[%d] Reading offer...\n%s\n", connectionId, browserOffer)
+	logger.Printf("Reading offer...\n%s\n", request.offer)
 	if err = peerConnection.SetRemoteDescription(offer); err != nil {
 		if cErr := peerConnection.Close(); cErr != nil {
-			fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+			logger.Printf("cannot close peerConnection: %v\n", cErr)
 		}
-		return "", err
+		return "", 0, err
 	}
 
-	fmt.Printf("[%d] Creating answer...\n", connectionId)
+	if transceiver := senderTransceiver(peerConnection, rtpSender); transceiver != nil {
+		applyOfferedCodecPreferences(logger, transceiver, request.offer, videoTrack.Codec().MimeType)
+	}
+	inactivateUnusedTransceivers(logger, peerConnection)
+
+	logger.Printf("Creating answer...\n")
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
 		if cErr := peerConnection.Close(); cErr != nil {
-			fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+			logger.Printf("cannot close peerConnection: %v\n", cErr)
 		}
-		return "", err
+		return "", 0, err
+	}
+
+	if err = validateAnswer(answer.SDP, request.offer, videoTrack.Codec().MimeType); err != nil {
+		if cErr := peerConnection.Close(); cErr != nil {
+			logger.Printf("cannot close peerConnection: %v\n", cErr)
+		}
+		return "", 0, err
 	}
 
 	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	go func() {
+		<-gatherComplete
+		if description := s.localDescription(); description != nil {
+			logMissingRelayCandidates(logger, description.SDP)
+		}
+		close(gathered)
+	}()
 
-	fmt.Printf("[%d] Setting local description...\n", connectionId)
+	logger.Printf("Setting local description...\n")
 	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		// The track is bound to its codec when the answer is applied
+		err = explainTrackError(err, videoTrack.Codec().MimeType)
 		if cErr := peerConnection.Close(); cErr != nil {
-			fmt.Printf("[%d] cannot close peerConnection: %v\n", connectionId, cErr)
+			logger.Printf("cannot close peerConnection: %v\n", cErr)
+		}
+		return "", 0, err
+	}
+
+	// Clients that trickle get the answer right away and the rest of our candidates through GET /session/<id>.
+	// For the others block until ICE Gathering is complete, as they only exchange one signaling message.
+	trickle := offerTrickles(request.offer)
+	if trickle {
+		logger.Printf("The client trickles ICE candidates, answering before ours are gathered\n")
+	} else {
+		select {
+		case <-gatherComplete:
+		case <-request.cancelled:
+			logger.Printf("The request was cancelled while gathering ICE candidates\n")
+			if cErr := peerConnection.Close(); cErr != nil {
+				logger.Printf("cannot close peerConnection: %v\n", cErr)
+			}
+			return "", 0, errRequestCancelled
 		}
-		return "", err
 	}
 
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
+	// Changes needing negotiation after the initial answer are reported to the session
+	peerConnection.OnNegotiationNeeded(s.negotiationNeeded)
 
-	fmt.Printf("[%d] Sending local description...\n", connectionId)
-	sdp := *peerConnection.LocalDescription()
-	return sdp.SDP, nil
+	logger.Printf("Sending local description...\n")
+	description := s.localDescription()
+	if description == nil {
+		return "", 0, errConnectionClosed
+	}
+	sdpAnswer := rewriteAnswer(pruneRelayCandidates(logger, description.SDP))
+	if !trickle && !hasCandidates(sdpAnswer) {
+		// The client could not reach us, the connection would silently fail
+		logger.Printf("Gathered no ICE candidates, the host has no usable network interface\n")
+		if cErr := peerConnection.Close(); cErr != nil {
+			logger.Printf("cannot close peerConnection: %v\n", cErr)
+		}
+		return "", 0, errNoIceCandidates
+	}
+	if trickle {
+		sdpAnswer = withTrickleOption(sdpAnswer)
+	}
+	logger.Debugf("Answer...\n%s\n", sdpAnswer)
+	return sdpAnswer, connectionId, nil
 }
 
-func main() {
-	fmt.Printf("Starting...\n")
+// newRouter returns the handlers of the HTTP signaling and control endpoints
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("content-type") == "application/sdp" {
+	r.HandleFunc("/", requireToken(func(w http.ResponseWriter, r *http.Request) {
+		receivedAt := time.Now()
+		requestId := r.Header.Get("X-Request-ID")
+		if !validRequestId(requestId) {
+			requestId = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", requestId)
+
+		var sdpOffer string
+		switch requestContentType(r) {
+		case "application/sdp":
 			buf := new(strings.Builder)
 			if _, err := io.Copy(buf, r.Body); err != nil {
-				http.Error(w, "Error1: "+err.Error(), http.StatusInternalServerError)
+				bodyReadFailed(w, err)
+				return
+			}
+			sdpOffer = buf.String()
+		case "application/x-www-form-urlencoded":
+			// For clients that cannot send a raw body, like a plain HTML form
+			if err := r.ParseForm(); err != nil && isTimeout(err) {
+				bodyReadFailed(w, err)
+				return
+			}
+			sdpOffer = r.PostFormValue("offer")
+			if sdpOffer == "" {
+				http.Error(w, "Missing offer form field", http.StatusBadRequest)
 				return
 			}
+		default:
+			http.Error(w, "Unaceptable", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := checkSdpBody(sdpOffer); err != nil {
+			http.Error(w, "Invalid offer: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
-			sdpOffer := buf.String()
-			sdpAnswer, err := setupConnection(sdpOffer)
+		audioArgs, err := selectAudioArgs(r.URL.Query().Get("audio"))
+		if err == errUnknownAudioLanguage {
+			http.Error(w, fmt.Sprintf("Unknown audio language, available are: %s", strings.Join(audioTracks.languages(), ", ")), http.StatusBadRequest)
+			return
+		}
+
+		sdpAnswer, connectionId, err := setupConnection(signalingRequest{
+			offer:      sdpOffer,
+			requestId:  requestId,
+			remoteAddr: r.RemoteAddr,
+			clientIp:   clientIp(r),
+			userAgent:  r.UserAgent(),
+			receivedAt: receivedAt,
+			cancelled:  r.Context().Done(),
+			audioArgs:  audioArgs,
+			debug:      requestedDebug(r),
+		})
+		if err == errRequestCancelled && r.Context().Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		if err == errNoIceCandidates {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if codecErr, ok := err.(noCommonCodecError); ok {
+			http.Error(w, codecErr.diagnostic(), http.StatusNotAcceptable)
+			return
+		}
+		if _, ok := err.(trackCodecError); ok {
+			// Tell the codec misconfiguration apart from failures of the connection itself
+			http.Error(w, "Unsupported video codec: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error2: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf(sdpAnswer)
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", fmt.Sprintf("%s/session/%d", requestBaseURL(r), connectionId))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(sdpAnswer))
+	})).Methods("POST")
+
+	r.HandleFunc("/session/{id:[0-9]+}", requireToken(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+		s := sessions.Get(id)
+		if s == nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+
+		switch requestContentType(r) {
+		case "application/sdp":
+			buf := new(strings.Builder)
+			if _, err := io.Copy(buf, r.Body); err != nil {
+				bodyReadFailed(w, err)
+				return
+			}
+
+			if err := checkSdpBody(buf.String()); err != nil {
+				http.Error(w, "Invalid offer: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			sdpAnswer, err := s.renegotiate(buf.String())
+			if codecErr, ok := err.(noCommonCodecError); ok {
+				http.Error(w, codecErr.diagnostic(), http.StatusNotAcceptable)
+				return
+			}
+			if _, ok := err.(trackCodecError); ok {
+				http.Error(w, "Unsupported video codec: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
 			if err != nil {
-				http.Error(w, "Error2: "+err.Error(), http.StatusInternalServerError)
+				http.Error(w, "Error2: "+err.Error(), http.StatusBadRequest)
 				return
 			}
-			fmt.Printf(sdpAnswer)
 			w.Header().Set("Content-Type", "application/sdp")
 			w.Write([]byte(sdpAnswer))
 			return
+		case "application/trickle-ice-sdpfrag":
+			buf := new(strings.Builder)
+			if _, err := io.Copy(buf, r.Body); err != nil {
+				bodyReadFailed(w, err)
+				return
+			}
+
+			frag, err := parseSdpFrag(buf.String())
+			if err != nil {
+				http.Error(w, "Invalid sdpfrag: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if remote := s.peerConnection.RemoteDescription(); frag.iceUfrag != "" && remote != nil && frag.iceUfrag != sdpIceUfrag(remote.SDP) {
+				http.Error(w, "ICE restarts are not supported", http.StatusNotImplemented)
+				return
+			}
+			for _, candidate := range frag.candidates {
+				s.logger.Printf("Adding remote candidate %s\n", candidate.Candidate)
+				if err := s.peerConnection.AddICECandidate(candidate); err != nil {
+					http.Error(w, "Error2: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 		http.Error(w, "Unaceptable", http.StatusUnsupportedMediaType)
-	}).Methods("POST")
+	})).Methods("PATCH")
+
+	r.HandleFunc("/session/{id:[0-9]+}", requireToken(handleLocalCandidates)).Methods("GET")
+	r.HandleFunc("/session/{id:[0-9]+}", requireToken(handleDeleteSession)).Methods("DELETE")
+	r.HandleFunc("/session/{id:[0-9]+}/stats", requireToken(handleStats)).Methods("GET")
+
+	r.HandleFunc("/version", handleVersion).Methods("GET")
+
+	r.HandleFunc("/thumbnail", requireToken(handleThumbnail)).Methods("GET")
+
+	r.HandleFunc("/source", requireToken(handleSource)).Methods("POST")
+
+	r.HandleFunc("/pause/{id:[0-9]+}", requireToken(handleHold(true))).Methods("POST")
+	r.HandleFunc("/resume/{id:[0-9]+}", requireToken(handleHold(false))).Methods("POST")
+
+	r.HandleFunc("/config", requireToken(handleConfig)).Methods("GET")
+	r.HandleFunc("/config/fps", requireToken(func(w http.ResponseWriter, r *http.Request) {
+		fps, err := strconv.ParseFloat(r.FormValue("fps"), 64)
+		if err != nil || fps < 1 || fps > 240 {
+			http.Error(w, "fps must be a number between 1 and 240", http.StatusBadRequest)
+			return
+		}
+		duration := time.Duration(float64(time.Second) / fps)
+		setFrameDuration(duration)
+		fmt.Printf("Frame duration changed to %v (%g fps)\n", duration, fps)
+		fmt.Fprintf(w, "%v\n", duration)
+	})).Methods("POST")
+
+	r.MethodNotAllowedHandler = methodNotAllowed(r)
+	return r
+}
+
+func main() {
+	defer lastWill()
+	if err := parseCommandLine(os.Args[1:]); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	if err := validateConfig(); err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *fallbackFrameFile != "" {
+		frame, err := loadFallbackFrame(*fallbackFrameFile)
+		if err != nil {
+			fmt.Printf("Cannot read the fallback frame: %v\n", err)
+			os.Exit(1)
+		}
+		fallbackFrame = frame
+	}
+
+	if err := setupInterfaceFilter(); err != nil {
+		fmt.Printf("Cannot select the ICE interfaces: %v\n", err)
+		os.Exit(1)
+	}
 
-	fmt.Printf("Listening on: http://[::]:5050/\n")
-	http.ListenAndServe("[::]:5050", r)
+	if err := setupUDPMux(); err != nil {
+		fmt.Printf("Cannot open UDP port: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := setupTCPMux(); err != nil {
+		fmt.Printf("Cannot open TCP port for ICE: %v\n", err)
+		os.Exit(1)
+	}
 
+	if _, ok := mediaSource.(rtpMediaSource); ok && !*checkOnly {
+		if err := startRtpIngest(); err != nil {
+			fmt.Printf("Cannot open RTP port: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *dtlsCert != "" || *dtlsKey != "" {
+		certificate, err := loadDTLSCertificate(*dtlsCert, *dtlsKey)
+		if err != nil {
+			fmt.Printf("Cannot load DTLS certificate: %v\n", err)
+			os.Exit(1)
+		}
+		fingerprints, err := certificate.GetFingerprints()
+		if err != nil {
+			fmt.Printf("Cannot load DTLS certificate: %v\n", err)
+			os.Exit(1)
+		}
+		for _, fingerprint := range fingerprints {
+			fmt.Printf("DTLS fingerprint: %s %s\n", fingerprint.Algorithm, fingerprint.Value)
+		}
+		dtlsCertificates = []webrtc.Certificate{certificate}
+	}
+
+	if *tlsCert != "" {
+		config, err := loadSignalingTLS(*tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Printf("Cannot load TLS certificate: %v\n", err)
+			os.Exit(1)
+		}
+		signalingTLS = config
+	}
+
+	if *playlistFile != "" {
+		items, err := ReadPlaylist(*playlistFile)
+		if err != nil {
+			fmt.Printf("Cannot read playlist: %v\n", err)
+			os.Exit(1)
+		}
+		if !strings.Contains(strings.Join(ffmpegArgs, " "), playlistInputPlaceholder) {
+			fmt.Printf("The ffmpeg arguments must contain %s when using a playlist\n", playlistInputPlaceholder)
+			os.Exit(1)
+		}
+		playlistItems = items
+	}
+
+	if *checkOnly {
+		os.Exit(runCheck())
+	}
+	if *selfTest {
+		os.Exit(runSelfTest())
+	}
+
+	if *spropParameterSets {
+		if err := loadSpropParameterSets(); err != nil {
+			fmt.Printf("Cannot read the parameter sets of the video source: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Announcing the parameter sets of the video source: %s\n", spropValue)
+	}
+
+	warmPool.refill()
+
+	if *offerFile != "" {
+		os.Exit(runOffline())
+	}
+
+	fmt.Printf("Starting...\n")
+	go switchSourceOnHangup()
+	if *turnCheck {
+		checkTurnServers()
+	}
+
+	fmt.Printf("Listening on: %s://%s/\n", listenScheme(), *listenAddress)
+	if err := serve(withRequestTimeout(newRouter())); err != nil {
+		fmt.Printf("Cannot listen: %v\n", err)
+		sendLastWill(fmt.Sprintf("cannot listen: %v", err))
+		os.Exit(1)
+	}
 }